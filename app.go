@@ -2,14 +2,18 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/husio/gallery/gallery/geocode"
 	"github.com/husio/gallery/gallery/handler"
+	"github.com/husio/gallery/gallery/iiif"
 	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/gallery/tus"
+	"github.com/husio/gallery/sq"
 	"github.com/husio/gallery/web"
 
 	"github.com/husio/x/envconf"
@@ -21,6 +25,48 @@ type configuration struct {
 	Database     string
 	UploadDir    string
 	ThumbnailDir string
+
+	// ThumbnailStore is either "dir", to keep every rendition in a separate
+	// file in ThumbnailDir, or "sqlite", to keep all of them in a single
+	// ThumbnailDatabase file.
+	ThumbnailStore    string
+	ThumbnailDatabase string
+	// ThumbnailCacheMax limits the total size of stored renditions, for
+	// example 20GB. Least recently used renditions are removed and created
+	// again when requested. Empty value means no limit.
+	ThumbnailCacheMax string
+
+	// Upload form size limits, in bytes.
+	UploadMaxFileSize    int64
+	UploadMaxRequestSize int64
+
+	// Comma separated list of rendition presets, in format
+	// name:<width>x<height>:<fill|fit>:<quality>. If PregenerateRenditions
+	// is true, renditions are created right after the upload, instead of
+	// on the first request.
+	Renditions            string
+	PregenerateRenditions bool
+	// RenditionWorkers is the maximum number of renditions created at the
+	// same time. Zero means the number of CPUs.
+	RenditionWorkers int
+
+	// IIIF Image API rendered images cache and output size limits.
+	IIIFCacheDir  string
+	IIIFMaxWidth  int
+	IIIFMaxHeight int
+	IIIFMaxArea   int
+
+	// Resumable uploads configuration. Uploads not modified for longer than
+	// expiry time are removed.
+	TusDir     string
+	TusMaxSize int64
+	TusExpiry  string
+
+	// GeoNames dump files used to tag geotagged photos with place names.
+	// Place tagging is disabled if cities file is not provided.
+	GeonamesCities      string
+	GeonamesCountries   string
+	GeonamesMaxDistance float64
 }
 
 func main() {
@@ -29,12 +75,34 @@ func main() {
 		Database:     "/tmp/gallery/db.sqlite3",
 		UploadDir:    "/tmp/gallery/photos",
 		ThumbnailDir: "/tmp/gallery/thumbnails",
+
+		ThumbnailStore:    "dir",
+		ThumbnailDatabase: "/tmp/gallery/thumbnails.sqlite3",
+
+		UploadMaxFileSize:    100 * 1e6,
+		UploadMaxRequestSize: 1000 * 1e6,
+
+		Renditions: storage.DefaultPresets,
+
+		IIIFCacheDir:  "/tmp/gallery/iiif",
+		IIIFMaxWidth:  4000,
+		IIIFMaxHeight: 4000,
+		IIIFMaxArea:   16000000,
+
+		TusDir:     "/tmp/gallery/tus",
+		TusMaxSize: 200 * 1e6,
+		TusExpiry:  "24h",
+
+		GeonamesMaxDistance: 50,
 	}
 	envconf.Must(envconf.LoadEnv(&conf))
 
 	os.MkdirAll(conf.UploadDir, 0777)
 	os.MkdirAll(conf.ThumbnailDir, 0777)
+	os.MkdirAll(conf.IIIFCacheDir, 0777)
+	os.MkdirAll(conf.TusDir, 0777)
 	os.MkdirAll(filepath.Dir(conf.Database), 0777)
+	os.MkdirAll(filepath.Dir(conf.ThumbnailDatabase), 0777)
 
 	if err := run(conf); err != nil {
 		log.Fatalf("application error: %s", err)
@@ -50,16 +118,107 @@ func run(conf configuration) error {
 	if err := db.Ping(); err != nil {
 		return fmt.Errorf("cannot ping database: %s", err)
 	}
+	if err := storage.Migrate(db); err != nil {
+		return fmt.Errorf("cannot migrate database: %s", err)
+	}
+
+	var places storage.PlaceFinder
+	if conf.GeonamesCities != "" {
+		idx, err := geocode.LoadFiles(conf.GeonamesCities, conf.GeonamesCountries)
+		if err != nil {
+			return fmt.Errorf("cannot load places: %s", err)
+		}
+		idx.MaxDistance = conf.GeonamesMaxDistance
+		places = idx
+	}
 
-	fs := storage.NewFileStore(conf.UploadDir, conf.ThumbnailDir)
-	uploader := storage.NewUploader(db, fs)
+	presets, err := storage.ParsePresets(conf.Renditions)
+	if err != nil {
+		return fmt.Errorf("invalid renditions configuration: %s", err)
+	}
+	var pregenerate storage.Presets
+	if conf.PregenerateRenditions {
+		pregenerate = presets
+	}
+
+	// thumbnails created before rendition presets were introduced are
+	// kept in the thumbnails directory, whichever store is used now
+	if n, err := storage.NewDirRenditionStore(conf.ThumbnailDir).RemoveLegacy(); err != nil {
+		log.Printf("cannot remove legacy thumbnails: %s", err)
+	} else if n != 0 {
+		log.Printf("%d legacy thumbnails removed", n)
+	}
+
+	var renditions storage.RenditionStore
+	switch conf.ThumbnailStore {
+	case "dir":
+		renditions = storage.NewDirRenditionStore(conf.ThumbnailDir)
+	case "sqlite":
+		store, err := storage.OpenSQLRenditionStore(conf.ThumbnailDatabase)
+		if err != nil {
+			return fmt.Errorf("cannot open thumbnail database: %s", err)
+		}
+		defer store.Close()
+		renditions = store
+	default:
+		return fmt.Errorf("unknown thumbnail store %q", conf.ThumbnailStore)
+	}
+
+	var cacheStats func() storage.CacheStats
+	if conf.ThumbnailCacheMax != "" {
+		maxSize, err := storage.ParseSize(conf.ThumbnailCacheMax)
+		if err != nil {
+			return fmt.Errorf("invalid thumbnail cache size: %s", err)
+		}
+		cache, err := storage.NewRenditionCache(renditions, maxSize)
+		if err != nil {
+			return fmt.Errorf("cannot create thumbnail cache: %s", err)
+		}
+		go cache.RunSweeper(time.Minute)
+		cacheStats = cache.Stats
+		renditions = cache
+	}
+
+	fs := storage.NewFileStore(conf.UploadDir, renditions, conf.RenditionWorkers)
+	uploader := storage.NewUploader(sq.NewDatabase(db), fs, places, pregenerate)
+	geotagger := storage.NewGeotagger(db, fs, places)
+	iiifCache := iiif.NewDiskCache(conf.IIIFCacheDir)
+	editor := storage.NewEditor(sq.NewDatabase(db), fs, iiifCache)
+
+	tusExpiry, err := time.ParseDuration(conf.TusExpiry)
+	if err != nil {
+		return fmt.Errorf("invalid resumable upload expiry time: %s", err)
+	}
+	resumable := tus.NewServer(conf.TusDir, "/upload/tus", conf.TusMaxSize, tusExpiry, handler.TusUpload(uploader.Upload))
+	go resumable.RunSweeper(time.Hour)
+
+	iiifLimits := iiif.Limits{
+		MaxWidth:  conf.IIIFMaxWidth,
+		MaxHeight: conf.IIIFMaxHeight,
+		MaxArea:   conf.IIIFMaxArea,
+	}
 
 	rt := web.NewRouter()
-	rt.Add(`/`, "GET", handler.PhotoList(db, storage.Images))
-	rt.Add(`/upload`, "GET,POST", handler.PhotoUpload(db, storage.TagGroups, uploader.Upload))
-	fsRead := func(year, orient int, imgID string) (io.ReadCloser, error) { return fs.Read(year, imgID) }
-	rt.Add(`/photo/(name)`, "GET", handler.ServePhoto(db, storage.ImageByID, fsRead))
-	rt.Add(`/thumbnail/(name)\.jpg`, "GET", handler.ServePhoto(db, storage.ImageByID, fs.ReadThumbnail))
+	rt.Add(`/`, "GET", handler.PhotoList(db, storage.Images, presets.Alternatives(storage.ThumbnailPreset)))
+	rt.Add(`/photos\.geojson`, "GET", handler.PhotoGeoJSON(db, storage.Images))
+	rt.Add(`/upload`, "GET,POST", handler.PhotoUpload(db, storage.TagGroups, fs.Spool, uploader.Upload, conf.UploadMaxFileSize, conf.UploadMaxRequestSize))
+	rt.Add(`/upload/tus`, "OPTIONS,POST", resumable.Collection)
+	rt.Add(`/upload/tus/(id)`, "OPTIONS,HEAD,PATCH,DELETE", resumable.Upload)
+	rt.Add(`/geotag`, "GET,POST", handler.Geotag(geotagger.Geotag))
+	rt.Add(`/photo/(name)`, "GET", handler.ServePhoto(db, storage.ImageByID, fs.Read))
+	rt.Add(`/photo/(name)/orientation`, "POST", handler.PhotoOrientation(editor.SetOrientation))
+	rt.Add(`/photo/(name)/focus`, "POST", handler.PhotoFocus(editor.SetFocus))
+	rt.Add(`/photo/(name)/text`, "GET,POST,PATCH", handler.PhotoText(db, storage.ImageByID, editor.SetText))
+	rt.Add(`/photo/(name)/similar`, "GET", handler.SimilarPhotos(db, storage.SimilarImages))
+	rt.Add(`/duplicates`, "GET", handler.DuplicatePhotos(db, storage.DuplicateCandidates))
+	rt.Add(`/review`, "GET,POST", handler.PhotoReview(db, storage.Images, editor.Delete))
+	rt.Add(`/thumbnail/(name)\.jpg`, "GET", handler.ThumbnailRedirect())
+	rt.Add(`/rendition/(preset)/(name)`, "GET", handler.ServeRendition(db, storage.ImageByID, presets, fs.ReadRendition))
+	rt.Add(`/admin/tags`, "GET,POST", handler.TagAdmin(db, storage.TagGroups, storage.TagAliases, storage.NewTagManager(sq.NewDatabase(db))))
+	rt.Add(`/admin/thumbnails`, "GET", handler.ThumbnailStats(cacheStats, fs.RenditionStats))
+	rt.Add(`/iiif/(id)`, "GET", handler.IIIFBaseRedirect())
+	rt.Add(`/iiif/(id)/info\.json`, "GET", handler.IIIFInfo(db, storage.ImageByID, iiifLimits))
+	rt.Add(`/iiif/(id)/(region)/(size)/(rotation)/(quality)`, "GET", handler.IIIFImage(db, storage.ImageByID, fs.Decode, iiifCache, iiifLimits))
 
 	log.Printf("running HTTP server: %s", conf.HTTP)
 	if err := http.ListenAndServe(conf.HTTP, rt); err != nil {
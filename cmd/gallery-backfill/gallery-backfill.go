@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+func main() {
+	dbFl := flag.String("db", "/tmp/gallery/db.sqlite3", "Database file path")
+	photosFl := flag.String("photos", "/tmp/gallery/photos", "Uploaded photos directory")
+	flag.Parse()
+
+	if err := run(*dbFl, *photosFl); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run compute perceptual hash, dominant colors and quality scores of every
+// stored photo uploaded before these were introduced, and rebuild full text
+// search index.
+func run(dbPath, photosDir string) error {
+	db, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("cannot open database: %s", err)
+	}
+	defer db.Close()
+	if err := storage.Migrate(db); err != nil {
+		return fmt.Errorf("cannot migrate database: %s", err)
+	}
+
+	fs := storage.NewFileStore(photosDir, nil, 0)
+
+	// index is kept in sync by the database, only images stored before it
+	// was introduced are missing
+	if err := storage.RebuildSearchIndex(db); err != nil {
+		return fmt.Errorf("cannot rebuild search index: %s", err)
+	}
+	log.Print("search index rebuilt")
+
+	// no limit, failed images would be returned again
+	images, err := storage.ImagesWithoutHash(db, -1)
+	if err != nil {
+		return fmt.Errorf("cannot list images: %s", err)
+	}
+	backfill(images, "hashed", func(img *storage.Image) error {
+		hash, err := storage.PerceptualHash(fs, img)
+		if err != nil {
+			return err
+		}
+		return storage.PutImageHash(db, img.ImageID, hash)
+	})
+
+	images, err = storage.ImagesWithoutPalette(db, -1)
+	if err != nil {
+		return fmt.Errorf("cannot list images: %s", err)
+	}
+	backfill(images, "with palette", func(img *storage.Image) error {
+		colors, err := storage.ImagePalette(fs, img)
+		if err != nil {
+			return err
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			return fmt.Errorf("cannot start transaction: %s", err)
+		}
+		if err := storage.PutImagePalette(tx, img.ImageID, colors); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+
+	images, err = storage.ImagesWithoutQuality(db, -1)
+	if err != nil {
+		return fmt.Errorf("cannot list images: %s", err)
+	}
+	backfill(images, "scored", func(img *storage.Image) error {
+		scores, err := storage.ImageQuality(fs, img)
+		if err != nil {
+			return err
+		}
+		return storage.PutImageQuality(db, img.ImageID, scores)
+	})
+	return nil
+}
+
+// backfill call update for every image, logging the progress. Failures are
+// logged, but do not stop processing of the remaining images.
+func backfill(images []*storage.Image, done string, update func(*storage.Image) error) {
+	var updated, failed int
+	for _, img := range images {
+		if err := update(img); err != nil {
+			log.Printf("%s: %s", img.ImageID, err)
+			failed++
+			continue
+		}
+		updated++
+		if updated%100 == 0 {
+			log.Printf("%d of %d images %s", updated, len(images), done)
+		}
+	}
+	log.Printf("%d images %s, %d failed", updated, done, failed)
+}
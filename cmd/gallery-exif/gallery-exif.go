@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+func main() {
+	dbFl := flag.String("db", "/tmp/gallery/db.sqlite3", "Database file path")
+	photosFl := flag.String("photos", "/tmp/gallery/photos", "Uploaded photos directory")
+	flag.Parse()
+
+	if err := run(*dbFl, *photosFl); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run extract EXIF metadata and GPS position from every stored photo and
+// update both database and metadata files.
+func run(dbPath, photosDir string) error {
+	db, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("cannot open database: %s", err)
+	}
+	defer db.Close()
+	if err := storage.Migrate(db); err != nil {
+		return fmt.Errorf("cannot migrate database: %s", err)
+	}
+
+	fs := storage.NewFileStore(photosDir, nil, 0)
+
+	const batchSize = 500
+	var updated, failed int
+	for offset := int64(0); ; offset += batchSize {
+		images, err := storage.Images(db, storage.ImagesOpts{
+			Offset: offset,
+			Limit:  batchSize,
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list images: %s", err)
+		}
+
+		for _, img := range images {
+			if !storage.HasEXIF(img.MediaType) {
+				continue
+			}
+			if err := reextract(db, fs, img); err != nil {
+				log.Printf("%s: %s", img.ImageID, err)
+				failed++
+			} else {
+				updated++
+			}
+		}
+
+		if len(images) < batchSize {
+			break
+		}
+	}
+
+	log.Printf("EXIF metadata updated for %d images, %d failed", updated, failed)
+	return nil
+}
+
+func reextract(db *sqlx.DB, fs *storage.FileStore, img *storage.Image) error {
+	fd, err := fs.Read(img)
+	if err != nil {
+		return fmt.Errorf("cannot read image: %s", err)
+	}
+	found, err := storage.ReadMetadata(fd)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	ex := found.EXIF
+	ex.ImageID = img.ImageID
+
+	if err := storage.PutImageEXIF(db, *ex); err != nil {
+		return fmt.Errorf("cannot store EXIF: %s", err)
+	}
+	if found.Latitude != nil {
+		err := storage.SetImageLocation(db, img.ImageID, *found.Latitude, *found.Longitude, found.Altitude)
+		if err != nil {
+			return fmt.Errorf("cannot store location: %s", err)
+		}
+	}
+
+	// keep metadata file in sync with the database
+	meta, err := fs.ReadMeta(img.Created.Year(), img.ImageID)
+	if err != nil {
+		meta = img
+	}
+	meta.EXIF = ex
+	if found.Latitude != nil {
+		meta.Latitude, meta.Longitude, meta.Altitude = found.Latitude, found.Longitude, found.Altitude
+	}
+	if err := fs.PutMeta(meta); err != nil {
+		return fmt.Errorf("cannot write metadata file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/husio/gallery/gallery/geocode"
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+func main() {
+	dbFl := flag.String("db", "/tmp/gallery/db.sqlite3", "Database file path")
+	citiesFl := flag.String("cities", "", "GeoNames cities dump file, eg. cities15000.txt")
+	countriesFl := flag.String("countries", "", "GeoNames countryInfo.txt file")
+	maxDistanceFl := flag.Float64("max-distance", 50, "Maximum distance to the nearest city in kilometers")
+	clearFl := flag.Bool("clear", false, "Only remove all automatically generated tags")
+	flag.Parse()
+
+	db, err := sqlx.Open("sqlite3", *dbFl)
+	if err != nil {
+		log.Fatalf("cannot open database: %s", err)
+	}
+	defer db.Close()
+	if err := storage.Migrate(db); err != nil {
+		log.Fatalf("cannot migrate database: %s", err)
+	}
+
+	if *clearFl {
+		if err := storage.DeleteAllAutoTags(db); err != nil {
+			log.Fatalf("cannot delete automatic tags: %s", err)
+		}
+		return
+	}
+
+	if *citiesFl == "" {
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	idx, err := geocode.LoadFiles(*citiesFl, *countriesFl)
+	if err != nil {
+		log.Fatalf("cannot load places: %s", err)
+	}
+	idx.MaxDistance = *maxDistanceFl
+
+	if err := run(db, idx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run replace automatically generated tags of all geotagged images with
+// names of places found at their locations.
+func run(db *sqlx.DB, places storage.PlaceFinder) error {
+	images, err := storage.Images(db, storage.ImagesOpts{Geotagged: true})
+	if err != nil {
+		return fmt.Errorf("cannot list images: %s", err)
+	}
+
+	var tagged int
+	for _, img := range images {
+		names, err := storage.TagPlaces(db, places, img)
+		if err != nil {
+			return fmt.Errorf("%s: %s", img.ImageID, err)
+		}
+		if len(names) != 0 {
+			tagged++
+		}
+	}
+	log.Printf("%d of %d geotagged images tagged with place names", tagged, len(images))
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/husio/gallery/gallery/geocode"
+	"github.com/husio/gallery/gallery/gpx"
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+func main() {
+	dbFl := flag.String("db", "/tmp/gallery/db.sqlite3", "Database file path")
+	photosFl := flag.String("photos", "/tmp/gallery/photos", "Uploaded photos directory")
+	gpxFl := flag.String("gpx", "", "GPX track file")
+	tagFl := flag.String("tag", "", "Geotag only photos matching tag query")
+	fromFl := flag.String("from", "", "Geotag only photos taken after given camera time, eg. 2016-07-20T08:00")
+	toFl := flag.String("to", "", "Geotag only photos taken before given camera time, eg. 2016-07-24T22:00")
+	offsetFl := flag.Duration("offset", 0, "Camera clock offset from UTC, eg. 9h")
+	maxGapFl := flag.Duration("max-gap", 10*time.Minute, "Longest gap between track points that position is interpolated for")
+	overwriteFl := flag.Bool("overwrite", false, "Overwrite location of already geotagged photos")
+	citiesFl := flag.String("cities", "", "GeoNames cities dump file, if given geotagged photos are tagged with place names")
+	countriesFl := flag.String("countries", "", "GeoNames countryInfo.txt file")
+	maxDistanceFl := flag.Float64("max-distance", 50, "Maximum distance to the nearest city in kilometers")
+	flag.Parse()
+
+	if *gpxFl == "" {
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var opts storage.GeotagOpts
+	if *tagFl != "" {
+		tq, err := storage.ParseTagQuery(*tagFl)
+		if err != nil {
+			log.Fatalf("invalid tag query: %s", err)
+		}
+		opts.Tags = tq
+	}
+	var err error
+	if opts.From, err = storage.ParseCameraTime(*fromFl); err != nil {
+		log.Fatalf("invalid from time: %s", err)
+	}
+	if opts.To, err = storage.ParseCameraTime(*toFl); err != nil {
+		log.Fatalf("invalid to time: %s", err)
+	}
+	opts.ClockOffset = *offsetFl
+	opts.Overwrite = *overwriteFl
+
+	var places storage.PlaceFinder
+	if *citiesFl != "" {
+		idx, err := geocode.LoadFiles(*citiesFl, *countriesFl)
+		if err != nil {
+			log.Fatalf("cannot load places: %s", err)
+		}
+		idx.MaxDistance = *maxDistanceFl
+		places = idx
+	}
+
+	if err := run(*dbFl, *photosFl, *gpxFl, *maxGapFl, places, opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(dbPath, photosDir, gpxPath string, maxGap time.Duration, places storage.PlaceFinder, opts storage.GeotagOpts) error {
+	fd, err := os.Open(gpxPath)
+	if err != nil {
+		return err
+	}
+	track, err := gpx.Parse(fd)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	track.MaxGap = maxGap
+	log.Printf("track recorded between %s and %s, %d points",
+		track.Start().Format(time.RFC3339), track.End().Format(time.RFC3339), len(track.Points))
+
+	db, err := sqlx.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("cannot open database: %s", err)
+	}
+	defer db.Close()
+	if err := storage.Migrate(db); err != nil {
+		return fmt.Errorf("cannot migrate database: %s", err)
+	}
+
+	geotagger := storage.NewGeotagger(db, storage.NewFileStore(photosDir, nil, 0), places)
+	res, err := geotagger.Geotag(track, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d photos matched, %d geotagged, %d already geotagged, %d outside of the track",
+		res.Matched, len(res.Geotagged), res.Skipped, res.OutOfTrack)
+	return nil
+}
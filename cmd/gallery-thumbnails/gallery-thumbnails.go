@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/husio/gallery/gallery/storage"
+)
+
+func main() {
+	thumbnailsFl := flag.String("thumbnails", "/tmp/gallery/thumbnails", "Thumbnails directory to migrate from")
+	dbFl := flag.String("db", "/tmp/gallery/thumbnails.sqlite3", "Thumbnail database file path to migrate to")
+	removeFl := flag.Bool("remove", false, "Remove thumbnail files once migrated")
+	flag.Parse()
+
+	if err := run(*thumbnailsFl, *dbFl, *removeFl); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run copy all renditions kept as separate files in the thumbnails directory
+// into the thumbnail database. Migration can be repeated, already migrated
+// renditions are overwritten.
+func run(thumbnailsDir, dbPath string, remove bool) error {
+	dst, err := storage.OpenSQLRenditionStore(dbPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	src := storage.NewDirRenditionStore(thumbnailsDir)
+
+	var migrated int
+	err = src.Walk(func(r storage.RenditionInfo) error {
+		fd, err := src.Open(r.Image, r.Preset)
+		if err != nil {
+			return fmt.Errorf("cannot open %s rendition of %q: %s", r.Preset, r.Image.ImageID, err)
+		}
+		content, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read %s rendition of %q: %s", r.Preset, r.Image.ImageID, err)
+		}
+		if err := dst.Put(r.Image, r.Preset, content); err != nil {
+			return fmt.Errorf("cannot migrate %s rendition of %q: %s", r.Preset, r.Image.ImageID, err)
+		}
+		if remove {
+			if err := src.Delete(r.Image, r.Preset); err != nil {
+				return fmt.Errorf("cannot remove %s rendition of %q: %s", r.Preset, r.Image.ImageID, err)
+			}
+		}
+		migrated++
+		if migrated%1000 == 0 {
+			log.Printf("%d thumbnails migrated", migrated)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d thumbnails migrated to %s", migrated, dbPath)
+	return nil
+}
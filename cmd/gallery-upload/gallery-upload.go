@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -34,24 +35,75 @@ func main() {
 }
 
 func run(urlStr string, photos, tags []string) error {
-	bar := pb.StartNew(len(photos))
-	defer bar.Finish()
+	// prefer resumable uploads if the server supports them
+	uploadFile := upload
+	tusURL := strings.TrimRight(urlStr, "/") + "/tus"
+	if tusSupported(tusURL) {
+		uploadFile = func(_, photo string, tags []string) (*fileReport, error) {
+			switch err := tusUpload(tusURL, photo, tags); err {
+			case nil:
+			case errTusUnconfirmed:
+				return &fileReport{File: filepath.Base(photo), Tags: tags, unconfirmed: true}, nil
+			default:
+				return nil, err
+			}
+			return &fileReport{File: filepath.Base(photo), Tags: tags}, nil
+		}
+	}
 
+	bar := pb.StartNew(len(photos))
+	var reports []*fileReport
 	for _, photo := range photos {
 		bar.Prefix(filepath.Base(photo))
-		if err := upload(urlStr, photo, tags); err != nil {
-			return fmt.Errorf("%s: %s", photo, err)
+		rep, err := uploadFile(urlStr, photo, tags)
+		if err != nil {
+			rep = &fileReport{File: filepath.Base(photo), Error: err.Error()}
 		}
+		reports = append(reports, rep)
 		bar.Increment()
 	}
-
+	bar.Finish()
+
+	var failed int
+	for i, rep := range reports {
+		switch {
+		case rep.Error != "":
+			failed++
+			fmt.Printf("%s: error: %s\n", photos[i], rep.Error)
+		case rep.unconfirmed:
+			fmt.Printf("%s: unknown: %s\n", photos[i], errTusUnconfirmed)
+		case rep.ImageID == "":
+			fmt.Printf("%s: uploaded\n", photos[i])
+		case rep.Created:
+			fmt.Printf("%s: created %s %s\n", photos[i], rep.ImageID, strings.Join(rep.Tags, ","))
+		default:
+			fmt.Printf("%s: exists %s %s\n", photos[i], rep.ImageID, strings.Join(rep.Tags, ","))
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(photos))
+	}
 	return nil
 }
 
-func upload(urlStr, photoPath string, tags []string) error {
+// fileReport is the result of a single file upload, as returned by the
+// server.
+type fileReport struct {
+	File    string   `json:"file"`
+	ImageID string   `json:"imageId"`
+	Created bool     `json:"created"`
+	Tags    []string `json:"tags"`
+	Error   string   `json:"error"`
+
+	// unconfirmed is set if the upload most likely succeeded, but server
+	// response was lost
+	unconfirmed bool
+}
+
+func upload(urlStr, photoPath string, tags []string) (*fileReport, error) {
 	fd, err := os.Open(photoPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer fd.Close()
 
@@ -59,33 +111,48 @@ func upload(urlStr, photoPath string, tags []string) error {
 	body := multipart.NewWriter(&buf)
 	wr, err := body.CreateFormFile("photos", filepath.Base(photoPath))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if _, err := io.Copy(wr, fd); err != nil {
-		return fmt.Errorf("cannot write file content: %s", err)
+		return nil, fmt.Errorf("cannot write file content: %s", err)
 	}
 
 	for i, tag := range tags {
 		name := fmt.Sprintf("tag_%d", i+1)
 		if err := body.WriteField(name, tag); err != nil {
-			return fmt.Errorf("cannot write tag: %s", err)
+			return nil, fmt.Errorf("cannot write tag: %s", err)
 		}
 	}
 
 	ct := body.FormDataContentType()
 	body.Close()
 
-	resp, err := http.Post(urlStr, ct, &buf)
+	req, err := http.NewRequest("POST", urlStr, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ct)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("cannot POST: %s", err)
+		return nil, fmt.Errorf("cannot POST: %s", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("response %d: %s", resp.StatusCode, string(b))
+		return nil, fmt.Errorf("response %d: %s", resp.StatusCode, string(b))
 	}
 
-	return nil
+	var report struct {
+		Files []*fileReport `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("cannot decode response: %s", err)
+	}
+	if len(report.Files) != 1 {
+		return nil, fmt.Errorf("expected single file report, got %d", len(report.Files))
+	}
+	return report.Files[0], nil
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tusVersion   = "1.0.0"
+	tusChunkSize = 4 << 20
+	tusRetries   = 8
+)
+
+// errTusUnconfirmed is returned when the server did not respond to the
+// request sending the last chunk and the upload no longer exists. Server
+// removes an upload once the file is stored, but it can also expire.
+var errTusUnconfirmed = errors.New("upload is gone after sending the last chunk, it was most likely stored")
+
+// tusSupported return true if server accepts resumable uploads under given
+// URL.
+func tusSupported(tusURL string) bool {
+	req, err := http.NewRequest("OPTIONS", tusURL, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return false
+	}
+	for _, v := range strings.Split(resp.Header.Get("Tus-Version"), ",") {
+		if strings.TrimSpace(v) == tusVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// tusUpload upload file using resumable upload protocol. Failed requests are
+// retried and upload continues from the last offset acknowledged by the
+// server.
+func tusUpload(tusURL, photoPath string, tags []string) error {
+	fd, err := os.Open(photoPath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	stat, err := fd.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat: %s", err)
+	}
+
+	// tag names can contain any character, including comma
+	rawTags, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("cannot encode tags: %s", err)
+	}
+	location, err := tusCreate(tusURL, stat.Size(), map[string]string{
+		"filename": filepath.Base(photoPath),
+		"tags":     string(rawTags),
+	})
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	// lastSent is true when the last chunk was sent, but the response was
+	// not received
+	var lastSent bool
+	for attempt := 0; offset < stat.Size(); {
+		next, err := tusPatch(location, fd, offset)
+		if err == nil {
+			offset = next
+			attempt = 0
+			continue
+		}
+		if lastSent && notFound(err) {
+			return errTusUnconfirmed
+		}
+		if _, ok := err.(*responseErr); !ok && offset+tusChunkSize >= stat.Size() {
+			lastSent = true
+		}
+		if !retryable(err) {
+			return err
+		}
+		if attempt++; attempt > tusRetries {
+			return err
+		}
+		wait := time.Duration(1<<uint(attempt-1)) * time.Second
+		log.Printf("%s: %s, retrying in %s", photoPath, err, wait)
+		time.Sleep(wait)
+
+		off, err := tusOffset(location)
+		switch {
+		case err == nil:
+			offset = off
+			lastSent = false
+		case lastSent && notFound(err):
+			return errTusUnconfirmed
+		}
+	}
+	return nil
+}
+
+// tusCreate create new upload and return its URL.
+func tusCreate(tusURL string, size int64, meta map[string]string) (string, error) {
+	var pairs []string
+	for k, v := range meta {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	req, err := http.NewRequest("POST", tusURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", strings.Join(pairs, ","))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot create upload: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("cannot create upload: response %d: %s", resp.StatusCode, string(b))
+	}
+
+	base, err := url.Parse(tusURL)
+	if err != nil {
+		return "", err
+	}
+	location, err := base.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location: %s", err)
+	}
+	return location.String(), nil
+}
+
+// tusOffset return number of bytes of the upload already stored by the
+// server.
+func tusOffset(location string) (int64, error) {
+	req, err := http.NewRequest("HEAD", location, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &responseErr{code: resp.StatusCode}
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+// tusPatch send single chunk of the file, starting at given offset and return
+// new offset.
+func tusPatch(location string, fd io.ReaderAt, offset int64) (int64, error) {
+	chunk := make([]byte, tusChunkSize)
+	n, err := fd.ReadAt(chunk, offset)
+	if err != nil && err != io.EOF {
+		return offset, fmt.Errorf("cannot read file: %s", err)
+	}
+	chunk = chunk[:n]
+	sum := sha1.Sum(chunk)
+
+	req, err := http.NewRequest("PATCH", location, bytes.NewReader(chunk))
+	if err != nil {
+		return offset, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return offset, fmt.Errorf("cannot PATCH: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return offset, &responseErr{code: resp.StatusCode, body: string(b)}
+	}
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
+
+type responseErr struct {
+	code int
+	body string
+}
+
+func (e *responseErr) Error() string {
+	return fmt.Sprintf("response %d: %s", e.code, e.body)
+}
+
+// notFound return true if request failed because the upload does not exist.
+func notFound(err error) bool {
+	e, ok := err.(*responseErr)
+	return ok && e.code == http.StatusNotFound
+}
+
+// retryable return true if request failed because of the network or server
+// error, or if the chunk was not accepted because of the offset or checksum
+// mismatch.
+func retryable(err error) bool {
+	e, ok := err.(*responseErr)
+	if !ok {
+		return true
+	}
+	switch {
+	case e.code == http.StatusConflict, e.code == 460:
+		return true
+	default:
+		return e.code >= 500
+	}
+}
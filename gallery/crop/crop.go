@@ -0,0 +1,153 @@
+// Package crop choose which region of an image to keep when the image is
+// cropped to a different aspect ratio.
+package crop
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// analysisSize is the longer side length of the image copy that is used to
+// measure details. Details of the full size image are not needed to find the
+// interesting region.
+const analysisSize = 128
+
+// Around return the biggest region of given bounds with width to height
+// ratio w:h, centered as close as possible on the focal point. Focal point
+// position is given as fractions of the bounds width and height.
+func Around(b image.Rectangle, w, h int, fx, fy float64) image.Rectangle {
+	cw, ch := regionSize(b.Dx(), b.Dy(), w, h)
+	x := clamp(int(math.Round(fx*float64(b.Dx())-float64(cw)/2)), 0, b.Dx()-cw)
+	y := clamp(int(math.Round(fy*float64(b.Dy())-float64(ch)/2)), 0, b.Dy()-ch)
+	return image.Rect(x, y, x+cw, y+ch).Add(b.Min)
+}
+
+// Detailed return the biggest region of given image with width to height
+// ratio w:h, that contains the most details. Detail is measured as the
+// energy of edges, so that uniform background, like sky or wall, is cut off
+// first. If all regions are equally detailed, centered one is returned.
+func Detailed(img image.Image, w, h int) image.Rectangle {
+	b := img.Bounds()
+	cw, ch := regionSize(b.Dx(), b.Dy(), w, h)
+	if cw == b.Dx() && ch == b.Dy() {
+		return b
+	}
+
+	scale := math.Min(1, float64(analysisSize)/float64(maxInt(b.Dx(), b.Dy())))
+	small := img
+	if scale < 1 {
+		sw := maxInt(1, int(math.Round(float64(b.Dx())*scale)))
+		sh := maxInt(1, int(math.Round(float64(b.Dy())*scale)))
+		small = imaging.Resize(img, sw, sh, imaging.Box)
+	}
+	energy := edgeEnergy(small)
+
+	// region can be moved only along one axis, so energy of all lines
+	// across that axis is summed
+	horizontal := cw < b.Dx()
+	var lines []float64
+	if horizontal {
+		lines = make([]float64, len(energy[0]))
+		for _, row := range energy {
+			for x, e := range row {
+				lines[x] += e
+			}
+		}
+	} else {
+		lines = make([]float64, len(energy))
+		for y, row := range energy {
+			for _, e := range row {
+				lines[y] += e
+			}
+		}
+	}
+
+	full, size := b.Dx(), cw
+	if !horizontal {
+		full, size = b.Dy(), ch
+	}
+	window := clamp(int(math.Round(float64(size)*float64(len(lines))/float64(full))), 1, len(lines))
+	start := bestWindow(lines, window)
+
+	offset := clamp(int(math.Round(float64(start)*float64(full)/float64(len(lines)))), 0, full-size)
+	if horizontal {
+		return image.Rect(offset, 0, offset+cw, ch).Add(b.Min)
+	}
+	return image.Rect(0, offset, cw, offset+ch).Add(b.Min)
+}
+
+// bestWindow return the start of a window of given size, with the highest
+// sum of values. Of equally good windows, the one closest to the center is
+// returned.
+func bestWindow(values []float64, size int) int {
+	var sum float64
+	for _, v := range values[:size] {
+		sum += v
+	}
+	center := float64(len(values)-size) / 2
+	best, bestSum := 0, sum
+	for start := 1; start+size <= len(values); start++ {
+		sum += values[start+size-1] - values[start-1]
+		const epsilon = 1e-9
+		switch {
+		case sum > bestSum+epsilon:
+			best, bestSum = start, sum
+		case sum > bestSum-epsilon && math.Abs(float64(start)-center) < math.Abs(float64(best)-center):
+			best = start
+		}
+	}
+	return best
+}
+
+// edgeEnergy return the gradient magnitude of image luminance, indexed by
+// row and column.
+func edgeEnergy(img image.Image) [][]float64 {
+	b := img.Bounds()
+	lum := make([][]float64, b.Dy())
+	for y := range lum {
+		lum[y] = make([]float64, b.Dx())
+		for x := range lum[y] {
+			lum[y][x] = float64(color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y)
+		}
+	}
+
+	energy := make([][]float64, len(lum))
+	for y := range lum {
+		energy[y] = make([]float64, len(lum[y]))
+		for x := range lum[y] {
+			dx := lum[y][clamp(x+1, 0, len(lum[y])-1)] - lum[y][clamp(x-1, 0, len(lum[y])-1)]
+			dy := lum[clamp(y+1, 0, len(lum)-1)][x] - lum[clamp(y-1, 0, len(lum)-1)][x]
+			energy[y][x] = math.Abs(dx) + math.Abs(dy)
+		}
+	}
+	return energy
+}
+
+// regionSize return size of the biggest region of width to height ratio w:h
+// that fits within given size.
+func regionSize(width, height, w, h int) (int, int) {
+	if width*h > height*w {
+		return maxInt(1, height*w/h), height
+	}
+	return width, maxInt(1, width*h/w)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+package crop
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestAround(t *testing.T) {
+	cases := map[string]struct {
+		bounds image.Rectangle
+		w, h   int
+		fx, fy float64
+		want   image.Rectangle
+	}{
+		"centered": {
+			bounds: image.Rect(0, 0, 400, 200),
+			w:      1, h: 1,
+			fx: 0.5, fy: 0.5,
+			want: image.Rect(100, 0, 300, 200),
+		},
+		"moved to focus": {
+			bounds: image.Rect(0, 0, 400, 200),
+			w:      1, h: 1,
+			fx: 0.7, fy: 0.5,
+			want: image.Rect(180, 0, 380, 200),
+		},
+		"focus near the edge": {
+			bounds: image.Rect(0, 0, 400, 200),
+			w:      1, h: 1,
+			fx: 0.1, fy: 0.9,
+			want: image.Rect(0, 0, 200, 200),
+		},
+		"portrait": {
+			bounds: image.Rect(0, 0, 200, 400),
+			w:      2, h: 1,
+			fx: 0.5, fy: 0.2,
+			want: image.Rect(0, 30, 200, 130),
+		},
+		"bounds not at origin": {
+			bounds: image.Rect(10, 10, 410, 210),
+			w:      1, h: 1,
+			fx: 1, fy: 0,
+			want: image.Rect(210, 10, 410, 210),
+		},
+		"same aspect ratio": {
+			bounds: image.Rect(0, 0, 400, 200),
+			w:      2, h: 1,
+			fx: 0.9, fy: 0.9,
+			want: image.Rect(0, 0, 400, 200),
+		},
+	}
+
+	for tname, tc := range cases {
+		got := Around(tc.bounds, tc.w, tc.h, tc.fx, tc.fy)
+		if got != tc.want {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+		}
+	}
+}
+
+func TestDetailed(t *testing.T) {
+	// noise is drawn on uniform background within given rectangle
+	withNoise := func(width, height int, detail image.Rectangle) image.Image {
+		rnd := rand.New(rand.NewSource(1))
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for x := 0; x < width; x++ {
+			for y := 0; y < height; y++ {
+				c := color.Gray{Y: 128}
+				if (image.Point{x, y}).In(detail) {
+					c.Y = uint8(rnd.Intn(256))
+				}
+				img.SetGray(x, y, c)
+			}
+		}
+		return img
+	}
+
+	cases := map[string]struct {
+		width, height int
+		detail        image.Rectangle
+		w, h          int
+		// want is the size of the region, that must contain the detail
+		want image.Rectangle
+	}{
+		"detail on the right": {
+			width: 400, height: 200,
+			detail: image.Rect(300, 50, 380, 150),
+			w:      1, h: 1,
+			want: image.Rect(0, 0, 200, 200),
+		},
+		"detail at the top of portrait": {
+			width: 300, height: 900,
+			detail: image.Rect(100, 60, 200, 160),
+			w:      1, h: 1,
+			want: image.Rect(0, 0, 300, 300),
+		},
+		"detail on the left of big image": {
+			width: 1600, height: 400,
+			detail: image.Rect(100, 100, 300, 300),
+			w:      1, h: 1,
+			want: image.Rect(0, 0, 400, 400),
+		},
+		"same aspect ratio": {
+			width: 400, height: 200,
+			detail: image.Rect(0, 0, 10, 10),
+			w:      2, h: 1,
+			want: image.Rect(0, 0, 400, 200),
+		},
+	}
+
+	for tname, tc := range cases {
+		got := Detailed(withNoise(tc.width, tc.height, tc.detail), tc.w, tc.h)
+		if got.Dx() != tc.want.Dx() || got.Dy() != tc.want.Dy() {
+			t.Errorf("%s: want %v size, got %v", tname, tc.want.Size(), got)
+			continue
+		}
+		if !tc.detail.In(got) {
+			t.Errorf("%s: %v does not contain the detail %v", tname, got, tc.detail)
+		}
+	}
+
+	// of equally detailed regions, centered one is chosen
+	if got, want := Detailed(withNoise(400, 200, image.Rectangle{}), 1, 1), image.Rect(100, 0, 300, 200); got != want {
+		t.Errorf("uniform image: want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,253 @@
+// Package geocode provides offline reverse geocoding, using GeoNames cities
+// dump (http://download.geonames.org/export/dump/) loaded into memory.
+package geocode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Place is a populated place, as described by GeoNames.
+type Place struct {
+	Name        string
+	CountryCode string
+	Country     string
+	Latitude    float64
+	Longitude   float64
+	Population  int64
+}
+
+const earthRadiusKm = 6371.0
+
+// Index allows to find the place nearest to given coordinates.
+type Index struct {
+	places []Place
+	// k-d tree built over 3D unit vectors, to avoid distortions near the
+	// poles and the antimeridian
+	tree []kdnode
+
+	// MaxDistance is the greatest distance, in kilometers, between location
+	// and the nearest place, for which the place is still considered
+	// matching. Zero means no limit.
+	MaxDistance float64
+}
+
+type kdnode struct {
+	point [3]float64
+	place int
+	axis  int
+	left  int
+	right int
+}
+
+// ErrNoPlaces is returned when cities dump contains no place.
+var ErrNoPlaces = errors.New("no places")
+
+// Load build index from GeoNames cities dump (eg. cities15000.txt). Country
+// names are read from GeoNames countryInfo.txt; if countries is nil, country
+// codes are used as names.
+func Load(cities, countries io.Reader) (*Index, error) {
+	names := make(map[string]string)
+	if countries != nil {
+		var err error
+		if names, err = readCountries(countries); err != nil {
+			return nil, fmt.Errorf("cannot read countries: %s", err)
+		}
+	}
+
+	var places []Place
+	rd := bufio.NewScanner(cities)
+	rd.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; rd.Scan(); line++ {
+		cols := strings.Split(rd.Text(), "\t")
+		if len(cols) < 15 {
+			return nil, fmt.Errorf("line %d: expected at least 15 columns, got %d", line, len(cols))
+		}
+		lat, err := strconv.ParseFloat(cols[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid latitude: %s", line, err)
+		}
+		lon, err := strconv.ParseFloat(cols[5], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid longitude: %s", line, err)
+		}
+		population, _ := strconv.ParseInt(cols[14], 10, 64)
+		country := names[cols[8]]
+		if country == "" {
+			country = cols[8]
+		}
+		places = append(places, Place{
+			Name:        cols[1],
+			CountryCode: cols[8],
+			Country:     country,
+			Latitude:    lat,
+			Longitude:   lon,
+			Population:  population,
+		})
+	}
+	if err := rd.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read cities: %s", err)
+	}
+	return NewIndex(places)
+}
+
+// LoadFiles build index from GeoNames dump files. Countries file path is
+// optional.
+func LoadFiles(citiesPath, countriesPath string) (*Index, error) {
+	cities, err := os.Open(citiesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cities.Close()
+
+	var countries io.Reader
+	if countriesPath != "" {
+		fd, err := os.Open(countriesPath)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		countries = fd
+	}
+	return Load(cities, countries)
+}
+
+// NewIndex build index of given places.
+func NewIndex(places []Place) (*Index, error) {
+	if len(places) == 0 {
+		return nil, ErrNoPlaces
+	}
+	idx := &Index{
+		places: places,
+		tree:   make([]kdnode, 0, len(places)),
+	}
+	nodes := make([]kdnode, len(places))
+	for i, p := range places {
+		nodes[i] = kdnode{point: toVector(p.Latitude, p.Longitude), place: i}
+	}
+	idx.build(nodes, 0)
+	return idx, nil
+}
+
+// build append subtree made of given nodes to the tree and return index of
+// its root.
+func (idx *Index) build(nodes []kdnode, depth int) int {
+	if len(nodes) == 0 {
+		return -1
+	}
+	axis := depth % 3
+	sort.Sort(byAxis{nodes: nodes, axis: axis})
+	median := len(nodes) / 2
+
+	pos := len(idx.tree)
+	n := nodes[median]
+	n.axis = axis
+	idx.tree = append(idx.tree, n)
+	left := idx.build(nodes[:median], depth+1)
+	right := idx.build(nodes[median+1:], depth+1)
+	idx.tree[pos].left = left
+	idx.tree[pos].right = right
+	return pos
+}
+
+type byAxis struct {
+	nodes []kdnode
+	axis  int
+}
+
+func (b byAxis) Len() int           { return len(b.nodes) }
+func (b byAxis) Less(i, j int) bool { return b.nodes[i].point[b.axis] < b.nodes[j].point[b.axis] }
+func (b byAxis) Swap(i, j int)      { b.nodes[i], b.nodes[j] = b.nodes[j], b.nodes[i] }
+
+// Nearest return place closest to given coordinates and distance to it in
+// kilometers. False is returned if the closest place is further than
+// MaxDistance.
+func (idx *Index) Nearest(lat, lon float64) (*Place, float64, bool) {
+	target := toVector(lat, lon)
+	best, bestDist := -1, math.Inf(1)
+	idx.nearest(0, target, &best, &bestDist)
+	if best == -1 {
+		return nil, 0, false
+	}
+
+	// convert chord length into great circle distance
+	km := 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(bestDist)/2))
+	if idx.MaxDistance != 0 && km > idx.MaxDistance {
+		return nil, km, false
+	}
+	return &idx.places[idx.tree[best].place], km, true
+}
+
+func (idx *Index) nearest(pos int, target [3]float64, best *int, bestDist *float64) {
+	if pos == -1 {
+		return
+	}
+	n := &idx.tree[pos]
+	if d := sqDist(n.point, target); d < *bestDist {
+		*best, *bestDist = pos, d
+	}
+
+	diff := target[n.axis] - n.point[n.axis]
+	near, far := n.left, n.right
+	if diff > 0 {
+		near, far = far, near
+	}
+	idx.nearest(near, target, best, bestDist)
+	if diff*diff < *bestDist {
+		idx.nearest(far, target, best, bestDist)
+	}
+}
+
+// Places return names of the country and the city nearest to given
+// location. Nothing is returned when there is no place close enough.
+func (idx *Index) Places(lat, lon float64) []string {
+	p, _, ok := idx.Nearest(lat, lon)
+	if !ok {
+		return nil
+	}
+	if p.Country == "" || p.Country == p.Name {
+		return []string{p.Name}
+	}
+	return []string{p.Country, p.Name}
+}
+
+func toVector(lat, lon float64) [3]float64 {
+	phi := lat * math.Pi / 180
+	lambda := lon * math.Pi / 180
+	return [3]float64{
+		math.Cos(phi) * math.Cos(lambda),
+		math.Cos(phi) * math.Sin(lambda),
+		math.Sin(phi),
+	}
+}
+
+func sqDist(a, b [3]float64) float64 {
+	dx, dy, dz := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dx*dx + dy*dy + dz*dz
+}
+
+// readCountries read GeoNames countryInfo.txt and return mapping of ISO
+// country code to country name.
+func readCountries(r io.Reader) (map[string]string, error) {
+	names := make(map[string]string)
+	rd := bufio.NewScanner(r)
+	for rd.Scan() {
+		line := rd.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		if len(cols) < 5 {
+			continue
+		}
+		names[cols[0]] = cols[4]
+	}
+	return names, rd.Err()
+}
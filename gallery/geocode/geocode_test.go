@@ -0,0 +1,79 @@
+package geocode
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCities = "" +
+	"1846266\tJeju City\tJeju City\t\t33.50972\t126.52194\tP\tPPLA\tKR\t\t17\t\t\t\t408364\t\t\tAsia/Seoul\t2016-01-01\n" +
+	"1835848\tSeoul\tSeoul\t\t37.566\t126.9784\tP\tPPLC\tKR\t\t11\t\t\t\t10349312\t\t\tAsia/Seoul\t2016-01-01\n" +
+	"1850147\tTokyo\tTokyo\t\t35.6895\t139.69171\tP\tPPLC\tJP\t\t40\t\t\t\t8336599\t\t\tAsia/Tokyo\t2016-01-01\n" +
+	"2198148\tLevuka\tLevuka\t\t-17.68333\t179.8\tP\tPPLA\tFJ\t\t03\t\t\t\t8360\t\t\tPacific/Fiji\t2016-01-01\n" +
+	"3099434\tGdansk\tGdansk\t\t54.35205\t18.64637\tP\tPPLA\tPL\t\t82\t\t\t\t461865\t\t\tEurope/Warsaw\t2016-01-01\n"
+
+const testCountries = "" +
+	"#ISO\tISO3\tISO-Numeric\tfips\tCountry\n" +
+	"KR\tKOR\t410\tKS\tSouth Korea\n" +
+	"JP\tJPN\t392\tJA\tJapan\n" +
+	"PL\tPOL\t616\tPL\tPoland\n"
+
+func TestIndexPlaces(t *testing.T) {
+	idx, err := Load(strings.NewReader(testCities), strings.NewReader(testCountries))
+	if err != nil {
+		t.Fatalf("cannot load: %s", err)
+	}
+	idx.MaxDistance = 100
+
+	cases := map[string]struct {
+		lat, lon float64
+		want     []string
+	}{
+		"jeju": {
+			lat:  33.45,
+			lon:  126.56,
+			want: []string{"South Korea", "Jeju City"},
+		},
+		"sopot": {
+			lat:  54.44,
+			lon:  18.56,
+			want: []string{"Poland", "Gdansk"},
+		},
+		"no_country_name_across_antimeridian": {
+			lat:  -17.6,
+			lon:  -179.9,
+			want: []string{"FJ", "Levuka"},
+		},
+		"middle_of_ocean": {
+			lat:  0,
+			lon:  -30,
+			want: nil,
+		},
+	}
+
+	for tname, tc := range cases {
+		if got := idx.Places(tc.lat, tc.lon); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+		}
+	}
+}
+
+func TestIndexNearestDistance(t *testing.T) {
+	idx, err := Load(strings.NewReader(testCities), nil)
+	if err != nil {
+		t.Fatalf("cannot load: %s", err)
+	}
+	p, km, ok := idx.Nearest(37.566, 126.9784)
+	if !ok || p.Name != "Seoul" {
+		t.Fatalf("want Seoul, got %+v", p)
+	}
+	if km > 0.001 {
+		t.Errorf("want zero distance, got %f", km)
+	}
+
+	if _, km, _ = idx.Nearest(37.566, 126.9784+0.5); math.Abs(km-44) > 1 {
+		t.Errorf("want about 44km, got %f", km)
+	}
+}
@@ -0,0 +1,159 @@
+// Package gpx reads GPS tracks recorded in GPX format and computes position
+// at any moment of the recording.
+package gpx
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Point is a single track point.
+type Point struct {
+	Latitude  float64
+	Longitude float64
+	// Elevation in meters, nil if not recorded.
+	Elevation *float64
+	Time      time.Time
+}
+
+// Track is a list of points ordered by time.
+type Track struct {
+	Points []Point
+
+	// MaxGap is the longest time between two recorded points, for which
+	// position is interpolated. Longer gaps usually mean that the device was
+	// turned off and position is unknown. Zero means no limit.
+	MaxGap time.Duration
+}
+
+// ErrNoPoints is returned when GPX file contains no timestamped track points.
+var ErrNoPoints = errors.New("no timestamped track points")
+
+// Parse read GPX document and return all track points, from all tracks and
+// segments, that have time information.
+func Parse(r io.Reader) (*Track, error) {
+	var doc struct {
+		Tracks []struct {
+			Segments []struct {
+				Points []struct {
+					Lat  float64  `xml:"lat,attr"`
+					Lon  float64  `xml:"lon,attr"`
+					Ele  *float64 `xml:"ele"`
+					Time string   `xml:"time"`
+				} `xml:"trkpt"`
+			} `xml:"trkseg"`
+		} `xml:"trk"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("cannot decode GPX: %s", err)
+	}
+
+	var track Track
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				if pt.Time == "" {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339Nano, pt.Time)
+				if err != nil {
+					return nil, fmt.Errorf("invalid track point time %q: %s", pt.Time, err)
+				}
+				track.Points = append(track.Points, Point{
+					Latitude:  pt.Lat,
+					Longitude: pt.Lon,
+					Elevation: pt.Ele,
+					Time:      t.UTC(),
+				})
+			}
+		}
+	}
+	if len(track.Points) == 0 {
+		return nil, ErrNoPoints
+	}
+	sort.Sort(byTime(track.Points))
+	return &track, nil
+}
+
+type byTime []Point
+
+func (p byTime) Len() int           { return len(p) }
+func (p byTime) Less(i, j int) bool { return p[i].Time.Before(p[j].Time) }
+func (p byTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Start return time of the first track point.
+func (t *Track) Start() time.Time {
+	return t.Points[0].Time
+}
+
+// End return time of the last track point.
+func (t *Track) End() time.Time {
+	return t.Points[len(t.Points)-1].Time
+}
+
+// Position return position at given moment, linearly interpolated between
+// two closest track points. False is returned if moment is outside of the
+// recorded track or within a gap longer than MaxGap.
+func (t *Track) Position(at time.Time) (Point, bool) {
+	pts := t.Points
+	if len(pts) == 0 {
+		return Point{}, false
+	}
+
+	// index of the first point recorded after given moment
+	i := sort.Search(len(pts), func(i int) bool { return pts[i].Time.After(at) })
+	switch {
+	case i == 0:
+		if pts[0].Time.Equal(at) {
+			return pts[0], true
+		}
+		return Point{}, false
+	case i == len(pts):
+		if pts[i-1].Time.Equal(at) {
+			return pts[i-1], true
+		}
+		return Point{}, false
+	}
+
+	a, b := pts[i-1], pts[i]
+	gap := b.Time.Sub(a.Time)
+	if t.MaxGap != 0 && gap > t.MaxGap {
+		return Point{}, false
+	}
+	if gap == 0 {
+		return a, true
+	}
+	ratio := float64(at.Sub(a.Time)) / float64(gap)
+	pos := Point{
+		Latitude:  a.Latitude + (b.Latitude-a.Latitude)*ratio,
+		Longitude: interpolateLon(a.Longitude, b.Longitude, ratio),
+		Time:      at,
+	}
+	if a.Elevation != nil && b.Elevation != nil {
+		ele := *a.Elevation + (*b.Elevation-*a.Elevation)*ratio
+		pos.Elevation = &ele
+	}
+	return pos, true
+}
+
+// interpolateLon interpolate longitude, taking the shorter way around the
+// globe when crossing the antimeridian.
+func interpolateLon(a, b, ratio float64) float64 {
+	diff := b - a
+	if diff > 180 {
+		diff -= 360
+	} else if diff < -180 {
+		diff += 360
+	}
+	lon := a + diff*ratio
+	if lon > 180 {
+		lon -= 360
+	} else if lon < -180 {
+		lon += 360
+	}
+	return lon
+}
@@ -0,0 +1,104 @@
+package gpx
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk>
+    <trkseg>
+      <trkpt lat="33.0" lon="126.0"><ele>100</ele><time>2016-07-20T10:00:00Z</time></trkpt>
+      <trkpt lat="34.0" lon="127.0"><ele>200</ele><time>2016-07-20T10:10:00Z</time></trkpt>
+    </trkseg>
+    <trkseg>
+      <trkpt lat="35.0" lon="179.0"><time>2016-07-20T12:00:00Z</time></trkpt>
+      <trkpt lat="35.0" lon="-179.0"><time>2016-07-20T12:10:00Z</time></trkpt>
+      <trkpt lat="0" lon="0"></trkpt>
+    </trkseg>
+  </trk>
+</gpx>`
+
+func TestTrackPosition(t *testing.T) {
+	track, err := Parse(strings.NewReader(testGPX))
+	if err != nil {
+		t.Fatalf("cannot parse: %s", err)
+	}
+	if len(track.Points) != 4 {
+		t.Fatalf("want 4 points, got %d", len(track.Points))
+	}
+	track.MaxGap = time.Hour
+
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("invalid time %q: %s", s, err)
+		}
+		return tm
+	}
+
+	cases := map[string]struct {
+		at      time.Time
+		wantOK  bool
+		wantLat float64
+		wantLon float64
+		wantEle float64
+	}{
+		"first_point": {
+			at:      at("2016-07-20T10:00:00Z"),
+			wantOK:  true,
+			wantLat: 33,
+			wantLon: 126,
+			wantEle: 100,
+		},
+		"interpolated": {
+			at:      at("2016-07-20T10:05:00Z"),
+			wantOK:  true,
+			wantLat: 33.5,
+			wantLon: 126.5,
+			wantEle: 150,
+		},
+		"before_track": {
+			at: at("2016-07-20T09:59:00Z"),
+		},
+		"after_track": {
+			at: at("2016-07-20T12:11:00Z"),
+		},
+		"gap_too_long": {
+			at: at("2016-07-20T11:00:00Z"),
+		},
+		"antimeridian": {
+			at:      at("2016-07-20T12:05:00Z"),
+			wantOK:  true,
+			wantLat: 35,
+			wantLon: 180,
+		},
+	}
+
+	for tname, tc := range cases {
+		pos, ok := track.Position(tc.at)
+		if ok != tc.wantOK {
+			t.Errorf("%s: want %v, got %v", tname, tc.wantOK, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if math.Abs(pos.Latitude-tc.wantLat) > 1e-9 || math.Abs(math.Abs(pos.Longitude)-math.Abs(tc.wantLon)) > 1e-9 {
+			t.Errorf("%s: want %g,%g, got %g,%g", tname, tc.wantLat, tc.wantLon, pos.Latitude, pos.Longitude)
+		}
+		if tc.wantEle != 0 && (pos.Elevation == nil || math.Abs(*pos.Elevation-tc.wantEle) > 1e-9) {
+			t.Errorf("%s: want %g elevation, got %v", tname, tc.wantEle, pos.Elevation)
+		}
+	}
+}
+
+func TestParseNoPoints(t *testing.T) {
+	_, err := Parse(strings.NewReader(`<gpx><trk><trkseg></trkseg></trk></gpx>`))
+	if err != ErrNoPoints {
+		t.Fatalf("want ErrNoPoints, got %v", err)
+	}
+}
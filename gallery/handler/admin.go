@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/web"
+)
+
+// ThumbnailStats return handler that reports rendition cache state and how
+// renditions were created. Cache stats can be nil if the cache size is not
+// limited.
+func ThumbnailStats(
+	cacheStats func() storage.CacheStats,
+	renditionStats func() storage.RenditionStats,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		content := struct {
+			Cache      *storage.CacheStats    `json:"cache,omitempty"`
+			Renditions storage.RenditionStats `json:"renditions"`
+		}{
+			Renditions: renditionStats(),
+		}
+		if cacheStats != nil {
+			stats := cacheStats()
+			content.Cache = &stats
+		}
+		web.JSONResp(w, content, http.StatusOK)
+	}
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/sq"
+	"github.com/husio/gallery/web"
+)
+
+// PhotoOrientation return handler that overrides EXIF orientation of an
+// image with the value provided in "orientation" form field.
+func PhotoOrientation(
+	setOrientation func(imageID string, orientation int) (*storage.Image, error),
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		asJSON := acceptsJSON(r)
+
+		o, err := strconv.Atoi(r.FormValue("orientation"))
+		if err != nil {
+			respondErr(w, asJSON, http.StatusBadRequest, "invalid orientation")
+			return
+		}
+
+		img, err := setOrientation(arg(0), o)
+		switch err {
+		case nil:
+			// all good
+		case storage.ErrInvalidOrientation:
+			respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+			return
+		case sq.ErrNotFound:
+			respondErr(w, asJSON, http.StatusNotFound, "image not found")
+			return
+		default:
+			log.Printf("cannot set %q image orientation: %s", arg(0), err)
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if asJSON {
+			web.JSONResp(w, img, http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// PhotoFocus return handler that sets focal point of an image to the
+// position provided in "x" and "y" form fields, as fractions of the image
+// width and height. Empty position removes the focal point.
+func PhotoFocus(
+	setFocus func(imageID string, x, y *float64) (*storage.Image, error),
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		asJSON := acceptsJSON(r)
+
+		var x, y *float64
+		if rawX, rawY := r.FormValue("x"), r.FormValue("y"); rawX != "" || rawY != "" {
+			fx, errX := strconv.ParseFloat(rawX, 64)
+			fy, errY := strconv.ParseFloat(rawY, 64)
+			if errX != nil || errY != nil {
+				respondErr(w, asJSON, http.StatusBadRequest, "invalid focal point")
+				return
+			}
+			x, y = &fx, &fy
+		}
+
+		img, err := setFocus(arg(0), x, y)
+		switch err {
+		case nil:
+			// all good
+		case storage.ErrInvalidFocus:
+			respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+			return
+		case sq.ErrNotFound:
+			respondErr(w, asJSON, http.StatusNotFound, "image not found")
+			return
+		default:
+			log.Printf("cannot set %q image focal point: %s", arg(0), err)
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if asJSON {
+			web.JSONResp(w, img, http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
+
+// PhotoText return handler that edits title, caption and alternative text of
+// an image. Form submission sets all texts, while JSON PATCH request changes
+// only texts present in the body.
+func PhotoText(
+	db sq.Getter,
+	imageByID func(sq.Getter, string) (*storage.Image, error),
+	setText func(imageID string, text storage.ImageText) (*storage.Image, error),
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		// PATCH request is sent by scripts only
+		asJSON := acceptsJSON(r) || r.Method == "PATCH"
+
+		var text storage.ImageText
+		switch r.Method {
+		case "GET":
+			img, err := imageByID(db, arg(0))
+			switch err {
+			case nil:
+				// all good
+			case sq.ErrNotFound:
+				respondErr(w, asJSON, http.StatusNotFound, "image not found")
+				return
+			default:
+				log.Printf("cannot get %q image: %s", arg(0), err)
+				respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if asJSON {
+				web.JSONResp(w, img, http.StatusOK)
+				return
+			}
+			context := struct {
+				Title          string
+				Image          *storage.Image
+				MaxTitleSize   int
+				MaxCaptionSize int
+				MaxAltTextSize int
+			}{
+				Title:          "describe photo",
+				Image:          img,
+				MaxTitleSize:   storage.MaxTitleSize,
+				MaxCaptionSize: storage.MaxCaptionSize,
+				MaxAltTextSize: storage.MaxAltTextSize,
+			}
+			renderOK(w, "photo-text", context)
+			return
+		case "PATCH":
+			// all texts together are never bigger than that
+			body := io.LimitReader(r.Body, 2*(storage.MaxTitleSize+storage.MaxCaptionSize+storage.MaxAltTextSize))
+			dec := json.NewDecoder(body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&text); err != nil {
+				respondErr(w, asJSON, http.StatusBadRequest, fmt.Sprintf("invalid JSON: %s", err))
+				return
+			}
+		default:
+			title, caption, alt := r.FormValue("title"), r.FormValue("caption"), r.FormValue("alt")
+			text = storage.ImageText{Title: &title, Caption: &caption, AltText: &alt}
+		}
+
+		img, err := setText(arg(0), text)
+		switch err {
+		case nil:
+			// all good
+		case storage.ErrTextTooLong:
+			respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+			return
+		case sq.ErrNotFound:
+			respondErr(w, asJSON, http.StatusNotFound, "image not found")
+			return
+		default:
+			log.Printf("cannot set %q image text: %s", arg(0), err)
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if asJSON {
+			web.JSONResp(w, img, http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/sq"
+	"github.com/husio/gallery/web"
+)
+
+// PhotoGeoJSON return handler that lists geotagged photos as GeoJSON feature
+// collection. Listing accepts the same filters as PhotoList.
+func PhotoGeoJSON(
+	db sq.Selector,
+	listImages func(sq.Selector, storage.ImagesOpts) ([]*storage.Image, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts, err := imagesOpts(r, 1000)
+		if err != nil {
+			web.JSONErr(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Geotagged = true
+
+		images, err := listImages(db, opts)
+		if err != nil {
+			web.StdJSONResp(w, http.StatusInternalServerError)
+			return
+		}
+
+		collection := geoFeatureCollection{
+			Type:     "FeatureCollection",
+			Features: make([]geoFeature, 0, len(images)),
+		}
+		if opts.BBox != nil {
+			b := opts.BBox
+			collection.BBox = []float64{b.MinLon, b.MinLat, b.MaxLon, b.MaxLat}
+		}
+		for _, img := range images {
+			coordinates := []float64{*img.Longitude, *img.Latitude}
+			if img.Altitude != nil {
+				coordinates = append(coordinates, *img.Altitude)
+			}
+			collection.Features = append(collection.Features, geoFeature{
+				Type: "Feature",
+				ID:   img.ImageID,
+				Geometry: geoPoint{
+					Type:        "Point",
+					Coordinates: coordinates,
+				},
+				Properties: geoPhoto{
+					ImageID:      img.ImageID,
+					Created:      img.Created,
+					Width:        img.Width,
+					Height:       img.Height,
+					URL:          fmt.Sprintf("/photo/%s", img.ImageID),
+					ThumbnailURL: fmt.Sprintf("/rendition/%s/%s", storage.ThumbnailPreset, img.ImageID),
+				},
+			})
+		}
+		web.JSONResp(w, collection, http.StatusOK)
+	}
+}
+
+type geoFeatureCollection struct {
+	Type     string       `json:"type"`
+	BBox     []float64    `json:"bbox,omitempty"`
+	Features []geoFeature `json:"features"`
+}
+
+type geoFeature struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Geometry   geoPoint `json:"geometry"`
+	Properties geoPhoto `json:"properties"`
+}
+
+type geoPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type geoPhoto struct {
+	ImageID      string    `json:"imageId"`
+	Created      time.Time `json:"created"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
+}
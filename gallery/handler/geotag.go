@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/husio/gallery/gallery/gpx"
+	"github.com/husio/gallery/gallery/storage"
+)
+
+// Geotag return handler that sets location of photos using uploaded GPX
+// track.
+func Geotag(
+	geotag func(*gpx.Track, storage.GeotagOpts) (*storage.GeotagResult, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			renderOK(w, "geotag", struct{ Title string }{Title: "Geotag photos"})
+			return
+		}
+
+		const megabyte = 1e6
+		if err := r.ParseMultipartForm(20 * megabyte); err != nil {
+			renderErrCode(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var opts storage.GeotagOpts
+		if raw := strings.TrimSpace(r.FormValue("tag")); raw != "" {
+			tq, err := storage.ParseTagQuery(raw)
+			if err != nil {
+				renderErrCode(w, http.StatusBadRequest, fmt.Sprintf("invalid tag query %q: %s", raw, err))
+				return
+			}
+			opts.Tags = tq
+		}
+		var err error
+		if opts.From, err = storage.ParseCameraTime(r.FormValue("from")); err != nil {
+			renderErrCode(w, http.StatusBadRequest, fmt.Sprintf("invalid from time: %s", err))
+			return
+		}
+		if opts.To, err = storage.ParseCameraTime(r.FormValue("to")); err != nil {
+			renderErrCode(w, http.StatusBadRequest, fmt.Sprintf("invalid to time: %s", err))
+			return
+		}
+		if raw := strings.TrimSpace(r.FormValue("offset")); raw != "" {
+			if opts.ClockOffset, err = time.ParseDuration(raw); err != nil {
+				renderErrCode(w, http.StatusBadRequest, fmt.Sprintf("invalid clock offset: %s", err))
+				return
+			}
+		}
+		opts.Overwrite = r.FormValue("overwrite") != ""
+		if opts.Tags == nil && opts.From.IsZero() && opts.To.IsZero() {
+			renderErrCode(w, http.StatusBadRequest, "either tag or time window is required")
+			return
+		}
+
+		fd, _, err := r.FormFile("gpx")
+		if err != nil {
+			renderErrCode(w, http.StatusBadRequest, fmt.Sprintf("cannot read GPX file: %s", err))
+			return
+		}
+		track, err := gpx.Parse(fd)
+		fd.Close()
+		if err != nil {
+			renderErrCode(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if raw := strings.TrimSpace(r.FormValue("max_gap")); raw != "" {
+			if track.MaxGap, err = time.ParseDuration(raw); err != nil {
+				renderErrCode(w, http.StatusBadRequest, fmt.Sprintf("invalid maximum gap: %s", err))
+				return
+			}
+		}
+
+		res, err := geotag(track, opts)
+		if err != nil {
+			renderErr(w, err.Error())
+			return
+		}
+
+		context := struct {
+			Title  string
+			Result *storage.GeotagResult
+		}{
+			Title:  "Geotag photos",
+			Result: res,
+		}
+		renderOK(w, "geotag-result", context)
+	}
+}
@@ -1,54 +1,180 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/husio/gallery/gallery/palette"
 	"github.com/husio/gallery/gallery/storage"
 	"github.com/husio/gallery/sq"
 	"github.com/husio/gallery/web"
 )
 
+// PhotoList return handler that renders listing of images. Thumbnails are
+// presets that can be used interchangeably for the image thumbnail, depending
+// on the screen pixel density. Full text search results come with a snippet
+// of the matching text. Clients accepting JSON get the list of images.
 func PhotoList(
 	db sq.Selector,
 	listImages func(sq.Selector, storage.ImagesOpts) ([]*storage.Image, error),
+	thumbnails storage.Presets,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
-		limit, _ := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
-		if limit == 0 {
-			limit = 100
-		}
-		images, err := listImages(db, storage.ImagesOpts{
-			Offset: offset,
-			Limit:  limit,
-			Tags:   r.URL.Query()["tag"],
-		})
+		opts, err := imagesOpts(r, 100)
+		if err != nil {
+			renderErrCode(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		images, err := listImages(db, opts)
 		if err != nil {
 			renderErr(w, err.Error())
 			return
 		}
 
+		if acceptsJSON(r) {
+			content := struct {
+				Images []*storage.Image `json:"images"`
+			}{
+				Images: images,
+			}
+			web.JSONResp(w, content, http.StatusOK)
+			return
+		}
+
+		var tagQuery string
+		if opts.Tags != nil {
+			tagQuery = opts.Tags.String()
+		}
+		// snippets are already escaped by the storage
+		snippets := make(map[string]template.HTML)
+		for _, img := range images {
+			if img.Snippet != "" {
+				snippets[img.ImageID] = template.HTML(img.Snippet)
+			}
+		}
 		context := struct {
-			Title  string
-			Images []*storage.Image
+			Title      string
+			Query      string
+			TagQuery   string
+			Images     []*storage.Image
+			Snippets   map[string]template.HTML
+			Thumbnails storage.Presets
 		}{
-			Title:  "listing",
-			Images: images,
+			Title:      "listing",
+			Query:      opts.Query,
+			TagQuery:   tagQuery,
+			Images:     images,
+			Snippets:   snippets,
+			Thumbnails: thumbnails,
 		}
 		renderOK(w, "photo-list", context)
 	}
 }
 
+// imagesOpts build image listing options from request query parameters.
+func imagesOpts(r *http.Request, defaultLimit int64) (storage.ImagesOpts, error) {
+	query := r.URL.Query()
+
+	offset, _ := strconv.ParseInt(query.Get("offset"), 10, 64)
+	limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+	if limit == 0 {
+		limit = defaultLimit
+	}
+	opts := storage.ImagesOpts{
+		Offset: offset,
+		Limit:  limit,
+		Camera: strings.TrimSpace(query.Get("camera")),
+		Lens:   strings.TrimSpace(query.Get("lens")),
+		Query:  strings.TrimSpace(query.Get("q")),
+	}
+
+	// every tag parameter is a separate query and all of them must match
+	var tags storage.TagAnd
+	for _, raw := range query["tag"] {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		tq, err := storage.ParseTagQuery(raw)
+		if err != nil {
+			return opts, fmt.Errorf("invalid tag query %q: %s", raw, err)
+		}
+		tags = append(tags, tq)
+	}
+	switch len(tags) {
+	case 0:
+		// no filtering
+	case 1:
+		opts.Tags = tags[0]
+	default:
+		opts.Tags = tags
+	}
+
+	if raw := query.Get("color"); raw != "" {
+		c, err := palette.ParseHex(raw)
+		if err != nil {
+			return opts, err
+		}
+		opts.Color = &c
+	}
+	if raw := query.Get("color_distance"); raw != "" {
+		d, err := strconv.ParseFloat(raw, 64)
+		if err != nil || !(d > 0) {
+			return opts, fmt.Errorf("invalid color distance %q", raw)
+		}
+		opts.ColorDistance = d
+	}
+
+	for _, raw := range query["score"] {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		f, err := storage.ParseScoreFilter(raw)
+		if err != nil {
+			return opts, err
+		}
+		opts.Scores = append(opts.Scores, f)
+	}
+	if raw := query.Get("sort"); raw != "" {
+		if !storage.ValidSort(raw) {
+			return opts, fmt.Errorf("invalid sort %q", raw)
+		}
+		opts.Sort = raw
+	}
+
+	if raw := query.Get("bbox"); raw != "" {
+		bbox, err := storage.ParseBBox(raw)
+		if err != nil {
+			return opts, fmt.Errorf("invalid bbox %q: %s", raw, err)
+		}
+		opts.BBox = bbox
+	}
+
+	return opts, nil
+}
+
+// PhotoUpload return handler for the upload form. Submitted files are
+// streamed to disk one by one using spool, so that the whole request is never
+// kept in memory. Files bigger than maxFileSize and requests bigger than
+// maxRequestSize are rejected.
+//
+// Failure of a single file upload does not stop processing of the remaining
+// files. Clients accepting JSON get a report with the result of every file.
 func PhotoUpload(
 	db sq.Selector,
 	tagGroups func(sq.Selector) ([]*storage.TagGroup, error),
-	uploadFile func(fd io.ReadSeeker, tags []string) error,
+	spool func(r io.Reader, maxSize int64) (*storage.SpooledFile, error),
+	uploadFile func(r io.Reader, tags []string) (*storage.UploadResult, error),
+	maxFileSize, maxRequestSize int64,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
@@ -59,88 +185,278 @@ func PhotoUpload(
 			}
 
 			context := struct {
-				Title string
-				Tags  []*storage.TagGroup
+				Title  string
+				Tags   []*storage.TagGroup
+				Accept string
 			}{
-				Title: "Upload photos",
-				Tags:  tags,
+				Title:  "Upload photos",
+				Tags:   tags,
+				Accept: storage.UploadAccept(),
 			}
 			renderOK(w, "upload", context)
 			return
 		}
 
-		const megabyte = 1e6
-		if err := r.ParseMultipartForm(100 * megabyte); err != nil {
-			renderErr(w, err.Error())
+		asJSON := acceptsJSON(r)
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			renderUploadErr(w, asJSON, err)
+			return
 		}
 
-		var tags []string
-		for i := 1; i < 20; i++ {
-			name := r.FormValue(fmt.Sprintf("tag_%d", i))
-			name = strings.TrimSpace(name)
-			if name == "" {
-				continue
-			}
-			tags = append(tags, name)
+		// tags can be sent after the files, so all files must be read
+		// before any of them is uploaded
+		type spooled struct {
+			name string
+			file *storage.SpooledFile
+			// err is set if the file could not be read
+			err error
 		}
+		var (
+			tags  []string
+			files []spooled
+		)
+		defer func() {
+			for _, f := range files {
+				if f.file != nil {
+					f.file.Remove()
+				}
+			}
+		}()
 
-		for _, f := range r.MultipartForm.File["photos"] {
-			fd, err := f.Open()
-			if err != nil {
-				renderErr(w, err.Error())
-				return
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
 			}
-			err = uploadFile(fd, tags)
-			fd.Close()
 			if err != nil {
-				renderErr(w, err.Error())
+				renderUploadErr(w, asJSON, err)
 				return
 			}
 
+			switch name := part.FormName(); {
+			case name == "photos" && part.FileName() != "":
+				f, err := spool(part, maxFileSize)
+				if err != nil {
+					// a rejected file is skipped, only exceeding the
+					// request size limit stops processing
+					_, drainErr := io.Copy(ioutil.Discard, part)
+					var maxBytes *http.MaxBytesError
+					if errors.As(err, &maxBytes) || errors.As(drainErr, &maxBytes) {
+						renderUploadErr(w, asJSON, maxBytes)
+						return
+					}
+					log.Printf("cannot read %q: %s", part.FileName(), err)
+				}
+				files = append(files, spooled{name: part.FileName(), file: f, err: err})
+			case strings.HasPrefix(name, "tag_"):
+				value, err := ioutil.ReadAll(io.LimitReader(part, maxTagSize))
+				if err != nil {
+					renderUploadErr(w, asJSON, err)
+					return
+				}
+				if tag := strings.TrimSpace(string(value)); tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			part.Close()
+		}
+
+		var (
+			report []*uploadReport
+			failed []string
+			// tooLarge is set if any file was rejected because of its
+			// size, which is the client and not the server failure
+			tooLarge bool
+		)
+		for _, f := range files {
+			rep := uploadReport{File: f.name}
+			if f.err != nil {
+				tooLarge = tooLarge || errors.Is(f.err, storage.ErrTooLarge)
+				rep.Error = f.err.Error()
+				failed = append(failed, fmt.Sprintf("%s: %s", f.name, f.err))
+			} else if res, err := uploadFile(f.file, tags); err != nil {
+				log.Printf("cannot upload %q: %s", f.name, err)
+				rep.Error = err.Error()
+				failed = append(failed, fmt.Sprintf("%s: %s", f.name, err))
+			} else {
+				rep.ImageID = res.Image.ImageID
+				rep.Created = res.Created
+				rep.Tags = res.Tags
+			}
+			report = append(report, &rep)
+		}
+
+		if asJSON {
+			content := struct {
+				Files []*uploadReport `json:"files"`
+			}{
+				Files: report,
+			}
+			web.JSONResp(w, content, http.StatusOK)
+			return
+		}
+		if len(failed) != 0 {
+			if tooLarge {
+				respondErr(w, asJSON, http.StatusRequestEntityTooLarge, strings.Join(failed, "; "))
+			} else {
+				renderErr(w, strings.Join(failed, "; "))
+			}
+			return
 		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 }
 
+// uploadReport is the result of a single file upload.
+type uploadReport struct {
+	File    string   `json:"file"`
+	ImageID string   `json:"imageId,omitempty"`
+	Created bool     `json:"created"`
+	Tags    []string `json:"tags,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// maxTagSize is the maximum length of a single tag name sent in upload form.
+const maxTagSize = 1024
+
+// renderUploadErr write error response for an error that happened while
+// reading upload request.
+func renderUploadErr(w http.ResponseWriter, asJSON bool, err error) {
+	code := http.StatusBadRequest
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) || errors.Is(err, storage.ErrTooLarge) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	respondErr(w, asJSON, code, err.Error())
+}
+
+// respondErr write error response either as JSON or as HTML page.
+func respondErr(w http.ResponseWriter, asJSON bool, code int, text string) {
+	if asJSON {
+		web.JSONErr(w, text, code)
+	} else {
+		renderErrCode(w, code, text)
+	}
+}
+
+// acceptsJSON return true if client prefers JSON response over HTML.
+func acceptsJSON(r *http.Request) bool {
+	for _, mt := range strings.Split(r.Header.Get("Accept"), ",") {
+		if i := strings.Index(mt, ";"); i != -1 {
+			mt = mt[:i]
+		}
+		if strings.TrimSpace(mt) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// ServePhoto return handler that serves original image file, using media
+// type it was uploaded with.
 func ServePhoto(
 	db sq.Getter,
 	imageByID func(sq.Getter, string) (*storage.Image, error),
-	openImage func(year, orientation int, id string) (io.ReadCloser, error),
+	openImage func(*storage.Image) (io.ReadCloser, error),
 ) web.Handler {
 	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
-		img, err := imageByID(db, arg(0))
-		switch err {
-		case nil:
-			// all good
-		case sq.ErrNotFound:
-			renderErr(w, "not found")
-			return
-		default:
-			log.Printf("cannot get %q image: %s", arg(0), err)
-			renderErr(w, err.Error())
-			return
-		}
+		serveImage(w, r, db, imageByID, openImage, arg(0), func(img *storage.Image) string {
+			if img.MediaType == "" {
+				return storage.DefaultMediaType
+			}
+			return img.MediaType
+		})
+	}
+}
 
-		if checkLastModified(w, r, img.Created) {
+// ServeRendition return handler that serves JPEG encoded rendition of an
+// image, created using preset of given name.
+func ServeRendition(
+	db sq.Getter,
+	imageByID func(sq.Getter, string) (*storage.Image, error),
+	presets storage.Presets,
+	openRendition func(*storage.Image, storage.Preset) (io.ReadCloser, error),
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		preset, ok := presets.Get(arg(0))
+		if !ok {
+			renderErrCode(w, http.StatusNotFound, "unknown preset")
 			return
 		}
+		openImage := func(img *storage.Image) (io.ReadCloser, error) {
+			return openRendition(img, preset)
+		}
+		serveImage(w, r, db, imageByID, openImage, arg(1), func(*storage.Image) string {
+			return "image/jpeg"
+		})
+	}
+}
 
-		fd, err := openImage(img.Created.Year(), img.Orientation, img.ImageID)
-		if err != nil {
-			log.Printf("cannot read %q image file: %s", img.ImageID, err)
-			renderErr(w, err.Error())
+// ThumbnailRedirect return handler that redirects thumbnail URL used before
+// rendition presets were introduced to the thumbnail rendition.
+func ThumbnailRedirect() web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		http.Redirect(w, r, "/rendition/"+storage.ThumbnailPreset+"/"+url.PathEscape(arg(0)), http.StatusMovedPermanently)
+	}
+}
+
+func serveImage(
+	w http.ResponseWriter,
+	r *http.Request,
+	db sq.Getter,
+	imageByID func(sq.Getter, string) (*storage.Image, error),
+	openImage func(*storage.Image) (io.ReadCloser, error),
+	imageID string,
+	contentType func(*storage.Image) string,
+) {
+	img, err := imageByID(db, imageID)
+	switch err {
+	case nil:
+		// all good
+	case sq.ErrNotFound:
+		renderErr(w, "not found")
+		return
+	default:
+		log.Printf("cannot get %q image: %s", imageID, err)
+		renderErr(w, err.Error())
+		return
+	}
+
+	// image content depends on the orientation and the focal point, which
+	// can be changed, so the creation time alone is not enough to validate
+	// client's cache
+	etag := fmt.Sprintf(`"%s-%d"`, img.ImageID, img.Orientation)
+	if img.FocusX != nil && img.FocusY != nil {
+		etag = fmt.Sprintf(`"%s-%d-%.4f-%.4f"`, img.ImageID, img.Orientation, *img.FocusX, *img.FocusY)
+	}
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match == etag {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		defer fd.Close()
-
-		w.Header().Set("X-Image-ID", img.ImageID)
-		w.Header().Set("X-Image-Width", fmt.Sprint(img.Width))
-		w.Header().Set("X-Image-Height", fmt.Sprint(img.Height))
-		w.Header().Set("X-Image-Created", img.Created.Format(time.RFC3339))
-		w.Header().Set("Content-Type", "image/jpeg")
+	} else if checkLastModified(w, r, img.Created) {
+		return
+	}
 
-		io.Copy(w, fd)
+	fd, err := openImage(img)
+	if err != nil {
+		log.Printf("cannot read %q image file: %s", img.ImageID, err)
+		renderErr(w, err.Error())
+		return
 	}
+	defer fd.Close()
+
+	w.Header().Set("X-Image-ID", img.ImageID)
+	w.Header().Set("X-Image-Width", fmt.Sprint(img.Width))
+	w.Header().Set("X-Image-Height", fmt.Sprint(img.Height))
+	w.Header().Set("X-Image-Created", img.Created.Format(time.RFC3339))
+	w.Header().Set("Content-Type", contentType(img))
+
+	io.Copy(w, fd)
 }
 
 func checkLastModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
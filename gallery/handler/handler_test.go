@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/husio/gallery/gallery/storage"
+)
+
+func TestPhotoUploadReport(t *testing.T) {
+	// uploadFile accept file content in form of "<result> <image id>"
+	uploadFile := func(r io.Reader, tags []string) (*storage.UploadResult, error) {
+		raw, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(raw))
+		switch fields[0] {
+		case "new":
+			return &storage.UploadResult{Image: &storage.Image{ImageID: fields[1]}, Created: true, Tags: tags}, nil
+		case "existing":
+			return &storage.UploadResult{Image: &storage.Image{ImageID: fields[1]}, Created: false, Tags: tags}, nil
+		default:
+			return nil, errors.New("cannot decode image")
+		}
+	}
+	const maxFileSize = 100
+	spool := func(r io.Reader, maxSize int64) (*storage.SpooledFile, error) {
+		return storage.Spool("", r, maxSize)
+	}
+
+	cases := map[string]struct {
+		files    [][2]string
+		html     bool
+		wantCode int
+		want     []*uploadReport
+	}{
+		"mixed results": {
+			files: [][2]string{
+				{"new.jpg", "new a"},
+				{"huge.jpg", "new " + strings.Repeat("x", maxFileSize)},
+				{"existing.jpg", "existing b"},
+				{"broken.jpg", "broken"},
+				{"last.jpg", "new c"},
+			},
+			wantCode: http.StatusOK,
+			want: []*uploadReport{
+				{File: "new.jpg", ImageID: "a", Created: true, Tags: []string{"trip"}},
+				{File: "huge.jpg", Error: storage.ErrTooLarge.Error()},
+				{File: "existing.jpg", ImageID: "b", Created: false, Tags: []string{"trip"}},
+				{File: "broken.jpg", Error: "cannot decode image"},
+				{File: "last.jpg", ImageID: "c", Created: true, Tags: []string{"trip"}},
+			},
+		},
+		"request too large": {
+			files: [][2]string{
+				{"new.jpg", "new a"},
+				{"huge.jpg", strings.Repeat("x", 30*maxFileSize)},
+			},
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		"html uploaded": {
+			files: [][2]string{
+				{"new.jpg", "new a"},
+			},
+			html:     true,
+			wantCode: http.StatusSeeOther,
+		},
+		"html file too large": {
+			files: [][2]string{
+				{"new.jpg", "new a"},
+				{"huge.jpg", "new " + strings.Repeat("x", maxFileSize)},
+			},
+			html:     true,
+			wantCode: http.StatusRequestEntityTooLarge,
+		},
+		"html upload failure": {
+			files: [][2]string{
+				{"broken.jpg", "broken"},
+			},
+			html:     true,
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for tname, tc := range cases {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, f := range tc.files {
+			fw, err := mw.CreateFormFile("photos", f[0])
+			if err != nil {
+				t.Fatalf("%s: cannot create form file: %s", tname, err)
+			}
+			io.WriteString(fw, f[1])
+		}
+		// tags are sent after the files
+		mw.WriteField("tag_1", "trip")
+		mw.Close()
+
+		r := httptest.NewRequest("POST", "/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		if !tc.html {
+			r.Header.Set("Accept", "application/json")
+		}
+		w := httptest.NewRecorder()
+		PhotoUpload(nil, nil, spool, uploadFile, maxFileSize, 20*maxFileSize)(w, r)
+
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: want %d response, got %d: %s", tname, tc.wantCode, w.Code, w.Body)
+			continue
+		}
+		if tc.want == nil {
+			continue
+		}
+		var resp struct {
+			Files []*uploadReport `json:"files"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Errorf("%s: cannot decode response: %s", tname, err)
+			continue
+		}
+		if !reflect.DeepEqual(resp.Files, tc.want) {
+			t.Errorf("%s: want report", tname)
+			for i := range tc.want {
+				t.Logf("want %+v", tc.want[i])
+			}
+			for i := range resp.Files {
+				t.Logf(" got %+v", resp.Files[i])
+			}
+		}
+	}
+}
+
+func TestTusUploadTags(t *testing.T) {
+	cases := map[string]struct {
+		meta     map[string]string
+		wantTags []string
+		wantErr  bool
+	}{
+		"no tags": {
+			meta: map[string]string{"filename": "a.jpg"},
+		},
+		"tag with comma": {
+			meta:     map[string]string{"tags": `["Seoul, Korea", " trip ", ""]`},
+			wantTags: []string{"Seoul, Korea", "trip"},
+		},
+		"invalid tags": {
+			meta:    map[string]string{"tags": "trip,Korea"},
+			wantErr: true,
+		},
+	}
+
+	for tname, tc := range cases {
+		var gotTags []string
+		complete := TusUpload(func(r io.Reader, tags []string) (*storage.UploadResult, error) {
+			gotTags = tags
+			return &storage.UploadResult{}, nil
+		})
+		err := complete(strings.NewReader("photo"), tc.meta)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error", tname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tname, err)
+			continue
+		}
+		if !reflect.DeepEqual(gotTags, tc.wantTags) {
+			t.Errorf("%s: want %q tags, got %q", tname, tc.wantTags, gotTags)
+		}
+	}
+}
+
+func TestThumbnailRedirect(t *testing.T) {
+	r := httptest.NewRequest("GET", "/thumbnail/Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk.jpg", nil)
+	w := httptest.NewRecorder()
+	ThumbnailRedirect()(w, r, func(int) string { return "Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk" })
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("want %d response, got %d", http.StatusMovedPermanently, w.Code)
+	}
+	if want, got := "/rendition/thumb/Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk", w.Header().Get("Location"); got != want {
+		t.Errorf("want %s location, got %s", want, got)
+	}
+}
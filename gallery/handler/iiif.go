@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/husio/gallery/gallery/iiif"
+	"github.com/husio/gallery/gallery/orientation"
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/sq"
+	"github.com/husio/gallery/web"
+)
+
+// IIIFBaseRedirect return handler that redirects image base URI to its
+// information document.
+func IIIFBaseRedirect() web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		http.Redirect(w, r, r.URL.Path+"/info.json", http.StatusSeeOther)
+	}
+}
+
+// IIIFInfo return handler that serves IIIF image information document.
+func IIIFInfo(
+	db sq.Getter,
+	imageByID func(sq.Getter, string) (*storage.Image, error),
+	limits iiif.Limits,
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		img, ok := iiifImage(w, db, imageByID, arg(0))
+		if !ok {
+			return
+		}
+		width, height := orientation.Size(img.Width, img.Height, img.Orientation)
+		info := iiif.NewInfo(requestBaseURL(r)+"/iiif/"+img.ImageID, width, height, limits)
+
+		b, err := json.MarshalIndent(info, "", "\t")
+		if err != nil {
+			web.StdJSONResp(w, http.StatusInternalServerError)
+			return
+		}
+		if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+			w.Header().Set("Content-Type", iiif.MediaType)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("Link", `<`+iiif.Protocol+`/3/level2.json>;rel="profile"`)
+		w.Write(b)
+	}
+}
+
+// IIIFImage return handler that serves images requested using IIIF Image
+// API. Rendered images are cached.
+func IIIFImage(
+	db sq.Getter,
+	imageByID func(sq.Getter, string) (*storage.Image, error),
+	decode func(*storage.Image) (image.Image, error),
+	cache *iiif.DiskCache,
+	limits iiif.Limits,
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		req, err := iiif.ParseRequest(arg(1), arg(2), arg(3), arg(4))
+		if err != nil {
+			writeIIIFErr(w, err)
+			return
+		}
+		img, ok := iiifImage(w, db, imageByID, arg(0))
+		if !ok {
+			return
+		}
+		width, height := orientation.Size(img.Width, img.Height, img.Orientation)
+		plan, err := req.Plan(width, height, limits)
+		if err != nil {
+			writeIIIFErr(w, err)
+			return
+		}
+
+		// orientation can be changed, so it must be part of the key
+		key := fmt.Sprintf("o%d_%s", img.Orientation, plan.Key())
+		fd, err := cache.Open(img.ImageID, key)
+		if err != nil {
+			src, err := decode(img)
+			if err != nil {
+				log.Printf("cannot decode %q image: %s", img.ImageID, err)
+				web.JSONErr(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			out := plan.Apply(src)
+			err = cache.Put(img.ImageID, key, func(w io.Writer) error {
+				return plan.Encode(w, out)
+			})
+			if err != nil {
+				log.Printf("cannot cache %q image: %s", img.ImageID, err)
+				web.JSONErr(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if fd, err = cache.Open(img.ImageID, key); err != nil {
+				web.JSONErr(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		defer fd.Close()
+
+		w.Header().Set("Content-Type", plan.ContentType())
+		w.Header().Set("Link", `<`+iiif.Protocol+`/3/level2.json>;rel="profile"`)
+		io.Copy(w, fd)
+	}
+}
+
+func iiifImage(
+	w http.ResponseWriter,
+	db sq.Getter,
+	imageByID func(sq.Getter, string) (*storage.Image, error),
+	imageID string,
+) (*storage.Image, bool) {
+	img, err := imageByID(db, imageID)
+	switch err {
+	case nil:
+		return img, true
+	case sq.ErrNotFound:
+		web.JSONErr(w, "image not found", http.StatusNotFound)
+	default:
+		log.Printf("cannot get %q image: %s", imageID, err)
+		web.JSONErr(w, err.Error(), http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+func writeIIIFErr(w http.ResponseWriter, err error) {
+	if e, ok := err.(*iiif.Error); ok {
+		web.JSONErr(w, e.Msg, e.Code)
+		return
+	}
+	web.JSONErr(w, err.Error(), http.StatusInternalServerError)
+}
+
+// requestBaseURL return scheme and host the request was sent to, taking into
+// account proxy headers.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
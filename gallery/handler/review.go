@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/sq"
+	"github.com/husio/gallery/web"
+)
+
+// PhotoReview return handler that lists images of the worst quality first, so
+// that rejected photos can be found and deleted in bulk. Listing accepts the
+// same filters as PhotoList, for example a tag of a burst of photos.
+// Submitting the form deletes all images selected with "image" form field.
+func PhotoReview(
+	db sq.Selector,
+	listImages func(sq.Selector, storage.ImagesOpts) ([]*storage.Image, error),
+	deleteImage func(imageID string) error,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asJSON := acceptsJSON(r)
+
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+				return
+			}
+			var (
+				deleted []string
+				failed  []string
+			)
+			for _, id := range r.PostForm["image"] {
+				switch err := deleteImage(id); err {
+				case nil:
+					deleted = append(deleted, id)
+				case sq.ErrNotFound:
+					// already deleted, most likely by submitting
+					// the form twice
+				default:
+					log.Printf("cannot delete %q image: %s", id, err)
+					failed = append(failed, id+": "+err.Error())
+				}
+			}
+
+			if asJSON {
+				content := struct {
+					Deleted []string `json:"deleted"`
+					Errors  []string `json:"errors,omitempty"`
+				}{
+					Deleted: deleted,
+					Errors:  failed,
+				}
+				web.JSONResp(w, content, http.StatusOK)
+				return
+			}
+			if len(failed) != 0 {
+				renderErr(w, strings.Join(failed, "; "))
+				return
+			}
+			// form is submitted to the same URL, so the listing is kept
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+			return
+		}
+
+		opts, err := imagesOpts(r, 50)
+		if err != nil {
+			respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+			return
+		}
+		if opts.Sort == "" {
+			opts.Sort = "quality"
+		}
+
+		images, err := listImages(db, opts)
+		if err != nil {
+			log.Printf("cannot list images for review: %s", err)
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if asJSON {
+			content := struct {
+				Images []*storage.Image `json:"images"`
+			}{
+				Images: images,
+			}
+			web.JSONResp(w, content, http.StatusOK)
+			return
+		}
+
+		var tagQuery string
+		if opts.Tags != nil {
+			tagQuery = opts.Tags.String()
+		}
+		context := struct {
+			Title    string
+			TagQuery string
+			URL      string
+			Images   []*storage.Image
+		}{
+			Title:    "review",
+			TagQuery: tagQuery,
+			URL:      r.URL.String(),
+			Images:   images,
+		}
+		renderOK(w, "review", context)
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/sq"
+	"github.com/husio/gallery/web"
+)
+
+// SimilarPhotos return handler that lists images looking similar to given
+// one. Maximum perceptual hash distance can be set with "distance" query
+// parameter.
+func SimilarPhotos(
+	db sq.Selector,
+	similarImages func(sq.Selector, string, int) ([]*storage.SimilarImage, error),
+) web.Handler {
+	return func(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+		distance, err := hashDistance(r, 10)
+		if err != nil {
+			web.JSONErr(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		images, err := similarImages(db, arg(0), distance)
+		switch err {
+		case nil:
+			// all good
+		case sq.ErrNotFound:
+			web.JSONErr(w, "image not found or not hashed yet", http.StatusNotFound)
+			return
+		default:
+			log.Printf("cannot find images similar to %q: %s", arg(0), err)
+			web.JSONErr(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		content := struct {
+			Images []*storage.SimilarImage `json:"images"`
+		}{
+			Images: images,
+		}
+		web.JSONResp(w, content, http.StatusOK)
+	}
+}
+
+// DuplicatePhotos return handler that reports groups of images looking nearly
+// the same. Maximum perceptual hash distance can be set with "distance"
+// query parameter.
+func DuplicatePhotos(
+	db sq.Selector,
+	duplicateCandidates func(sq.Selector, int) ([][]*storage.Image, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asJSON := acceptsJSON(r)
+
+		distance, err := hashDistance(r, 4)
+		if err != nil {
+			respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		groups, err := duplicateCandidates(db, distance)
+		if err != nil {
+			log.Printf("cannot find duplicate candidates: %s", err)
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if asJSON {
+			content := struct {
+				Groups [][]*storage.Image `json:"groups"`
+			}{
+				Groups: groups,
+			}
+			web.JSONResp(w, content, http.StatusOK)
+			return
+		}
+
+		context := struct {
+			Title    string
+			Distance int
+			Groups   [][]*storage.Image
+		}{
+			Title:    "duplicate candidates",
+			Distance: distance,
+			Groups:   groups,
+		}
+		renderOK(w, "duplicates", context)
+	}
+}
+
+// hashDistance return perceptual hash distance from "distance" query
+// parameter.
+func hashDistance(r *http.Request, defaultDistance int) (int, error) {
+	raw := r.URL.Query().Get("distance")
+	if raw == "" {
+		return defaultDistance, nil
+	}
+	distance, err := strconv.Atoi(raw)
+	if err != nil || distance < 0 || distance > 64 {
+		return 0, fmt.Errorf("invalid distance %q", raw)
+	}
+	return distance, nil
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/sq"
+	"github.com/husio/gallery/web"
+)
+
+// TagEditor change tags of all images at once.
+type TagEditor interface {
+	Rename(from, to string, keepAlias bool) (int64, error)
+	Merge(names []string, into string, keepAliases bool) (int64, error)
+	Delete(name string) (int64, error)
+	SetAlias(alias, name string) error
+	DeleteAlias(alias string) error
+}
+
+// TagAdmin return handler of the tag management page. Submitted form must
+// contain "action" field, which is one of:
+//
+//	rename  - rename "from" tag to "to"
+//	merge   - merge all "name" tags into "into" tag
+//	delete  - delete all "name" tags
+//	alias   - define "alias" of "name" tag
+//	unalias - delete "alias"
+//
+// Renamed and merged tags are kept as aliases if "keep" field is set.
+func TagAdmin(
+	db sq.Selector,
+	tagGroups func(sq.Selector) ([]*storage.TagGroup, error),
+	tagAliases func(sq.Selector) ([]*storage.TagAlias, error),
+	tags TagEditor,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asJSON := acceptsJSON(r)
+
+		if r.Method == "POST" {
+			if err := r.ParseForm(); err != nil {
+				respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+				return
+			}
+			changed, err := changeTags(r, tags)
+			switch err {
+			case nil:
+				// all good
+			case storage.ErrInvalidTag, errUnknownAction:
+				respondErr(w, asJSON, http.StatusBadRequest, err.Error())
+				return
+			case sq.ErrNotFound:
+				respondErr(w, asJSON, http.StatusNotFound, "alias not found")
+				return
+			default:
+				log.Printf("cannot change tags: %s", err)
+				respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			if asJSON {
+				content := struct {
+					Changed int64 `json:"changed"`
+				}{
+					Changed: changed,
+				}
+				web.JSONResp(w, content, http.StatusOK)
+				return
+			}
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+
+		groups, err := tagGroups(db)
+		if err != nil {
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+		aliases, err := tagAliases(db)
+		if err != nil {
+			respondErr(w, asJSON, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if asJSON {
+			content := struct {
+				Tags    []*storage.TagGroup `json:"tags"`
+				Aliases []*storage.TagAlias `json:"aliases"`
+			}{
+				Tags:    groups,
+				Aliases: aliases,
+			}
+			web.JSONResp(w, content, http.StatusOK)
+			return
+		}
+
+		context := struct {
+			Title   string
+			Tags    []*storage.TagGroup
+			Aliases []*storage.TagAlias
+		}{
+			Title:   "tags",
+			Tags:    groups,
+			Aliases: aliases,
+		}
+		renderOK(w, "tag-admin", context)
+	}
+}
+
+var errUnknownAction = errors.New("unknown action")
+
+// changeTags apply change described by the submitted form and return the
+// number of changed image tags.
+func changeTags(r *http.Request, tags TagEditor) (int64, error) {
+	keep := r.FormValue("keep") != ""
+
+	switch r.FormValue("action") {
+	case "rename":
+		return tags.Rename(r.FormValue("from"), r.FormValue("to"), keep)
+	case "merge":
+		return tags.Merge(r.Form["name"], r.FormValue("into"), keep)
+	case "delete":
+		var deleted int64
+		for _, name := range r.Form["name"] {
+			n, err := tags.Delete(name)
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+		}
+		return deleted, nil
+	case "alias":
+		return 0, tags.SetAlias(r.FormValue("alias"), r.FormValue("name"))
+	case "unalias":
+		return 0, tags.DeleteAlias(r.FormValue("alias"))
+	default:
+		return 0, errUnknownAction
+	}
+}
@@ -25,6 +25,10 @@ func render(w http.ResponseWriter, code int, template string, context interface{
 }
 
 func renderErr(w http.ResponseWriter, text string) {
+	renderErrCode(w, http.StatusInternalServerError, text)
+}
+
+func renderErrCode(w http.ResponseWriter, code int, text string) {
 	context := struct {
 		Title string
 		Text  string
@@ -32,7 +36,7 @@ func renderErr(w http.ResponseWriter, text string) {
 		Title: "error",
 		Text:  text,
 	}
-	render(w, http.StatusInternalServerError, "error", context)
+	render(w, code, "error", context)
 }
 
 var tmpl = template.Must(template.New("").Parse(`
@@ -80,7 +84,7 @@ var tmpl = template.Must(template.New("").Parse(`
 
                         <h3>2. select files to upload</h3>
                         <div>
-                                <input type="file" name="photos" multiple="multiple" accept=".jpg,.png">
+                                <input type="file" name="photos" multiple="multiple" accept="{{.Accept}}">
                         </div>
 
                         <h3>3. upload</h3>
@@ -91,23 +95,217 @@ var tmpl = template.Must(template.New("").Parse(`
 {{end}}
 
 
+{{define "geotag"}}
+        {{template "header" .}}
+        <body>
+                <a href="/">back to listing</a>
+                <form enctype="multipart/form-data" action="/geotag" method="POST">
+                        <h3>1. select GPX track</h3>
+                        <div>
+                                <input type="file" name="gpx" accept=".gpx,application/gpx+xml" required>
+                        </div>
+
+                        <h3>2. select photos</h3>
+                        <div>
+                                <input type="text" name="tag" placeholder="Tag query, eg. Holiday in Korea">
+                        </div>
+                        <div>
+                                Taken between
+                                <input type="datetime-local" name="from">
+                                and
+                                <input type="datetime-local" name="to">
+                                (camera time)
+                        </div>
+
+                        <h3>3. adjust</h3>
+                        <div>
+                                <input type="text" name="offset" placeholder="Camera clock offset from UTC, eg. 9h or -1h30m">
+                        </div>
+                        <div>
+                                <input type="text" name="max_gap" placeholder="Longest gap between track points, eg. 10m">
+                        </div>
+                        <div>
+                                <label><input type="checkbox" name="overwrite"> overwrite existing locations</label>
+                        </div>
+
+                        <input type="submit" value="geotag">
+                </form>
+        </body>
+</html>
+{{end}}
+
+
+{{define "geotag-result"}}
+        {{template "header" .}}
+        <body>
+                <a href="/">back to listing</a>
+                <div>{{.Result.Matched}} photos matched</div>
+                <div>{{len .Result.Geotagged}} photos geotagged</div>
+                <div>{{.Result.Skipped}} photos skipped, already geotagged</div>
+                <div>{{.Result.OutOfTrack}} photos taken outside of the track</div>
+        </body>
+</html>
+{{end}}
+
+
+{{define "duplicates"}}
+        {{template "header" .}}
+        <body>
+                <a href="/">back to listing</a>
+                <h3>Groups of nearly identical photos, hash distance at most {{.Distance}}</h3>
+                {{range .Groups}}
+                        <div>
+                                {{range .}}
+                                        <a href="/photo/{{.ImageID}}">
+                                                <img src="/rendition/thumb/{{.ImageID}}"
+                                                        title="{{.Width}}x{{.Height}} {{.Created}}" style="width:100px;height:100px;background:#000;">
+                                        </a>
+                                {{end}}
+                        </div>
+                {{else}}
+                        <div>No duplicate candidates</div>
+                {{end}}
+        </body>
+</html>
+{{end}}
+
+
+{{define "photo-text"}}
+        {{template "header" .}}
+        <body>
+                <a href="/">back to listing</a>
+                {{with .Image}}
+                        <div>
+                                <img src="/rendition/thumb/{{.ImageID}}" alt="{{.AltText}}" style="width:200px;height:200px;background:#000;">
+                        </div>
+                        <form action="/photo/{{.ImageID}}/text" method="POST">
+                                <div>
+                                        <input type="text" name="title" value="{{.Title}}" maxlength="{{$.MaxTitleSize}}" placeholder="Title">
+                                </div>
+                                <div>
+                                        <textarea name="caption" maxlength="{{$.MaxCaptionSize}}" placeholder="Caption">{{.Caption}}</textarea>
+                                </div>
+                                <div>
+                                        <input type="text" name="alt" value="{{.AltText}}" maxlength="{{$.MaxAltTextSize}}" placeholder="Description for readers that cannot see the photo">
+                                </div>
+                                <input type="submit" value="Save">
+                        </form>
+                {{end}}
+        </body>
+</html>
+{{end}}
+
+
+{{define "tag-admin"}}
+        {{template "header" .}}
+        <body>
+                <a href="/">back to listing</a>
+                <h3>Tags</h3>
+                <form action="/admin/tags" method="POST">
+                        {{range .Tags}}
+                                <div>
+                                        <label><input type="checkbox" name="name" value="{{.Name}}"> {{.Name}}</label>
+                                        <a href="/?tag={{.Name}}">{{.Count}} photos</a>
+                                </div>
+                        {{else}}
+                                <div>No tags</div>
+                        {{end}}
+                        <div>
+                                <input type="text" name="into" placeholder="Tag name" list="tag-names">
+                                <label><input type="checkbox" name="keep"> keep old names as aliases</label>
+                                <button type="submit" name="action" value="merge">Rename or merge selected</button>
+                                <button type="submit" name="action" value="delete">Delete selected</button>
+                        </div>
+                </form>
+
+                <h3>Aliases</h3>
+                {{range .Aliases}}
+                        <form action="/admin/tags" method="POST">
+                                {{.Alias}} &rarr; {{.Name}}
+                                <input type="hidden" name="alias" value="{{.Alias}}">
+                                <button type="submit" name="action" value="unalias">Delete</button>
+                        </form>
+                {{end}}
+                <form action="/admin/tags" method="POST">
+                        <input type="text" name="alias" placeholder="Alias, eg. Jeju" required>
+                        &rarr;
+                        <input type="text" name="name" placeholder="Tag name, eg. jeju" list="tag-names" required>
+                        <button type="submit" name="action" value="alias">Add alias</button>
+                </form>
+
+                <datalist id="tag-names">
+                        {{range .Tags}}<option value="{{.Name}}">{{end}}
+                </datalist>
+        </body>
+</html>
+{{end}}
+
+
+{{define "review"}}
+        {{template "header" .}}
+        <body>
+                <a href="/">back to listing</a>
+                <div>
+                        Review photos, the worst first
+                        <form action="/review" method="GET">
+                                <input type="search" name="tag" value="{{.TagQuery}}" placeholder="eg. burst AND NOT favourite">
+                                <input type="submit" value="Search">
+                        </form>
+                </div>
+                <form action="{{.URL}}" method="POST">
+                        {{range .Images}}
+                                <label style="display:inline-block;width:110px;">
+                                        <img src="/rendition/thumb/{{.ImageID}}"
+                                                title="{{.Created}}" style="width:100px;height:100px;background:#000;">
+                                        <div>
+                                                <input type="checkbox" name="image" value="{{.ImageID}}">
+                                                {{with .Quality}}
+                                                        <span title="sharpness {{printf "%.2f" .Sharpness}}, exposure {{printf "%.2f" .Exposure}}">{{printf "%.2f" .Score}}</span>
+                                                {{else}}
+                                                        <span>not scored</span>
+                                                {{end}}
+                                        </div>
+                                </label>
+                        {{else}}
+                                <div>No photos</div>
+                        {{end}}
+                        {{if .Images}}
+                                <div><input type="submit" value="Delete selected"></div>
+                        {{end}}
+                </form>
+        </body>
+</html>
+{{end}}
+
+
 {{define "photo-list"}}
         {{template "header" .}}
         <body>
                 <div>
                         <a href="/upload">Upload photos</a>
+                        <a href="/geotag">Geotag photos</a>
+                        <a href="/duplicates">Duplicate candidates</a>
+                        <a href="/review">Review photos</a>
+                        <a href="/admin/tags">Manage tags</a>
                 </div>
                 <div>
                         Filter photos
                         <form action="/" method="GET">
-                                <input type="search" name="tag" placeholder="Search photos" required>
+                                <input type="search" name="q" value="{{.Query}}" placeholder="eg. sunset kyoto canon">
+                                <input type="search" name="tag" value="{{.TagQuery}}" placeholder="Tags, eg. holiday AND (korea OR japan) AND NOT blurry">
                                 <input type="submit" value="Search">
                         </form>
                 </div>
                 {{range .Images}}
-                        <a href="/photo/{{.ImageID}}">
-                                <img src="/thumbnail/{{.ImageID}}.jpg" title="{{.Created}}" style="width:100px;height:100px;background:#000;">
+                        {{$id := .ImageID}}
+                        <a href="/photo/{{$id}}">
+                                <img src="/rendition/thumb/{{$id}}"
+                                        {{with $.Thumbnails}}srcset="{{range $i, $p := .}}{{if $i}}, {{end}}/rendition/{{$p.Name}}/{{$id}} {{$p.Width}}w{{end}}" sizes="100px"{{end}}
+                                        alt="{{if .AltText}}{{.AltText}}{{else}}{{.Title}}{{end}}"
+                                        title="{{if .Title}}{{.Title}}{{else}}{{.Created}}{{end}}" style="width:100px;height:100px;background:#000;">
                         </a>
+                        <a href="/photo/{{$id}}/text">edit</a>
+                        {{with index $.Snippets $id}}<div>{{.}}</div>{{end}}
                 {{else}}
                         <div>No photos</div>
                 {{end}}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/husio/gallery/gallery/storage"
+	"github.com/husio/gallery/gallery/tus"
+)
+
+// TusUpload return handler for completed resumable uploads, that stores
+// uploaded file using given upload function. Tags are read from "tags" upload
+// metadata, that is a JSON encoded list of names.
+func TusUpload(
+	uploadFile func(r io.Reader, tags []string) (*storage.UploadResult, error),
+) tus.Handler {
+	return func(fd io.ReadSeeker, meta map[string]string) error {
+		var names []string
+		if raw := meta["tags"]; raw != "" {
+			if err := json.Unmarshal([]byte(raw), &names); err != nil {
+				return fmt.Errorf("invalid tags metadata: %s", err)
+			}
+		}
+		var tags []string
+		for _, name := range names {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			tags = append(tags, name)
+		}
+		if _, err := uploadFile(fd, tags); err != nil {
+			log.Printf("cannot upload %q: %s", meta["filename"], err)
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package iiif
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskCache keeps rendered images on disk, in a separate directory for every
+// source image.
+type DiskCache struct {
+	dir string
+}
+
+func NewDiskCache(dir string) *DiskCache {
+	return &DiskCache{dir: dir}
+}
+
+// Open return cached image stored under given key.
+func (c *DiskCache) Open(imageID, key string) (*os.File, error) {
+	return os.Open(filepath.Join(c.dir, imageID, key))
+}
+
+// Put store image under given key. Content is first written into a
+// temporary file, so that partially written images are never served.
+func (c *DiskCache) Put(imageID, key string, write func(io.Writer) error) error {
+	dir := filepath.Join(c.dir, imageID)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("cannot create directory: %s", err)
+	}
+	fd, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("cannot create file: %s", err)
+	}
+	defer os.Remove(fd.Name())
+
+	err = write(fd)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write image: %s", err)
+	}
+	return os.Rename(fd.Name(), filepath.Join(dir, key))
+}
+
+// Remove delete all cached images of given source image.
+func (c *DiskCache) Remove(imageID string) error {
+	// never remove anything outside of the image directory
+	if imageID == "" || imageID == "." || imageID == ".." || strings.ContainsAny(imageID, `/\`) {
+		return fmt.Errorf("invalid image ID %q", imageID)
+	}
+	return os.RemoveAll(filepath.Join(c.dir, imageID))
+}
@@ -0,0 +1,392 @@
+// Package iiif implements the IIIF Image API 3.0, compliance level 2.
+//
+// Image request URI has the form
+//
+//	{id}/{region}/{size}/{rotation}/{quality}.{format}
+//
+// See https://iiif.io/api/image/3.0/
+package iiif
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	Context  = "http://iiif.io/api/image/3/context.json"
+	Protocol = "http://iiif.io/api/image"
+	Profile  = "level2"
+
+	// MediaType is the media type of image information document, when
+	// requested as JSON-LD.
+	MediaType = `application/ld+json;profile="` + Context + `"`
+)
+
+// Error is returned when request cannot be processed. Code is the HTTP
+// status code that should be returned to the client.
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &Error{Code: http.StatusBadRequest, Msg: fmt.Sprintf(format, args...)}
+}
+
+func notImplemented(format string, args ...interface{}) error {
+	return &Error{Code: http.StatusNotImplemented, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Limits restrict size of the output images. Zero value means no limit.
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxArea   int
+}
+
+// Info is the image information document.
+type Info struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	MaxWidth       int      `json:"maxWidth,omitempty"`
+	MaxHeight      int      `json:"maxHeight,omitempty"`
+	MaxArea        int      `json:"maxArea,omitempty"`
+	ExtraQualities []string `json:"extraQualities"`
+	ExtraFeatures  []string `json:"extraFeatures"`
+}
+
+// NewInfo return information document of an image available under given
+// base URI.
+func NewInfo(baseURI string, width, height int, limits Limits) *Info {
+	return &Info{
+		Context:        Context,
+		ID:             baseURI,
+		Type:           "ImageService3",
+		Protocol:       Protocol,
+		Profile:        Profile,
+		Width:          width,
+		Height:         height,
+		MaxWidth:       limits.MaxWidth,
+		MaxHeight:      limits.MaxHeight,
+		MaxArea:        limits.MaxArea,
+		ExtraQualities: []string{"color", "gray"},
+		ExtraFeatures:  []string{"baseUriRedirect", "cors", "jsonldMediaType", "mirroring", "sizeUpscaling"},
+	}
+}
+
+// Request is parsed image request.
+type Request struct {
+	region   string
+	size     string
+	upscale  bool
+	mirror   bool
+	rotation int
+	gray     bool
+	format   string
+}
+
+// ParseRequest parse image request parameters. Quality and format are passed
+// together, as they appear in the URI.
+func ParseRequest(region, size, rotation, qualityFormat string) (*Request, error) {
+	req := Request{region: region}
+
+	req.size = size
+	if strings.HasPrefix(size, "^") {
+		req.upscale = true
+		req.size = size[1:]
+	}
+
+	if strings.HasPrefix(rotation, "!") {
+		req.mirror = true
+		rotation = rotation[1:]
+	}
+	deg, err := strconv.ParseFloat(rotation, 64)
+	if err != nil || deg < 0 || deg > 360 {
+		return nil, badRequest("invalid rotation %q", rotation)
+	}
+	if math.Mod(deg, 90) != 0 {
+		return nil, notImplemented("only rotation by multiple of 90 degrees is supported")
+	}
+	req.rotation = int(deg) % 360
+
+	dot := strings.LastIndex(qualityFormat, ".")
+	if dot == -1 {
+		return nil, badRequest("missing format")
+	}
+	switch quality := qualityFormat[:dot]; quality {
+	case "default", "color":
+		// image is always returned in color
+	case "gray":
+		req.gray = true
+	case "bitonal":
+		return nil, notImplemented("bitonal quality is not supported")
+	default:
+		return nil, badRequest("invalid quality %q", quality)
+	}
+	switch req.format = qualityFormat[dot+1:]; req.format {
+	case "jpg", "png":
+		// supported
+	case "tif", "gif", "jp2", "pdf", "webp":
+		return nil, notImplemented("%s format is not supported", req.format)
+	default:
+		return nil, badRequest("invalid format %q", req.format)
+	}
+	return &req, nil
+}
+
+// Plan return operations required to create requested image from an image
+// of given size.
+func (req *Request) Plan(width, height int, limits Limits) (*Plan, error) {
+	region, err := parseRegion(req.region, width, height)
+	if err != nil {
+		return nil, err
+	}
+	w, h, err := parseSize(req.size, req.upscale, region.Dx(), region.Dy(), limits)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Region:   region,
+		Width:    w,
+		Height:   h,
+		Mirror:   req.mirror,
+		Rotation: req.rotation,
+		Gray:     req.gray,
+		Format:   req.format,
+	}, nil
+}
+
+func parseRegion(s string, width, height int) (image.Rectangle, error) {
+	full := image.Rect(0, 0, width, height)
+	switch s {
+	case "full":
+		return full, nil
+	case "square":
+		side := width
+		if height < side {
+			side = height
+		}
+		x, y := (width-side)/2, (height-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
+	}
+
+	pct := strings.HasPrefix(s, "pct:")
+	if pct {
+		s = s[4:]
+	}
+	chunks := strings.Split(s, ",")
+	if len(chunks) != 4 {
+		return image.Rectangle{}, badRequest("invalid region")
+	}
+	var v [4]float64
+	for i, c := range chunks {
+		n, err := strconv.ParseFloat(c, 64)
+		if err != nil || n < 0 || (!pct && n != math.Trunc(n)) {
+			return image.Rectangle{}, badRequest("invalid region")
+		}
+		v[i] = n
+	}
+	if pct {
+		v[0] = v[0] * float64(width) / 100
+		v[1] = v[1] * float64(height) / 100
+		v[2] = v[2] * float64(width) / 100
+		v[3] = v[3] * float64(height) / 100
+	}
+	x, y := int(math.Round(v[0])), int(math.Round(v[1]))
+	region := image.Rect(x, y, x+int(math.Round(v[2])), y+int(math.Round(v[3]))).Intersect(full)
+	if region.Empty() {
+		return image.Rectangle{}, badRequest("region is outside of the image")
+	}
+	return region, nil
+}
+
+func parseSize(s string, upscale bool, rw, rh int, limits Limits) (int, int, error) {
+	if s == "max" {
+		scale := limits.scale(rw, rh)
+		if scale > 1 && !upscale {
+			scale = 1
+		}
+		w, h := int(float64(rw)*scale), int(float64(rh)*scale)
+		if w < 1 || h < 1 {
+			return 0, 0, badRequest("image too small")
+		}
+		return w, h, nil
+	}
+
+	var w, h int
+	switch {
+	case strings.HasPrefix(s, "pct:"):
+		n, err := strconv.ParseFloat(s[4:], 64)
+		if err != nil || n <= 0 {
+			return 0, 0, badRequest("invalid size")
+		}
+		w = int(math.Round(float64(rw) * n / 100))
+		h = int(math.Round(float64(rh) * n / 100))
+	case strings.HasPrefix(s, "!"):
+		cw, ch, err := parseWH(s[1:])
+		if err != nil || cw == 0 || ch == 0 {
+			return 0, 0, badRequest("invalid size")
+		}
+		scale := math.Min(float64(cw)/float64(rw), float64(ch)/float64(rh))
+		w = int(math.Round(float64(rw) * scale))
+		h = int(math.Round(float64(rh) * scale))
+	default:
+		var err error
+		if w, h, err = parseWH(s); err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case w == 0 && h == 0:
+			return 0, 0, badRequest("invalid size")
+		case w == 0:
+			w = int(math.Round(float64(rw) * float64(h) / float64(rh)))
+		case h == 0:
+			h = int(math.Round(float64(rh) * float64(w) / float64(rw)))
+		}
+	}
+
+	if w < 1 || h < 1 {
+		return 0, 0, badRequest("image too small")
+	}
+	if !upscale && (w > rw || h > rh) {
+		return 0, 0, badRequest("upscaling requires ^ size prefix")
+	}
+	if !limits.allow(w, h) {
+		return 0, 0, badRequest("requested size exceeds the limit")
+	}
+	return w, h, nil
+}
+
+// parseWH parse "w,h", "w," or ",h" size. Missing value is returned as zero.
+func parseWH(s string) (int, int, error) {
+	chunks := strings.Split(s, ",")
+	if len(chunks) != 2 {
+		return 0, 0, badRequest("invalid size")
+	}
+	var v [2]int
+	for i, c := range chunks {
+		if c == "" {
+			continue
+		}
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 {
+			return 0, 0, badRequest("invalid size")
+		}
+		v[i] = n
+	}
+	return v[0], v[1], nil
+}
+
+// scale return the biggest scale factor, that applied to given size does not
+// exceed limits.
+func (l Limits) scale(w, h int) float64 {
+	scale := math.Inf(1)
+	if l.MaxWidth > 0 {
+		scale = math.Min(scale, float64(l.MaxWidth)/float64(w))
+	}
+	if l.MaxHeight > 0 {
+		scale = math.Min(scale, float64(l.MaxHeight)/float64(h))
+	}
+	if l.MaxArea > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(l.MaxArea)/float64(w*h)))
+	}
+	if math.IsInf(scale, 1) {
+		return 1
+	}
+	return scale
+}
+
+func (l Limits) allow(w, h int) bool {
+	return (l.MaxWidth <= 0 || w <= l.MaxWidth) &&
+		(l.MaxHeight <= 0 || h <= l.MaxHeight) &&
+		(l.MaxArea <= 0 || w*h <= l.MaxArea)
+}
+
+// Plan describe operations that create requested image, in the order they
+// are applied.
+type Plan struct {
+	Region   image.Rectangle
+	Width    int
+	Height   int
+	Mirror   bool
+	Rotation int
+	Gray     bool
+	Format   string
+}
+
+// Key return string that is the same for all requests producing the same
+// image. It is safe to use as file name.
+func (p *Plan) Key() string {
+	var mirror, quality string
+	if p.Mirror {
+		mirror = "!"
+	}
+	quality = "default"
+	if p.Gray {
+		quality = "gray"
+	}
+	return fmt.Sprintf("%d,%d,%d,%d_%d,%d_%s%d_%s.%s",
+		p.Region.Min.X, p.Region.Min.Y, p.Region.Dx(), p.Region.Dy(),
+		p.Width, p.Height, mirror, p.Rotation, quality, p.Format)
+}
+
+// ContentType return media type of the created image.
+func (p *Plan) ContentType() string {
+	if p.Format == "png" {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// Apply create requested image.
+func (p *Plan) Apply(src image.Image) image.Image {
+	img := src
+	if p.Region != src.Bounds() {
+		img = imaging.Crop(img, p.Region)
+	}
+	if p.Width != p.Region.Dx() || p.Height != p.Region.Dy() {
+		img = imaging.Resize(img, p.Width, p.Height, imaging.Lanczos)
+	}
+	if p.Mirror {
+		img = imaging.FlipH(img)
+	}
+	// imaging rotates counter-clockwise
+	switch p.Rotation {
+	case 90:
+		img = imaging.Rotate270(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+	if p.Gray {
+		img = imaging.Grayscale(img)
+	}
+	return img
+}
+
+// Encode write image in requested format.
+func (p *Plan) Encode(w io.Writer, img image.Image) error {
+	if p.Format == "png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+}
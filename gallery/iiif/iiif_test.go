@@ -0,0 +1,171 @@
+package iiif
+
+import (
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	limits := Limits{MaxWidth: 2000, MaxHeight: 2000, MaxArea: 2000000}
+
+	cases := map[string]struct {
+		region, size, rotation, quality string
+		width, height                   int
+
+		wantKey  string
+		wantCode int
+	}{
+		"full_max": {
+			region: "full", size: "max", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantKey: "0,0,400,300_400,300_0_default.jpg",
+		},
+		"max_limited": {
+			region: "full", size: "max", rotation: "0", quality: "default.jpg",
+			width: 4000, height: 1000,
+			wantKey: "0,0,4000,1000_2000,500_0_default.jpg",
+		},
+		"max_upscaled": {
+			region: "full", size: "^max", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantKey: "0,0,400,300_1632,1224_0_default.jpg",
+		},
+		"square": {
+			region: "square", size: "100,", rotation: "90", quality: "color.png",
+			width: 400, height: 300,
+			wantKey: "50,0,300,300_100,100_90_default.png",
+		},
+		"pixel_region": {
+			region: "10,20,100,50", size: ",25", rotation: "!180", quality: "gray.jpg",
+			width: 400, height: 300,
+			wantKey: "10,20,100,50_50,25_!180_gray.jpg",
+		},
+		"region_cropped_to_image": {
+			region: "300,200,500,500", size: "max", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantKey: "300,200,100,100_100,100_0_default.jpg",
+		},
+		"percent": {
+			region: "pct:50,50,50,50", size: "pct:50", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantKey: "200,150,200,150_100,75_0_default.jpg",
+		},
+		"best_fit": {
+			region: "full", size: "!100,100", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantKey: "0,0,400,300_100,75_0_default.jpg",
+		},
+		"distorted": {
+			region: "full", size: "50,50", rotation: "360", quality: "default.jpg",
+			width: 400, height: 300,
+			wantKey: "0,0,400,300_50,50_0_default.jpg",
+		},
+		"region_outside": {
+			region: "500,0,10,10", size: "max", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantCode: http.StatusBadRequest,
+		},
+		"upscale_without_prefix": {
+			region: "full", size: "800,", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantCode: http.StatusBadRequest,
+		},
+		"size_over_limit": {
+			region: "full", size: "^3000,", rotation: "0", quality: "default.jpg",
+			width: 400, height: 300,
+			wantCode: http.StatusBadRequest,
+		},
+		"arbitrary_rotation": {
+			region: "full", size: "max", rotation: "45", quality: "default.jpg",
+			width: 400, height: 300,
+			wantCode: http.StatusNotImplemented,
+		},
+		"invalid_rotation": {
+			region: "full", size: "max", rotation: "-90", quality: "default.jpg",
+			width: 400, height: 300,
+			wantCode: http.StatusBadRequest,
+		},
+		"bitonal": {
+			region: "full", size: "max", rotation: "0", quality: "bitonal.jpg",
+			width: 400, height: 300,
+			wantCode: http.StatusNotImplemented,
+		},
+		"invalid_format": {
+			region: "full", size: "max", rotation: "0", quality: "default.xyz",
+			width: 400, height: 300,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for tname, tc := range cases {
+		plan, err := planRequest(tc.region, tc.size, tc.rotation, tc.quality, tc.width, tc.height, limits)
+		if tc.wantCode != 0 {
+			if e, ok := err.(*Error); !ok || e.Code != tc.wantCode {
+				t.Errorf("%s: want %d error, got %v", tname, tc.wantCode, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: cannot plan: %s", tname, err)
+			continue
+		}
+		if key := plan.Key(); key != tc.wantKey {
+			t.Errorf("%s: want %q, got %q", tname, tc.wantKey, key)
+		}
+	}
+}
+
+func planRequest(region, size, rotation, quality string, width, height int, limits Limits) (*Plan, error) {
+	req, err := ParseRequest(region, size, rotation, quality)
+	if err != nil {
+		return nil, err
+	}
+	return req.Plan(width, height, limits)
+}
+
+func TestPlanApply(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	plan, err := planRequest("0,0,200,100", "100,", "90", "gray.png", 400, 300, Limits{})
+	if err != nil {
+		t.Fatalf("cannot plan: %s", err)
+	}
+	// rotated by 90 degrees, so width and height are swapped
+	if b := plan.Apply(src).Bounds(); b.Dx() != 50 || b.Dy() != 100 {
+		t.Errorf("want 50x100 image, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestDiskCacheRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iiif")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewDiskCache(dir)
+	for _, id := range []string{"a", "b"} {
+		if err := c.Put(id, "full.jpg", func(w io.Writer) error { return nil }); err != nil {
+			t.Fatalf("cannot put %s: %s", id, err)
+		}
+	}
+	for _, id := range []string{"", ".", "..", "a/..", `..\a`} {
+		if err := c.Remove(id); err == nil {
+			t.Errorf("want %q image ID rejected", id)
+		}
+	}
+	if err := c.Remove("a"); err != nil {
+		t.Fatalf("cannot remove: %s", err)
+	}
+	if _, err := c.Open("a", "full.jpg"); !os.IsNotExist(err) {
+		t.Errorf("want removed, got %v", err)
+	}
+	if fd, err := c.Open("b", "full.jpg"); err != nil {
+		t.Errorf("want other image kept, got %v", err)
+	} else {
+		fd.Close()
+	}
+}
@@ -0,0 +1,70 @@
+// Package orientation transforms images stored with EXIF orientation tag, so
+// that they are displayed the way the camera was held.
+//
+// See http://www.exif.org/Exif2-2.PDF, page 18.
+package orientation
+
+import (
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+// EXIF orientation tag values. Name describes the transformation that must be
+// applied to the stored image in order to display it correctly.
+const (
+	Normal     = 1
+	FlipH      = 2
+	Rotate180  = 3
+	FlipV      = 4
+	Transpose  = 5
+	Rotate90   = 6
+	Transverse = 7
+	Rotate270  = 8
+)
+
+// Valid return true if given value is a valid EXIF orientation. Zero value,
+// used for images without orientation information, is not valid.
+func Valid(o int) bool {
+	return o >= Normal && o <= Rotate270
+}
+
+// SwapsSize return true if displaying image with given orientation swaps its
+// width and height.
+func SwapsSize(o int) bool {
+	return o >= Transpose && o <= Rotate270
+}
+
+// Size return displayed size of an image stored with given width, height and
+// orientation.
+func Size(width, height, o int) (int, int) {
+	if SwapsSize(o) {
+		return height, width
+	}
+	return width, height
+}
+
+// Apply return image transformed for display according to given orientation.
+// Unknown orientation values are treated as normal orientation.
+func Apply(img image.Image, o int) image.Image {
+	// imaging rotates counter-clockwise, while orientation names are
+	// using clockwise rotation
+	switch o {
+	case FlipH:
+		return imaging.FlipH(img)
+	case Rotate180:
+		return imaging.Rotate180(img)
+	case FlipV:
+		return imaging.FlipV(img)
+	case Transpose:
+		return imaging.Transpose(img)
+	case Rotate90:
+		return imaging.Rotate270(img)
+	case Transverse:
+		return imaging.Transverse(img)
+	case Rotate270:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
@@ -0,0 +1,59 @@
+package orientation
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	const width, height = 3, 2
+
+	// upright image with every pixel different
+	upright := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			upright.Set(x, y, color.NRGBA{uint8(x * 50), uint8(y * 50), 0, 255})
+		}
+	}
+
+	// stored pixel position mapped to displayed position, as described by
+	// EXIF specification
+	cases := map[string]struct {
+		orientation int
+		display     func(sx, sy int) (int, int)
+	}{
+		"unknown":    {0, func(sx, sy int) (int, int) { return sx, sy }},
+		"normal":     {Normal, func(sx, sy int) (int, int) { return sx, sy }},
+		"flip_h":     {FlipH, func(sx, sy int) (int, int) { return width - 1 - sx, sy }},
+		"rotate_180": {Rotate180, func(sx, sy int) (int, int) { return width - 1 - sx, height - 1 - sy }},
+		"flip_v":     {FlipV, func(sx, sy int) (int, int) { return sx, height - 1 - sy }},
+		"transpose":  {Transpose, func(sx, sy int) (int, int) { return sy, sx }},
+		"rotate_90":  {Rotate90, func(sx, sy int) (int, int) { return width - 1 - sy, sx }},
+		"transverse": {Transverse, func(sx, sy int) (int, int) { return width - 1 - sy, height - 1 - sx }},
+		"rotate_270": {Rotate270, func(sx, sy int) (int, int) { return sy, height - 1 - sx }},
+	}
+
+	for tname, tc := range cases {
+		sw, sh := Size(width, height, tc.orientation)
+		stored := image.NewNRGBA(image.Rect(0, 0, sw, sh))
+		for sx := 0; sx < sw; sx++ {
+			for sy := 0; sy < sh; sy++ {
+				stored.Set(sx, sy, upright.At(tc.display(sx, sy)))
+			}
+		}
+
+		got := Apply(stored, tc.orientation)
+		if b := got.Bounds(); b.Dx() != width || b.Dy() != height {
+			t.Errorf("%s: want %dx%d image, got %dx%d", tname, width, height, b.Dx(), b.Dy())
+			continue
+		}
+		for x := 0; x < width; x++ {
+			for y := 0; y < height; y++ {
+				if got.At(x, y) != upright.At(x, y) {
+					t.Errorf("%s: invalid pixel at %d,%d: %v", tname, x, y, got.At(x, y))
+				}
+			}
+		}
+	}
+}
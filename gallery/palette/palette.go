@@ -0,0 +1,215 @@
+// Package palette extracts dominant colors of an image and compares colors
+// the way they are perceived, using CIELAB color space.
+//
+// See https://en.wikipedia.org/wiki/Median_cut
+package palette
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Color is a palette color together with its share in the image.
+type Color struct {
+	R, G, B uint8
+	// Weight is the fraction of image pixels represented by the color.
+	Weight float64
+}
+
+// Hex return color in #rrggbb notation.
+func (c Color) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// ParseHex return color described in #rrggbb or #rgb notation. Leading hash
+// is optional.
+func ParseHex(s string) (Color, error) {
+	raw := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(raw) == 3 {
+		raw = string([]byte{raw[0], raw[0], raw[1], raw[1], raw[2], raw[2]})
+	}
+	if len(raw) != 6 {
+		return Color{}, fmt.Errorf("invalid color %q", s)
+	}
+	v, err := strconv.ParseUint(raw, 16, 32)
+	if err != nil {
+		return Color{}, fmt.Errorf("invalid color %q", s)
+	}
+	return Color{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v)}, nil
+}
+
+// Lab return color in CIELAB color space, using D65 white point.
+func (c Color) Lab() (l, a, b float64) {
+	r, g, bl := linear(c.R), linear(c.G), linear(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*bl) / 0.95047
+	y := (0.2126*r + 0.7152*g + 0.0722*bl) / 1.00000
+	z := (0.0193*r + 0.1192*g + 0.9505*bl) / 1.08883
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// linear return linear intensity of sRGB encoded channel value.
+func linear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// Distance return CIE76 color difference. Difference of about 2.3 is just
+// noticeable, colors more than 50 apart are considered different.
+func Distance(c1, c2 Color) float64 {
+	l1, a1, b1 := c1.Lab()
+	l2, a2, b2 := c2.Lab()
+	return math.Sqrt((l1-l2)*(l1-l2) + (a1-a2)*(a1-a2) + (b1-b2)*(b1-b2))
+}
+
+// AnalysisSize is the longer side length of the image copy that colors are
+// extracted from.
+const AnalysisSize = 100
+
+// Extract return at most n dominant colors of given image, ordered from the
+// most common. Colors are found with median cut algorithm.
+func Extract(img image.Image, n int) []Color {
+	b := img.Bounds()
+	if b.Empty() || n <= 0 {
+		return nil
+	}
+	if b.Dx() > AnalysisSize || b.Dy() > AnalysisSize {
+		img = imaging.Fit(img, AnalysisSize, AnalysisSize, imaging.Box)
+		b = img.Bounds()
+	}
+
+	pixels := make([][3]uint8, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			// RGBA returns alpha premultiplied values
+			r, g, bl = r*0xffff/a, g*0xffff/a, bl*0xffff/a
+			pixels = append(pixels, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8)})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	boxes := []colorBox{newColorBox(pixels)}
+	for len(boxes) < n {
+		// split the box with the widest channel range, weighted by the
+		// number of pixels, so that big uniform areas are not split
+		best, bestScore := -1, 0
+		for i, box := range boxes {
+			if score := box.spread() * len(box.pixels); box.spread() > 0 && score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best == -1 {
+			break
+		}
+		a, b := boxes[best].split()
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	colors := make([]Color, 0, len(boxes))
+	for _, box := range boxes {
+		c := box.mean()
+		c.Weight = float64(len(box.pixels)) / float64(len(pixels))
+		colors = append(colors, c)
+	}
+	sort.SliceStable(colors, func(i, j int) bool {
+		return colors[i].Weight > colors[j].Weight
+	})
+	return colors
+}
+
+type colorBox struct {
+	pixels [][3]uint8
+	// channel is the index of the color channel with the widest range
+	channel int
+	rng     int
+}
+
+func newColorBox(pixels [][3]uint8) colorBox {
+	box := colorBox{pixels: pixels}
+	for ch := 0; ch < 3; ch++ {
+		lo, hi := 255, 0
+		for _, p := range pixels {
+			v := int(p[ch])
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > box.rng {
+			box.channel, box.rng = ch, hi-lo
+		}
+	}
+	return box
+}
+
+func (box colorBox) spread() int {
+	if len(box.pixels) < 2 {
+		return 0
+	}
+	return box.rng
+}
+
+// split divide the box at the median of its widest channel.
+func (box colorBox) split() (colorBox, colorBox) {
+	ch := box.channel
+	sort.Slice(box.pixels, func(i, j int) bool {
+		return box.pixels[i][ch] < box.pixels[j][ch]
+	})
+	// pixels of the same value are kept together, so the box is divided
+	// at the start or the end of the run containing the median, whichever
+	// is closer to the middle
+	half := len(box.pixels) / 2
+	lo, hi := half, half
+	for lo > 0 && box.pixels[lo-1][ch] == box.pixels[half][ch] {
+		lo--
+	}
+	for hi < len(box.pixels) && box.pixels[hi][ch] == box.pixels[half][ch] {
+		hi++
+	}
+	at := lo
+	if lo == 0 || (hi < len(box.pixels) && hi-half < half-lo) {
+		at = hi
+	}
+	return newColorBox(box.pixels[:at]), newColorBox(box.pixels[at:])
+}
+
+func (box colorBox) mean() Color {
+	var sum [3]int
+	for _, p := range box.pixels {
+		for ch := range sum {
+			sum[ch] += int(p[ch])
+		}
+	}
+	n := len(box.pixels)
+	return Color{
+		R: uint8((sum[0] + n/2) / n),
+		G: uint8((sum[1] + n/2) / n),
+		B: uint8((sum[2] + n/2) / n),
+	}
+}
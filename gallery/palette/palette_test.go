@@ -0,0 +1,104 @@
+package palette
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func TestParseHex(t *testing.T) {
+	cases := map[string]struct {
+		raw     string
+		want    Color
+		wantErr bool
+	}{
+		"full":          {raw: "#aabbcc", want: Color{R: 0xaa, G: 0xbb, B: 0xcc}},
+		"upper case":    {raw: "#AABBCC", want: Color{R: 0xaa, G: 0xbb, B: 0xcc}},
+		"short":         {raw: "#abc", want: Color{R: 0xaa, G: 0xbb, B: 0xcc}},
+		"without hash":  {raw: "102030", want: Color{R: 0x10, G: 0x20, B: 0x30}},
+		"invalid digit": {raw: "#aabbcg", wantErr: true},
+		"too long":      {raw: "#aabbccdd", wantErr: true},
+		"empty":         {raw: "", wantErr: true},
+	}
+
+	for tname, tc := range cases {
+		got, err := ParseHex(tc.raw)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", tname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tname, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+		}
+		if got.Hex() != "#"+hexLower(tc.want) {
+			t.Errorf("%s: unexpected hex %s", tname, got.Hex())
+		}
+	}
+}
+
+func hexLower(c Color) string {
+	const digits = "0123456789abcdef"
+	var b []byte
+	for _, v := range []uint8{c.R, c.G, c.B} {
+		b = append(b, digits[v>>4], digits[v&0xf])
+	}
+	return string(b)
+}
+
+func TestLab(t *testing.T) {
+	cases := map[string]struct {
+		color   Color
+		l, a, b float64
+	}{
+		"black": {color: Color{0, 0, 0, 0}, l: 0, a: 0, b: 0},
+		"white": {color: Color{255, 255, 255, 0}, l: 100, a: 0, b: 0},
+		"red":   {color: Color{255, 0, 0, 0}, l: 53.24, a: 80.09, b: 67.20},
+		"blue":  {color: Color{0, 0, 255, 0}, l: 32.30, a: 79.19, b: -107.86},
+	}
+
+	for tname, tc := range cases {
+		l, a, b := tc.color.Lab()
+		if math.Abs(l-tc.l) > 0.1 || math.Abs(a-tc.a) > 0.1 || math.Abs(b-tc.b) > 0.1 {
+			t.Errorf("%s: want %.2f %.2f %.2f, got %.2f %.2f %.2f", tname, tc.l, tc.a, tc.b, l, a, b)
+		}
+	}
+
+	if d := Distance(Color{R: 200, G: 10, B: 10}, Color{R: 205, G: 12, B: 8}); d > 5 {
+		t.Errorf("similar reds are %f apart", d)
+	}
+	if d := Distance(Color{R: 200, G: 10, B: 10}, Color{R: 10, G: 10, B: 200}); d < 50 {
+		t.Errorf("red and blue are only %f apart", d)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	// three quarters red, one quarter blue
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	red := color.RGBA{220, 20, 20, 255}
+	blue := color.RGBA{20, 20, 220, 255}
+	draw.Draw(img, img.Bounds(), &image.Uniform{red}, image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(300, 0, 400, 200), &image.Uniform{blue}, image.ZP, draw.Src)
+
+	colors := Extract(img, 5)
+	if len(colors) != 2 {
+		t.Fatalf("want 2 colors, got %v", colors)
+	}
+	if c := colors[0]; c.R != red.R || c.G != red.G || c.B != red.B || math.Abs(c.Weight-0.75) > 0.02 {
+		t.Errorf("want red with 0.75 weight first, got %+v", c)
+	}
+	if c := colors[1]; c.R != blue.R || c.G != blue.G || c.B != blue.B || math.Abs(c.Weight-0.25) > 0.02 {
+		t.Errorf("want blue with 0.25 weight second, got %+v", c)
+	}
+
+	if colors := Extract(image.NewRGBA(image.Rect(0, 0, 10, 10)), 5); len(colors) != 0 {
+		t.Errorf("want no colors of transparent image, got %v", colors)
+	}
+}
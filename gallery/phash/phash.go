@@ -0,0 +1,106 @@
+// Package phash implements perceptual image hashing, that produces similar
+// hashes for visually similar images, for example the same photo saved with
+// different quality or size.
+//
+// See http://www.hackerfactor.com/blog/index.php?/archives/529-Kind-of-Like-That.html
+package phash
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+
+	"github.com/disintegration/imaging"
+)
+
+// DHash return difference hash of given image. Every bit tells if the
+// brightness of a pixel is greater than of its right neighbour, in 9x8
+// grayscale copy of the image.
+func DHash(img image.Image) uint64 {
+	small := imaging.Resize(img, 9, 8, imaging.Box)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luminance(small.At(x, y)) > luminance(small.At(x+1, y)) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func luminance(c color.Color) uint8 {
+	return color.GrayModel.Convert(c).(color.Gray).Y
+}
+
+// Distance return the number of bits that differ in given hashes. The lower
+// the distance, the more similar the images are.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Group return groups of similar hashes. Hashes belong to the same group if
+// they are connected by a chain of hashes, each at most maxDistance from the
+// previous one. Groups are given as indexes of the hashes slice. Hashes
+// without any similar hash are not returned.
+func Group(hashes []uint64, maxDistance int) [][]int {
+	if maxDistance < 0 {
+		return nil
+	}
+
+	// if two hashes differ on at most maxDistance bits, then after
+	// splitting them into maxDistance+1 chunks, at least one chunk is
+	// identical, so only hashes sharing a chunk must be compared
+	chunks := maxDistance + 1
+	if chunks > 64 {
+		chunks = 64
+	}
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for c := 0; c < chunks; c++ {
+		from, to := 64*c/chunks, 64*(c+1)/chunks
+		mask := (uint64(1)<<uint(to-from) - 1) << uint(from)
+		buckets := make(map[uint64][]int)
+		for i, h := range hashes {
+			buckets[h&mask] = append(buckets[h&mask], i)
+		}
+		for _, bucket := range buckets {
+			for i, a := range bucket {
+				for _, b := range bucket[i+1:] {
+					ra, rb := find(a), find(b)
+					if ra != rb && Distance(hashes[a], hashes[b]) <= maxDistance {
+						parent[ra] = rb
+					}
+				}
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	var roots []int
+	for i := range hashes {
+		r := find(i)
+		if _, ok := members[r]; !ok {
+			roots = append(roots, r)
+		}
+		members[r] = append(members[r], i)
+	}
+	var groups [][]int
+	for _, r := range roots {
+		if len(members[r]) > 1 {
+			groups = append(groups, members[r])
+		}
+	}
+	return groups
+}
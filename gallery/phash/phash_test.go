@@ -0,0 +1,134 @@
+package phash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestDHash(t *testing.T) {
+	gradient := func(w, h int, flip bool) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for x := 0; x < w; x++ {
+			for y := 0; y < h; y++ {
+				v := uint8((x*x + 3*y*x) * 255 / (w*w + 3*h*w))
+				if flip {
+					v = 255 - v
+				}
+				img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+			}
+		}
+		return img
+	}
+	reencode := func(img image.Image, quality int) image.Image {
+		var b bytes.Buffer
+		if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatalf("cannot encode: %s", err)
+		}
+		out, err := jpeg.Decode(&b)
+		if err != nil {
+			t.Fatalf("cannot decode: %s", err)
+		}
+		return out
+	}
+
+	orig := gradient(640, 480, false)
+	cases := map[string]struct {
+		img     image.Image
+		similar bool
+	}{
+		"low quality":       {img: reencode(orig, 20), similar: true},
+		"resized":           {img: imaging.Resize(orig, 160, 120, imaging.Linear), similar: true},
+		"slightly brighter": {img: imaging.AdjustBrightness(orig, 5), similar: true},
+		"inverted":          {img: gradient(640, 480, true), similar: false},
+		"mirrored":          {img: imaging.FlipH(orig), similar: false},
+	}
+
+	hash := DHash(orig)
+	for tname, tc := range cases {
+		d := Distance(hash, DHash(tc.img))
+		if similar := d <= 4; similar != tc.similar {
+			t.Errorf("%s: want similar %v, got distance %d", tname, tc.similar, d)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	if d := Distance(0, 0); d != 0 {
+		t.Errorf("want 0, got %d", d)
+	}
+	if d := Distance(0xF0, 0x0F); d != 8 {
+		t.Errorf("want 8, got %d", d)
+	}
+	if d := Distance(0, ^uint64(0)); d != 64 {
+		t.Errorf("want 64, got %d", d)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var hashes []uint64
+	for i := 0; i < 300; i++ {
+		h := rnd.Uint64()
+		hashes = append(hashes, h)
+		// some hashes have near copies
+		for j := 0; j < rnd.Intn(3); j++ {
+			hashes = append(hashes, h^(1<<uint(rnd.Intn(64)))^(1<<uint(rnd.Intn(64))))
+		}
+	}
+
+	for _, maxDistance := range []int{0, 2, 4, 12} {
+		got := normalize(Group(hashes, maxDistance))
+		want := normalize(bruteForceGroup(hashes, maxDistance))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("distance %d: want %d groups, got %d", maxDistance, len(want), len(got))
+		}
+	}
+}
+
+// bruteForceGroup compare every pair of hashes.
+func bruteForceGroup(hashes []uint64, maxDistance int) [][]int {
+	group := make([]int, len(hashes))
+	for i := range group {
+		group[i] = i
+	}
+	for i := range hashes {
+		for j := range hashes {
+			if Distance(hashes[i], hashes[j]) > maxDistance || group[i] == group[j] {
+				continue
+			}
+			old := group[j]
+			for k := range group {
+				if group[k] == old {
+					group[k] = group[i]
+				}
+			}
+		}
+	}
+	byGroup := make(map[int][]int)
+	for i, g := range group {
+		byGroup[g] = append(byGroup[g], i)
+	}
+	var groups [][]int
+	for _, g := range byGroup {
+		if len(g) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func normalize(groups [][]int) [][]int {
+	for _, g := range groups {
+		sort.Ints(g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
@@ -0,0 +1,117 @@
+// Package quality measures technical quality of a photo, so that blurred or
+// badly exposed shots can be found without looking at every one of them.
+package quality
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// AnalysisSize is the longer side length of the image copy that is measured.
+// Images are scaled down to the same size, so that scores of images of
+// different resolution are comparable.
+const AnalysisSize = 512
+
+// sharpnessMidpoint is the Laplacian variance that is given sharpness score
+// of 0.5. Sharp photos usually have variance of several hundreds.
+const sharpnessMidpoint = 100
+
+// Luminance below shadowLevel or above highlightLevel is considered clipped.
+const (
+	shadowLevel    = 8
+	highlightLevel = 247
+)
+
+// Scores describe technical quality of an image. All values are within 0..1
+// range.
+type Scores struct {
+	// Sharpness is close to 0 for blurred images and close to 1 for sharp
+	// ones.
+	Sharpness float64
+	// Exposure is close to 1 for well exposed images. Too dark, too bright
+	// and images with a lot of clipped pixels score low.
+	Exposure float64
+	// Brightness is the mean luminance.
+	Brightness float64
+	// Shadows and Highlights are fractions of pixels that are completely
+	// black or white.
+	Shadows    float64
+	Highlights float64
+}
+
+// Quality return overall quality score. Photo is as good as its worst
+// aspect, so the lowest score is returned.
+func (s Scores) Quality() float64 {
+	return math.Min(s.Sharpness, s.Exposure)
+}
+
+// Measure return quality scores of given image.
+func Measure(img image.Image) Scores {
+	b := img.Bounds()
+	if b.Dx() > AnalysisSize || b.Dy() > AnalysisSize {
+		img = imaging.Fit(img, AnalysisSize, AnalysisSize, imaging.Box)
+		b = img.Bounds()
+	}
+	if b.Empty() {
+		return Scores{}
+	}
+
+	lum := make([][]float64, b.Dy())
+	var histogram [256]int
+	for y := range lum {
+		lum[y] = make([]float64, b.Dx())
+		for x := range lum[y] {
+			v := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			lum[y][x] = float64(v)
+			histogram[v]++
+		}
+	}
+
+	var s Scores
+	variance := laplacianVariance(lum)
+	s.Sharpness = variance / (variance + sharpnessMidpoint)
+
+	total := float64(b.Dx() * b.Dy())
+	var sum float64
+	for v, n := range histogram {
+		sum += float64(v * n)
+		switch {
+		case v < shadowLevel:
+			s.Shadows += float64(n)
+		case v > highlightLevel:
+			s.Highlights += float64(n)
+		}
+	}
+	s.Brightness = sum / total / 255
+	s.Shadows /= total
+	s.Highlights /= total
+
+	// mid-gray is ideal, slightly darker or brighter images are still fine
+	offset := 2 * (s.Brightness - 0.5)
+	s.Exposure = (1 - offset*offset) * math.Max(0, 1-s.Shadows-s.Highlights)
+	return s
+}
+
+// laplacianVariance return the variance of luminance Laplacian. Edges of
+// sharp images give high Laplacian values, while blur smooths them out.
+//
+// See https://www.pyimagesearch.com/2015/09/07/blur-detection-with-opencv/
+func laplacianVariance(lum [][]float64) float64 {
+	var sum, sumSq, n float64
+	for y := 1; y < len(lum)-1; y++ {
+		for x := 1; x < len(lum[y])-1; x++ {
+			v := lum[y-1][x] + lum[y+1][x] + lum[y][x-1] + lum[y][x+1] - 4*lum[y][x]
+			sum += v
+			sumSq += v * v
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
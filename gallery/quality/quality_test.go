@@ -0,0 +1,96 @@
+package quality
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// checkerboard return image of black and white squares of given size.
+func checkerboard(width, height, square int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if (x/square+y/square)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 40})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 215})
+			}
+		}
+	}
+	return img
+}
+
+func uniform(c uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, 200, 200))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{Y: c}}, image.ZP, draw.Src)
+	return img
+}
+
+func TestMeasureSharpness(t *testing.T) {
+	sharp := checkerboard(400, 300, 10)
+	blurred := imaging.Blur(sharp, 6)
+
+	s, b := Measure(sharp), Measure(blurred)
+	if s.Sharpness < 0.9 {
+		t.Errorf("want sharp image to score high, got %f", s.Sharpness)
+	}
+	if b.Sharpness > 0.2 {
+		t.Errorf("want blurred image to score low, got %f", b.Sharpness)
+	}
+	if Measure(uniform(128)).Sharpness != 0 {
+		t.Errorf("want uniform image to have no sharpness")
+	}
+}
+
+func TestMeasureExposure(t *testing.T) {
+	cases := map[string]struct {
+		img            image.Image
+		minExposure    float64
+		maxExposure    float64
+		wantShadows    float64
+		wantHighlights float64
+	}{
+		"mid gray": {
+			img:         uniform(128),
+			minExposure: 0.99,
+			maxExposure: 1,
+		},
+		"slightly dark": {
+			img:         uniform(90),
+			minExposure: 0.7,
+			maxExposure: 0.95,
+		},
+		"black": {
+			img:         uniform(0),
+			maxExposure: 0,
+			wantShadows: 1,
+		},
+		"white": {
+			img:            uniform(255),
+			maxExposure:    0,
+			wantHighlights: 1,
+		},
+		"high contrast": {
+			img:         checkerboard(200, 200, 20),
+			minExposure: 0.9,
+			maxExposure: 1,
+		},
+	}
+
+	for tname, tc := range cases {
+		s := Measure(tc.img)
+		if s.Exposure < tc.minExposure || s.Exposure > tc.maxExposure {
+			t.Errorf("%s: want exposure within %.2f..%.2f, got %f", tname, tc.minExposure, tc.maxExposure, s.Exposure)
+		}
+		if s.Shadows != tc.wantShadows || s.Highlights != tc.wantHighlights {
+			t.Errorf("%s: want %f shadows and %f highlights, got %f and %f", tname, tc.wantShadows, tc.wantHighlights, s.Shadows, s.Highlights)
+		}
+		if q := s.Quality(); q > s.Exposure || q > s.Sharpness {
+			t.Errorf("%s: quality %f higher than one of the scores", tname, q)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/husio/gallery/gallery/palette"
+	"github.com/husio/gallery/sq"
+)
+
+// PaletteSize is the number of dominant colors extracted from every image.
+const PaletteSize = 5
+
+// colorMinWeight is the smallest fraction of an image a palette color must
+// cover to be matched by color search, so that tiny spots of color do not
+// make the image match.
+const colorMinWeight = 0.1
+
+// PaletteColor is one of the dominant colors of an image.
+type PaletteColor struct {
+	ImageID string `db:"image_id" json:"-"`
+	// Color is given in #rrggbb notation.
+	Color string `db:"color"    json:"color"`
+	// Weight is the fraction of the image covered by the color.
+	Weight float64 `db:"weight"   json:"weight"`
+}
+
+// ImagePalette return dominant colors of given image content, ordered from
+// the most common.
+func ImagePalette(fs *FileStore, img *Image) ([]palette.Color, error) {
+	src, err := analysisImage(fs, img, palette.AnalysisSize)
+	if err != nil {
+		return nil, err
+	}
+	return palette.Extract(src, PaletteSize), nil
+}
+
+// PutImagePalette store dominant colors of an image, replacing previous
+// palette if any exists. Colors must be ordered from the most common.
+func PutImagePalette(e sq.Execer, imageID string, colors []palette.Color) error {
+	if _, err := e.Exec(`
+		DELETE FROM image_colors
+		WHERE image_id = ?
+	`, imageID); err != nil {
+		return sq.CastErr(err)
+	}
+	for i, c := range colors {
+		l, a, b := c.Lab()
+		if _, err := e.Exec(`
+			INSERT INTO image_colors (image_id, position, color, weight, lab_l, lab_a, lab_b)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, imageID, i, c.Hex(), c.Weight, l, a, b); err != nil {
+			return sq.CastErr(err)
+		}
+	}
+	return nil
+}
+
+// ImagesWithoutPalette return images that dominant colors were not extracted
+// from.
+func ImagesWithoutPalette(s sq.Selector, limit int64) ([]*Image, error) {
+	var imgs []*Image
+	err := s.Select(&imgs, `
+		SELECT i.* FROM images i
+		WHERE NOT EXISTS (
+			SELECT 1 FROM image_colors c
+			WHERE c.image_id = i.image_id
+		)
+		ORDER BY i.created DESC
+		LIMIT ?
+	`, limit)
+	return imgs, sq.CastErr(err)
+}
+
+// newPalette return palette of an image, as it is stored in the database.
+func newPalette(imageID string, colors []palette.Color) []*PaletteColor {
+	p := make([]*PaletteColor, len(colors))
+	for i, c := range colors {
+		p[i] = &PaletteColor{ImageID: imageID, Color: c.Hex(), Weight: c.Weight}
+	}
+	return p
+}
+
+// loadPalettes set palette of all given images.
+func loadPalettes(s sq.Selector, imgs []*Image) error {
+	byID := make(map[string]*Image, len(imgs))
+	ids := make([]string, len(imgs))
+	for i, img := range imgs {
+		byID[img.ImageID] = img
+		ids[i] = img.ImageID
+	}
+	return inBatches(ids, func(placeholders string, args []interface{}) error {
+		var colors []*PaletteColor
+		query := fmt.Sprintf(`
+			SELECT image_id, color, weight FROM image_colors
+			WHERE image_id IN (%s)
+			ORDER BY image_id, position
+		`, placeholders)
+		if err := s.Select(&colors, query, args...); err != nil {
+			return sq.CastErr(err)
+		}
+		for _, c := range colors {
+			img := byID[c.ImageID]
+			img.Palette = append(img.Palette, c)
+		}
+		return nil
+	})
+}
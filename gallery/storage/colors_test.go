@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/gallery/palette"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestImagesColorFilter(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	palettes := map[string][]palette.Color{
+		"red":  {{R: 200, G: 20, B: 20, Weight: 0.8}, {R: 250, G: 250, B: 250, Weight: 0.2}},
+		"blue": {{R: 20, G: 20, B: 200, Weight: 0.95}, {R: 200, G: 20, B: 20, Weight: 0.05}},
+		"none": nil,
+	}
+	for id, colors := range palettes {
+		if _, err := CreateImage(db, Image{ImageID: id, Width: 1, Height: 1, Created: time.Now()}); err != nil {
+			t.Fatalf("cannot create %s image: %s", id, err)
+		}
+		if err := PutImagePalette(db, id, colors); err != nil {
+			t.Fatalf("cannot store %s palette: %s", id, err)
+		}
+	}
+
+	cases := map[string]struct {
+		color    palette.Color
+		distance float64
+		want     []string
+	}{
+		"exact":             {color: palette.Color{R: 200, G: 20, B: 20}, want: []string{"red"}},
+		"similar shade":     {color: palette.Color{R: 220, G: 30, B: 25}, want: []string{"red"}},
+		"common color":      {color: palette.Color{R: 20, G: 20, B: 200}, want: []string{"blue"}},
+		"minor color":       {color: palette.Color{R: 255, G: 255, B: 255}, want: []string{"red"}},
+		"no match":          {color: palette.Color{R: 20, G: 200, B: 20}, want: nil},
+		"wide distance":     {color: palette.Color{R: 20, G: 200, B: 20}, distance: 1000, want: []string{"blue", "red"}},
+		"tiny spot ignored": {color: palette.Color{R: 200, G: 20, B: 20}, distance: 1, want: []string{"red"}},
+	}
+	for tname, tc := range cases {
+		c := tc.color
+		imgs, err := Images(db, ImagesOpts{Limit: 10, Color: &c, ColorDistance: tc.distance})
+		if err != nil {
+			t.Errorf("%s: cannot list images: %s", tname, err)
+			continue
+		}
+		got := make(map[string]bool)
+		for _, img := range imgs {
+			got[img.ImageID] = true
+			if len(img.Palette) != len(palettes[img.ImageID]) {
+				t.Errorf("%s: want %s palette loaded, got %v", tname, img.ImageID, img.Palette)
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+			continue
+		}
+		for _, id := range tc.want {
+			if !got[id] {
+				t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+			}
+		}
+	}
+
+	imgs, err := ImagesWithoutPalette(db, -1)
+	if err != nil {
+		t.Fatalf("cannot list images without palette: %s", err)
+	}
+	if len(imgs) != 1 || imgs[0].ImageID != "none" {
+		t.Errorf("want only none image without palette, got %v", imgs)
+	}
+}
+
+// newTestDB return in memory database with the application schema.
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	schema, err := ioutil.ReadFile("../../schema.sql")
+	if err != nil {
+		t.Fatalf("cannot read schema: %s", err)
+	}
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %s", err)
+	}
+	// every connection would get a separate in memory database
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(string(schema)); err != nil {
+		db.Close()
+		t.Fatalf("cannot create schema: %s", err)
+	}
+	return db
+}
@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/husio/gallery/gallery/orientation"
+	"github.com/husio/gallery/sq"
+)
+
+var (
+	// ErrInvalidOrientation is returned when setting orientation value
+	// that is not defined by EXIF.
+	ErrInvalidOrientation = errors.New("invalid orientation")
+
+	// ErrInvalidFocus is returned when setting focal point outside of the
+	// image.
+	ErrInvalidFocus = errors.New("invalid focal point")
+
+	// ErrTextTooLong is returned when setting title, caption or alternative
+	// text longer than allowed.
+	ErrTextTooLong = errors.New("text too long")
+)
+
+// Maximum length, in bytes, of image texts.
+const (
+	MaxTitleSize   = 200
+	MaxCaptionSize = 10000
+	MaxAltTextSize = 1000
+)
+
+// Editor change information of already stored images, keeping the database
+// and metadata files in sync.
+type Editor struct {
+	db          sq.Database
+	fs          *FileStore
+	derivatives DerivativeCache
+}
+
+// DerivativeCache keep images rendered from the original image, other than
+// renditions.
+type DerivativeCache interface {
+	// Remove delete all cached images of given image.
+	Remove(imageID string) error
+}
+
+// NewEditor return editor of images kept in given storages. Derivatives
+// cache is cleared when the image is deleted or its orientation changes. It
+// can be nil if not used.
+func NewEditor(db sq.Database, fs *FileStore, derivatives DerivativeCache) *Editor {
+	return &Editor{
+		db:          db,
+		fs:          fs,
+		derivatives: derivatives,
+	}
+}
+
+// SetOrientation override orientation of an image, for example when the
+// camera did not recognize it correctly.
+func (e *Editor) SetOrientation(imageID string, o int) (*Image, error) {
+	if !orientation.Valid(o) {
+		return nil, ErrInvalidOrientation
+	}
+	img, err := ImageByID(e.db, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := e.db.Exec(`
+		UPDATE images SET orientation = ?
+		WHERE image_id = ?
+	`, o, imageID); err != nil {
+		return nil, fmt.Errorf("database error: %s", sq.CastErr(err))
+	}
+	img.Orientation = o
+
+	if err := e.updateMeta(img, func(meta *Image) { meta.Orientation = o }); err != nil {
+		return nil, fmt.Errorf("cannot update metadata file: %s", err)
+	}
+	if err := e.fs.RemoveRenditions(img); err != nil {
+		return nil, fmt.Errorf("cannot remove renditions: %s", err)
+	}
+	if e.derivatives != nil {
+		if err := e.derivatives.Remove(imageID); err != nil {
+			return nil, fmt.Errorf("cannot remove derivatives: %s", err)
+		}
+	}
+	return img, nil
+}
+
+// SetFocus set focal point of an image, given as fractions of the displayed
+// image width and height. Fill renditions are cropped around the focal point.
+// Nil position removes the focal point.
+func (e *Editor) SetFocus(imageID string, x, y *float64) (*Image, error) {
+	if (x == nil) != (y == nil) {
+		return nil, ErrInvalidFocus
+	}
+	if x != nil && !(*x >= 0 && *x <= 1 && *y >= 0 && *y <= 1) {
+		return nil, ErrInvalidFocus
+	}
+	img, err := ImageByID(e.db, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := e.db.Exec(`
+		UPDATE images SET focus_x = ?, focus_y = ?
+		WHERE image_id = ?
+	`, x, y, imageID); err != nil {
+		return nil, fmt.Errorf("database error: %s", sq.CastErr(err))
+	}
+	img.FocusX, img.FocusY = x, y
+
+	if err := e.updateMeta(img, func(meta *Image) { meta.FocusX, meta.FocusY = x, y }); err != nil {
+		return nil, fmt.Errorf("cannot update metadata file: %s", err)
+	}
+	if err := e.fs.RemoveRenditions(img); err != nil {
+		return nil, fmt.Errorf("cannot remove renditions: %s", err)
+	}
+	return img, nil
+}
+
+// ImageText is a change of human readable texts describing an image. Nil
+// fields are not changed, empty string removes the text.
+type ImageText struct {
+	Title   *string `json:"title"`
+	Caption *string `json:"caption"`
+	AltText *string `json:"altText"`
+}
+
+// SetText update title, caption and alternative text of an image. Texts are
+// trimmed of surrounding white space.
+func (e *Editor) SetText(imageID string, text ImageText) (*Image, error) {
+	var err error
+	if text.Title, err = cleanText(text.Title, MaxTitleSize); err != nil {
+		return nil, err
+	}
+	if text.Caption, err = cleanText(text.Caption, MaxCaptionSize); err != nil {
+		return nil, err
+	}
+	if text.AltText, err = cleanText(text.AltText, MaxAltTextSize); err != nil {
+		return nil, err
+	}
+	img, err := ImageByID(e.db, imageID)
+	if err != nil {
+		return nil, err
+	}
+
+	apply := func(img *Image) {
+		if text.Title != nil {
+			img.Title = *text.Title
+		}
+		if text.Caption != nil {
+			img.Caption = *text.Caption
+		}
+		if text.AltText != nil {
+			img.AltText = *text.AltText
+		}
+	}
+	apply(img)
+
+	if _, err := e.db.Exec(`
+		UPDATE images SET title = ?, caption = ?, alt_text = ?
+		WHERE image_id = ?
+	`, img.Title, img.Caption, img.AltText, imageID); err != nil {
+		return nil, fmt.Errorf("database error: %s", sq.CastErr(err))
+	}
+
+	if err := e.updateMeta(img, apply); err != nil {
+		return nil, fmt.Errorf("cannot update metadata file: %s", err)
+	}
+	return img, nil
+}
+
+// cleanText return text trimmed of surrounding white space, or nil if text is
+// nil.
+func cleanText(text *string, max int) (*string, error) {
+	if text == nil {
+		return nil, nil
+	}
+	s := strings.TrimSpace(*text)
+	if len(s) > max {
+		return nil, ErrTextTooLong
+	}
+	return &s, nil
+}
+
+// Delete remove an image together with all its information, files,
+// renditions and derivatives.
+func (e *Editor) Delete(imageID string) error {
+	img, err := ImageByID(e.db, imageID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := e.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("database error: cannot start transaction: %s", err)
+	}
+	// images table is referenced by all others, so it goes last
+	for _, table := range []string{"tags", "image_exif", "image_hashes", "image_colors", "image_quality", "images"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE image_id = ?`, imageID); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("database error: cannot delete from %s: %s", table, sq.CastErr(err))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("database error: cannot commit: %s", err)
+	}
+
+	// image is already gone from the catalogue, leftover files are not
+	// visible anymore
+	if err := e.fs.RemoveRenditions(img); err != nil {
+		log.Printf("cannot remove %q image renditions: %s", imageID, err)
+	}
+	if e.derivatives != nil {
+		if err := e.derivatives.Remove(imageID); err != nil {
+			log.Printf("cannot remove %q image derivatives: %s", imageID, err)
+		}
+	}
+	if err := e.fs.Remove(img); err != nil {
+		log.Printf("cannot remove %q image file: %s", imageID, err)
+	}
+	return nil
+}
+
+// updateMeta apply change to the metadata file of given image. If metadata
+// file cannot be read, it is created from the image information.
+func (e *Editor) updateMeta(img *Image, change func(*Image)) error {
+	meta, err := e.fs.ReadMeta(img.Created.Year(), img.ImageID)
+	if err != nil {
+		meta = img
+	}
+	change(meta)
+	return e.fs.PutMeta(meta)
+}
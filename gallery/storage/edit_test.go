@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/gallery/iiif"
+	"github.com/husio/gallery/gallery/quality"
+	"github.com/husio/gallery/sq"
+)
+
+func TestEditorSetText(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "gallery-text")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := Image{ImageID: "photo", Width: 1, Height: 1, Created: time.Now()}
+	if _, err := CreateImage(db, img); err != nil {
+		t.Fatalf("cannot create image: %s", err)
+	}
+	fs := NewFileStore(dir, NewDirRenditionStore(dir), 0)
+	editor := NewEditor(sq.NewDatabase(db), fs, nil)
+
+	text := func(s string) *string { return &s }
+	steps := []struct {
+		change  ImageText
+		want    [3]string
+		wantErr error
+	}{
+		{
+			change: ImageText{Title: text(" Sunset "), Caption: text("Over the sea"), AltText: text("Orange sky")},
+			want:   [3]string{"Sunset", "Over the sea", "Orange sky"},
+		},
+		{
+			// only given fields are changed
+			change: ImageText{Caption: text("")},
+			want:   [3]string{"Sunset", "", "Orange sky"},
+		},
+		{
+			change:  ImageText{Title: text(strings.Repeat("x", MaxTitleSize+1))},
+			want:    [3]string{"Sunset", "", "Orange sky"},
+			wantErr: ErrTextTooLong,
+		},
+	}
+	for i, step := range steps {
+		if _, err := editor.SetText(img.ImageID, step.change); err != step.wantErr {
+			t.Fatalf("step %d: want %v error, got %v", i, step.wantErr, err)
+		}
+		stored, err := ImageByID(db, img.ImageID)
+		if err != nil {
+			t.Fatalf("step %d: cannot get image: %s", i, err)
+		}
+		meta, err := fs.ReadMeta(img.Created.Year(), img.ImageID)
+		if err != nil {
+			t.Fatalf("step %d: cannot read metadata: %s", i, err)
+		}
+		for _, got := range []*Image{stored, meta} {
+			if texts := [3]string{got.Title, got.Caption, got.AltText}; texts != step.want {
+				t.Errorf("step %d: want %q, got %q", i, step.want, texts)
+			}
+		}
+	}
+
+	if _, err := editor.SetText("missing", ImageText{Title: text("x")}); err != sq.ErrNotFound {
+		t.Errorf("want not found error, got %v", err)
+	}
+}
+
+func TestEditorDelete(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+	dir, err := ioutil.TempDir("", "gallery-delete")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := Image{ImageID: "blurred", Width: 1, Height: 1, Created: time.Now()}
+	if _, err := CreateImage(db, img); err != nil {
+		t.Fatalf("cannot create image: %s", err)
+	}
+	if _, err := CreateTag(db, Tag{ImageID: img.ImageID, Name: "burst"}); err != nil {
+		t.Fatalf("cannot tag image: %s", err)
+	}
+	if err := PutImageQuality(db, img.ImageID, quality.Scores{Sharpness: 0.1}); err != nil {
+		t.Fatalf("cannot store quality: %s", err)
+	}
+
+	derivatives := iiif.NewDiskCache(filepath.Join(dir, "iiif"))
+	for _, id := range []string{img.ImageID, "other"} {
+		err := derivatives.Put(id, "full.jpg", func(w io.Writer) error {
+			_, err := io.WriteString(w, "derivative")
+			return err
+		})
+		if err != nil {
+			t.Fatalf("cannot cache %s derivative: %s", id, err)
+		}
+	}
+
+	fs := NewFileStore(dir, NewDirRenditionStore(dir), 0)
+	editor := NewEditor(sq.NewDatabase(db), fs, derivatives)
+	if err := editor.Delete(img.ImageID); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	if _, err := derivatives.Open(img.ImageID, "full.jpg"); !os.IsNotExist(err) {
+		t.Errorf("want derivatives deleted, got %v", err)
+	}
+	if fd, err := derivatives.Open("other", "full.jpg"); err != nil {
+		t.Errorf("want derivatives of other image kept, got %v", err)
+	} else {
+		fd.Close()
+	}
+	if _, err := ImageByID(db, img.ImageID); err != sq.ErrNotFound {
+		t.Errorf("want image deleted, got %v", err)
+	}
+	for _, table := range []string{"tags", "image_quality"} {
+		var n int
+		if err := db.Get(&n, `SELECT COUNT(*) FROM `+table); err != nil || n != 0 {
+			t.Errorf("want %s rows deleted, got %d: %v", table, n, err)
+		}
+	}
+	if err := editor.Delete(img.ImageID); err != sq.ErrNotFound {
+		t.Errorf("want not found error when deleting again, got %v", err)
+	}
+}
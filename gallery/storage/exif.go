@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/husio/gallery/sq"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF contains camera settings as written by the camera into image
+// metadata. Zero value means that information is not available.
+type EXIF struct {
+	ImageID string `db:"image_id"      json:"-"`
+	Make    string `db:"make"          json:"make,omitempty"`
+	Model   string `db:"model"         json:"model,omitempty"`
+	Lens    string `db:"lens"          json:"lens,omitempty"`
+	// FocalLength is given in millimeters.
+	FocalLength float64 `db:"focal_length"  json:"focalLength,omitempty"`
+	// Aperture is the F number.
+	Aperture float64 `db:"aperture"      json:"aperture,omitempty"`
+	// ExposureTime is given in seconds.
+	ExposureTime float64 `db:"exposure_time" json:"exposureTime,omitempty"`
+	ISO          int     `db:"iso"           json:"iso,omitempty"`
+	// Flash is true if flash fired when taking the photo.
+	Flash    bool   `db:"flash"         json:"flash"`
+	Software string `db:"software"      json:"software,omitempty"`
+}
+
+// Camera return human readable camera name.
+func (e *EXIF) Camera() string {
+	// most vendors repeat make in model name
+	if strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// ExposureTimeString return exposure time in photographic notation, for
+// example 1/250 or 2s.
+func (e *EXIF) ExposureTimeString() string {
+	switch {
+	case e.ExposureTime <= 0:
+		return ""
+	case e.ExposureTime < 1:
+		return fmt.Sprintf("1/%.0f", 1/e.ExposureTime)
+	default:
+		return fmt.Sprintf("%gs", e.ExposureTime)
+	}
+}
+
+// PutImageEXIF store camera settings of an image, replacing previous value if
+// any exists.
+func PutImageEXIF(e sq.Execer, ex EXIF) error {
+	_, err := e.Exec(`
+		INSERT OR REPLACE INTO image_exif (
+			image_id, make, model, lens, focal_length, aperture,
+			exposure_time, iso, flash, software
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ex.ImageID, ex.Make, ex.Model, ex.Lens, ex.FocalLength, ex.Aperture,
+		ex.ExposureTime, ex.ISO, ex.Flash, ex.Software)
+	return sq.CastErr(err)
+}
+
+// ImageEXIF return camera settings of an image.
+func ImageEXIF(g sq.Getter, imageID string) (*EXIF, error) {
+	var ex EXIF
+	err := g.Get(&ex, `
+		SELECT * FROM image_exif
+		WHERE image_id = ?
+		LIMIT 1
+	`, imageID)
+	if err != nil {
+		return nil, sq.CastErr(err)
+	}
+	return &ex, nil
+}
+
+// loadEXIF set camera settings of given images.
+func loadEXIF(s sq.Selector, imgs []*Image) error {
+	byID := make(map[string]*Image, len(imgs))
+	ids := make([]string, len(imgs))
+	for i, img := range imgs {
+		byID[img.ImageID] = img
+		ids[i] = img.ImageID
+	}
+	return inBatches(ids, func(placeholders string, args []interface{}) error {
+		var exifs []*EXIF
+		query := fmt.Sprintf(`
+			SELECT * FROM image_exif
+			WHERE image_id IN (%s)
+		`, placeholders)
+		if err := s.Select(&exifs, query, args...); err != nil {
+			return sq.CastErr(err)
+		}
+		for _, ex := range exifs {
+			byID[ex.ImageID].EXIF = ex
+		}
+		return nil
+	})
+}
+
+// ReadMetadata decode EXIF metadata from given image file content. Returned
+// image has only metadata related fields set: orientation, creation time,
+// location and camera settings. Only JPEG and TIFF files contain EXIF
+// metadata.
+func ReadMetadata(r io.Reader) (*Image, error) {
+	meta, err := exif.Decode(r)
+	if meta == nil {
+		return nil, fmt.Errorf("cannot decode EXIF: %s", err)
+	}
+	var img Image
+	applyEXIF(&img, meta)
+	return &img, nil
+}
+
+func cameraEXIF(meta *exif.Exif) *EXIF {
+	ex := EXIF{
+		Make:         exifString(meta, exif.Make),
+		Model:        exifString(meta, exif.Model),
+		Lens:         exifString(meta, lensModel),
+		FocalLength:  exifRat(meta, exif.FocalLength),
+		Aperture:     exifRat(meta, exif.FNumber),
+		ExposureTime: exifRat(meta, exif.ExposureTime),
+		ISO:          exifInt(meta, exif.ISOSpeedRatings),
+		Flash:        exifInt(meta, exif.Flash)&1 == 1,
+		Software:     exifString(meta, exif.Software),
+	}
+	return &ex
+}
+
+// applyEXIF update image information using given EXIF metadata.
+func applyEXIF(img *Image, meta *exif.Exif) {
+	if orientation, err := meta.Get(exif.Orientation); err != nil {
+		if !exif.IsTagNotPresentError(err) {
+			log.Printf("cannot extract image orientation: %s", err)
+		}
+	} else {
+		if o, err := orientation.Int(0); err != nil {
+			log.Printf("cannot format orientation: %s", err)
+		} else {
+			img.Orientation = o
+		}
+	}
+	if dt, err := meta.Get(exif.DateTimeOriginal); err != nil {
+		// most images without EXIF camera settings do not have it either
+		if !exif.IsTagNotPresentError(err) {
+			log.Printf("cannot extract image datetime original: %s", err)
+		}
+	} else {
+		if raw, err := dt.StringVal(); err != nil {
+			log.Printf("cannot format datetime original: %s", err)
+		} else {
+			img.Created, err = time.Parse("2006:01:02 15:04:05", raw)
+			if err != nil {
+				log.Printf("cannot parse datetime original: %s", err)
+			}
+		}
+	}
+	if lat, lon, err := meta.LatLong(); err == nil {
+		img.Latitude = &lat
+		img.Longitude = &lon
+		if alt, ok := exifAltitude(meta); ok {
+			img.Altitude = &alt
+		}
+	} else if !exif.IsTagNotPresentError(err) {
+		log.Printf("cannot extract GPS position: %s", err)
+	}
+	img.EXIF = cameraEXIF(meta)
+	img.EXIF.ImageID = img.ImageID
+}
+
+// exifPreview return JPEG encoded preview embedded in EXIF metadata or nil.
+func exifPreview(meta *exif.Exif) []byte {
+	// JpegThumbnail does not validate the offsets
+	start := exifInt(meta, exif.ThumbJPEGInterchangeFormat)
+	length := exifInt(meta, exif.ThumbJPEGInterchangeFormatLength)
+	if start <= 0 || length <= 0 || start+length > len(meta.Raw) {
+		return nil
+	}
+	raw, err := meta.JpegThumbnail()
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// exifAltitude return altitude in meters above the sea level.
+func exifAltitude(meta *exif.Exif) (float64, bool) {
+	tag, err := meta.Get(exif.GPSAltitude)
+	if err != nil || tag.Count == 0 {
+		return 0, false
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0, false
+	}
+	alt := float64(num) / float64(den)
+	// reference value 1 means below the sea level
+	if exifInt(meta, exif.GPSAltitudeRef) == 1 {
+		alt = -alt
+	}
+	return alt, true
+}
+
+func exifString(meta *exif.Exif, name exif.FieldName) string {
+	tag, err := meta.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifRat(meta *exif.Exif, name exif.FieldName) float64 {
+	tag, err := meta.Get(name)
+	if err != nil || tag.Count == 0 {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+func exifInt(meta *exif.Exif, name exif.FieldName) int {
+	tag, err := meta.Get(name)
+	if err != nil || tag.Count == 0 {
+		return 0
+	}
+	n, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+const (
+	lensMake  exif.FieldName = "LensMake"
+	lensModel exif.FieldName = "LensModel"
+)
+
+func init() {
+	exif.RegisterParsers(&lensParser{})
+}
+
+// lensParser load lens information from EXIF sub-IFD, which is not supported
+// by the goexif parser.
+type lensParser struct{}
+
+func (lensParser) Parse(x *exif.Exif) error {
+	ptr, err := x.Get(exif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := ptr.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil
+	}
+	x.LoadTags(dir, map[uint16]exif.FieldName{
+		0xA433: lensMake,
+		0xA434: lensModel,
+	}, false)
+	return nil
+}
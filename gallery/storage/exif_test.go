@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func TestApplyEXIF(t *testing.T) {
+	cases := map[string]struct {
+		ifd0    []tiffEntry
+		exifIFD []tiffEntry
+		want    EXIF
+		created time.Time
+	}{
+		"all camera settings": {
+			ifd0: []tiffEntry{
+				asciiEntry(0x010F, "Canon\x00\x00"),
+				asciiEntry(0x0110, "Canon EOS 5D "),
+				asciiEntry(0x0131, "Firmware 1.1"),
+			},
+			exifIFD: []tiffEntry{
+				ratEntry(0x829A, 1, 250),
+				ratEntry(0x829D, 28, 10),
+				shortEntry(0x8827, 400),
+				asciiEntry(0x9003, "2016:07:21 18:30:05"),
+				shortEntry(0x9209, 0x19),
+				ratEntry(0x920A, 50, 1),
+				asciiEntry(0xA434, "EF50mm f/1.8 II"),
+			},
+			want: EXIF{
+				Make:         "Canon",
+				Model:        "Canon EOS 5D",
+				Lens:         "EF50mm f/1.8 II",
+				FocalLength:  50,
+				Aperture:     2.8,
+				ExposureTime: 0.004,
+				ISO:          400,
+				Flash:        true,
+				Software:     "Firmware 1.1",
+			},
+			created: time.Date(2016, 7, 21, 18, 30, 5, 0, time.UTC),
+		},
+		"flash not fired": {
+			ifd0: []tiffEntry{
+				asciiEntry(0x0110, "X100"),
+			},
+			exifIFD: []tiffEntry{
+				shortEntry(0x9209, 0x10),
+			},
+			want: EXIF{Model: "X100"},
+		},
+		"no camera settings": {
+			ifd0: []tiffEntry{
+				shortEntry(0x0112, 6),
+			},
+			want: EXIF{},
+		},
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for tname, tc := range cases {
+		logs.Reset()
+		meta, err := exif.Decode(bytes.NewReader(testTIFF(tc.ifd0, tc.exifIFD)))
+		if err != nil {
+			t.Errorf("%s: cannot decode: %s", tname, err)
+			continue
+		}
+		img := Image{ImageID: "photo"}
+		applyEXIF(&img, meta)
+		want := tc.want
+		want.ImageID = "photo"
+		if img.EXIF == nil || *img.EXIF != want {
+			t.Errorf("%s: want %+v, got %+v", tname, want, img.EXIF)
+		}
+		if !img.Created.Equal(tc.created) {
+			t.Errorf("%s: want %s creation time, got %s", tname, tc.created, img.Created)
+		}
+		if logs.Len() != 0 {
+			t.Errorf("%s: want nothing logged, got %q", tname, logs.String())
+		}
+	}
+}
+
+func TestImagesCameraFilter(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	exifs := []EXIF{
+		{ImageID: "canon", Make: "Canon", Model: "Canon EOS 5D", Lens: "EF50mm f/1.8 II"},
+		{ImageID: "nikon", Make: "NIKON CORPORATION", Model: "NIKON D750", Lens: "AF-S 50mm f/1.8G"},
+		{ImageID: "phone", Make: "Apple", Model: "iPhone 6"},
+	}
+	for _, ex := range exifs {
+		if _, err := CreateImage(db, Image{ImageID: ex.ImageID, Created: now}); err != nil {
+			t.Fatalf("cannot create %s image: %s", ex.ImageID, err)
+		}
+		if err := PutImageEXIF(db, ex); err != nil {
+			t.Fatalf("cannot store %s EXIF: %s", ex.ImageID, err)
+		}
+	}
+	if _, err := CreateImage(db, Image{ImageID: "unknown", Created: now}); err != nil {
+		t.Fatalf("cannot create image: %s", err)
+	}
+
+	cases := map[string]struct {
+		opts ImagesOpts
+		want []string
+	}{
+		"no filter":       {opts: ImagesOpts{}, want: []string{"canon", "nikon", "phone", "unknown"}},
+		"camera make":     {opts: ImagesOpts{Camera: "nikon"}, want: []string{"nikon"}},
+		"camera model":    {opts: ImagesOpts{Camera: "iphone"}, want: []string{"phone"}},
+		"make and model":  {opts: ImagesOpts{Camera: "Apple iPhone"}, want: []string{"phone"}},
+		"lens":            {opts: ImagesOpts{Lens: "50mm"}, want: []string{"canon", "nikon"}},
+		"camera and lens": {opts: ImagesOpts{Camera: "canon", Lens: "50mm"}, want: []string{"canon"}},
+		"no match":        {opts: ImagesOpts{Camera: "leica"}, want: nil},
+	}
+	for tname, tc := range cases {
+		tc.opts.Limit = 10
+		imgs, err := Images(db, tc.opts)
+		if err != nil {
+			t.Errorf("%s: cannot list images: %s", tname, err)
+			continue
+		}
+		var ids []string
+		for _, img := range imgs {
+			ids = append(ids, img.ImageID)
+		}
+		sort.Strings(ids)
+		if !reflect.DeepEqual(ids, tc.want) {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, ids)
+		}
+	}
+
+	imgs, err := Images(db, ImagesOpts{Limit: 10, Camera: "canon"})
+	if err != nil {
+		t.Fatalf("cannot list images: %s", err)
+	}
+	if len(imgs) != 1 || imgs[0].EXIF == nil || *imgs[0].EXIF != exifs[0] {
+		t.Errorf("want listed image with camera settings, got %+v", imgs)
+	}
+	img, err := ImageByID(db, "nikon")
+	if err != nil {
+		t.Fatalf("cannot get image: %s", err)
+	}
+	if img.EXIF == nil || *img.EXIF != exifs[1] {
+		t.Errorf("want image with camera settings, got %+v", img.EXIF)
+	}
+	if img, err := ImageByID(db, "unknown"); err != nil || img.EXIF != nil {
+		t.Errorf("want image without camera settings, got %+v, %v", img, err)
+	}
+}
+
+// tiffEntry is a single IFD entry, with value encoded in little endian.
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: []byte(s + "\x00")}
+}
+
+func shortEntry(tag uint16, v uint16) tiffEntry {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, v)
+	return tiffEntry{tag: tag, typ: 3, count: 1, value: b.Bytes()}
+}
+
+func ratEntry(tag uint16, num, den uint32) tiffEntry {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{num, den})
+	return tiffEntry{tag: tag, typ: 5, count: 1, value: b.Bytes()}
+}
+
+// testTIFF return TIFF encoded EXIF metadata with given IFD0 entries and, if
+// not empty, EXIF sub-IFD entries.
+func testTIFF(ifd0, exifIFD []tiffEntry) []byte {
+	ifdSize := func(n int) uint32 { return uint32(2 + 12*n + 4) }
+
+	if len(exifIFD) != 0 {
+		ptr := uint32(8) + ifdSize(len(ifd0)+1)
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, ptr)
+		ifd0 = append(ifd0, tiffEntry{tag: 0x8769, typ: 4, count: 1, value: b.Bytes()})
+	}
+	dataOffset := uint32(8) + ifdSize(len(ifd0))
+	if len(exifIFD) != 0 {
+		dataOffset += ifdSize(len(exifIFD))
+	}
+
+	var out, data bytes.Buffer
+	out.WriteString("II*\x00")
+	binary.Write(&out, binary.LittleEndian, uint32(8))
+	for _, ifd := range [][]tiffEntry{ifd0, exifIFD} {
+		if len(ifd) == 0 {
+			continue
+		}
+		binary.Write(&out, binary.LittleEndian, uint16(len(ifd)))
+		for _, e := range ifd {
+			binary.Write(&out, binary.LittleEndian, []uint16{e.tag, e.typ})
+			binary.Write(&out, binary.LittleEndian, e.count)
+			if len(e.value) <= 4 {
+				var inline [4]byte
+				copy(inline[:], e.value)
+				out.Write(inline[:])
+			} else {
+				binary.Write(&out, binary.LittleEndian, dataOffset+uint32(data.Len()))
+				data.Write(e.value)
+			}
+		}
+		binary.Write(&out, binary.LittleEndian, uint32(0))
+	}
+	out.Write(data.Bytes())
+	return out.Bytes()
+}
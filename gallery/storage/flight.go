@@ -0,0 +1,42 @@
+package storage
+
+import "sync"
+
+// flightGroup deduplicates concurrent calls with the same key, so that only
+// one of them is executed and all callers receive its result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// Do execute fn, unless there is already an execution in progress for the
+// same key, in which case its result is returned. Returned flag is true if
+// the result comes from another caller's execution.
+func (g *flightGroup) Do(key string, fn func() error) (bool, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return true, f.err
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.err = fn()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+
+	return false, f.err
+}
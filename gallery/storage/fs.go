@@ -1,30 +1,51 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"image"
 	"image/jpeg"
 	"io"
-	"log"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
-	"sync"
+	"runtime"
+	"sync/atomic"
 
-	"github.com/disintegration/imaging"
+	"github.com/husio/gallery/gallery/orientation"
+	"github.com/rwcarlsen/goexif/exif"
 )
 
 type FileStore struct {
-	photos string
+	photos     string
+	renditions RenditionStore
 
-	// make sure only one storage is in use at any time to not abuse hdd
-	mu         sync.Mutex
-	thumbnails string
+	// renditions of the same image are never created concurrently
+	flights flightGroup
+	// workers limit number of images decoded at the same time, either to
+	// create renditions or by Decode callers
+	workers chan struct{}
+
+	// generated is the number of created renditions, fromPreview is the
+	// number of those created from embedded EXIF preview
+	generated   int64
+	fromPreview int64
 }
 
-func NewFileStore(photosRoot, thumbnailsRoot string) *FileStore {
+// NewFileStore return store keeping original images in given directory and
+// their renditions in given rendition store, which can be nil if renditions
+// are not used. At most workers images are decoded at the same time. Zero or
+// less means as many as there are CPUs available.
+func NewFileStore(photosRoot string, renditions RenditionStore, workers int) *FileStore {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 	return &FileStore{
 		photos:     photosRoot,
-		thumbnails: thumbnailsRoot,
+		renditions: renditions,
+		workers:    make(chan struct{}, workers),
 	}
 }
 
@@ -33,7 +54,7 @@ func (fs *FileStore) Put(img *Image, content io.Reader) error {
 
 	os.MkdirAll(dir, 0776)
 
-	imgPath := filepath.Join(dir, fmt.Sprintf("%s.jpg", img.ImageID))
+	imgPath := filepath.Join(dir, img.ImageID+mediaTypeExt(img.MediaType))
 	fd, err := os.OpenFile(imgPath, os.O_CREATE|os.O_WRONLY, 0640)
 	if err != nil {
 		return fmt.Errorf("cannot create %q: %s", imgPath, err)
@@ -50,11 +71,70 @@ func (fs *FileStore) Put(img *Image, content io.Reader) error {
 	return nil
 }
 
+// TempFile create new temporary file on the same file system as stored
+// images, so that it can be moved to its final location with Commit.
+func (fs *FileStore) TempFile() (*os.File, error) {
+	os.MkdirAll(fs.photos, 0776)
+	return ioutil.TempFile(fs.photos, ".ingest-")
+}
+
+// Spool copy content into a temporary file on the same file system as stored
+// images, see Spool function. Such file is moved to its final location when
+// uploaded, instead of being copied.
+func (fs *FileStore) Spool(r io.Reader, maxSize int64) (*SpooledFile, error) {
+	dir := fs.spoolDir()
+	if err := os.MkdirAll(dir, 0776); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory: %s", err)
+	}
+	return Spool(dir, r, maxSize)
+}
+
+func (fs *FileStore) spoolDir() string {
+	return filepath.Join(fs.photos, "uploads", "tmp")
+}
+
+// Commit atomically move already written temporary file to the location of
+// given image and store image metadata. Images are content addressed, so if
+// the image file already exists, it is left untouched and false is returned.
+func (fs *FileStore) Commit(img *Image, tmpPath string) (bool, error) {
+	dir := filepath.Join(fs.photos, fmt.Sprint(img.Created.Year()))
+
+	os.MkdirAll(dir, 0776)
+
+	if err := os.Chmod(tmpPath, 0640); err != nil {
+		return false, fmt.Errorf("cannot change mode: %s", err)
+	}
+	// unlike rename, link fails if the destination file exists
+	imgPath := filepath.Join(dir, img.ImageID+mediaTypeExt(img.MediaType))
+	if err := os.Link(tmpPath, imgPath); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot link %q: %s", imgPath, err)
+	}
+	os.Remove(tmpPath)
+
+	if err := fs.PutMeta(img); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// Remove delete image file together with its metadata.
+func (fs *FileStore) Remove(img *Image) error {
+	dir := filepath.Join(fs.photos, fmt.Sprint(img.Created.Year()))
+	os.Remove(filepath.Join(dir, img.ImageID+".json"))
+	return os.Remove(filepath.Join(dir, img.ImageID+mediaTypeExt(img.MediaType)))
+}
+
 func (fs *FileStore) PutMeta(img *Image) error {
 	dir := filepath.Join(fs.photos, fmt.Sprint(img.Created.Year()))
 	path := filepath.Join(dir, fmt.Sprintf("%s.json", img.ImageID))
 
-	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0640)
+	os.MkdirAll(dir, 0776)
+
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
 	if err != nil {
 		return err
 	}
@@ -69,61 +149,195 @@ func (fs *FileStore) PutMeta(img *Image) error {
 	return nil
 }
 
-func (fs *FileStore) Read(year int, imageID string) (io.ReadCloser, error) {
-	path := filepath.Join(fs.photos, fmt.Sprint(year), imageID+".jpg")
+// Read return original image file content.
+func (fs *FileStore) Read(img *Image) (io.ReadCloser, error) {
+	path := filepath.Join(fs.photos, fmt.Sprint(img.Created.Year()), img.ImageID+mediaTypeExt(img.MediaType))
 	return os.Open(path)
 }
 
-func (fs *FileStore) ReadThumbnail(year, orientation int, imageID string) (io.ReadCloser, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	path := filepath.Join(fs.thumbnails, fmt.Sprint(year), imageID+".jpg")
-	fd, err := os.Open(path)
-	if err == nil {
+// ReadRendition return JPEG encoded rendition of given image. Rendition is
+// created from the original image file if does not yet exist.
+func (fs *FileStore) ReadRendition(img *Image, p Preset) (io.ReadCloser, error) {
+	if fd, err := fs.renditions.Open(img, p.Name); err == nil {
 		return fd, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
 
-	img, err := fs.Read(year, imageID)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read photo file: %s", err)
+	// all renditions of the same image are created one by one, so when
+	// waiting for another preset, rendition must be checked again
+	for {
+		shared, err := fs.flights.Do(img.ImageID, func() error {
+			return fs.generate(img, Presets{p})
+		})
+		if fd, err := fs.renditions.Open(img, p.Name); err == nil {
+			return fd, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !shared {
+			return nil, fmt.Errorf("%s rendition of %q not created", p.Name, img.ImageID)
+		}
+	}
+}
+
+// PutRenditions create renditions of given image for all presets. Original
+// image is decoded only once.
+func (fs *FileStore) PutRenditions(img *Image, presets Presets) error {
+	_, err := fs.flights.Do(img.ImageID, func() error {
+		return fs.generate(img, presets)
+	})
+	return err
+}
+
+// generate create all missing renditions of given image. Must be called only
+// by a single flight for given image.
+func (fs *FileStore) generate(img *Image, presets Presets) error {
+	var missing Presets
+	for _, p := range presets {
+		if !fs.renditions.Exists(img, p.Name) {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	fs.workers <- struct{}{}
+	defer func() { <-fs.workers }()
+
+	// embedded preview is much faster to decode than the original, so use
+	// it for all presets it is good enough for
+	if preview := fs.preview(img); preview != nil {
+		var rest Presets
+		for _, p := range missing {
+			if !previewFits(preview, img, p) {
+				rest = append(rest, p)
+				continue
+			}
+			if err := fs.putRendition(img, p, preview); err != nil {
+				return err
+			}
+			atomic.AddInt64(&fs.fromPreview, 1)
+		}
+		if missing = rest; len(missing) == 0 {
+			return nil
+		}
 	}
-	image, err := jpeg.Decode(img)
-	img.Close()
+
+	// worker is already taken
+	src, err := fs.decode(img)
 	if err != nil {
-		return nil, fmt.Errorf("cannot decode image: %s", err)
+		return err
 	}
-	switch orientation {
-	case 1:
-		// all good
-	case 3:
-		image = imaging.Rotate180(image)
-	case 8:
-		image = imaging.Rotate90(image)
-	case 6:
-		image = imaging.Rotate270(image)
-	default:
-		log.Printf("unknown image orientation: %s", imageID)
+	for _, p := range missing {
+		if err := fs.putRendition(img, p, src); err != nil {
+			return err
+		}
 	}
-	image = imaging.Fill(image, 100, 100, imaging.Center, imaging.Linear)
+	return nil
+}
 
-	os.MkdirAll(filepath.Dir(path), 0777)
+func (fs *FileStore) putRendition(img *Image, p Preset, src image.Image) error {
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, p.render(src, img), p.jpegOptions()); err != nil {
+		return fmt.Errorf("cannot encode rendition: %s", err)
+	}
+	if err := fs.renditions.Put(img, p.Name, b.Bytes()); err != nil {
+		return err
+	}
+	atomic.AddInt64(&fs.generated, 1)
+	return nil
+}
 
-	fd, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+// RenditionStats describe renditions created since the store was created.
+type RenditionStats struct {
+	Generated int64 `json:"generated"`
+	// FromPreview is the number of renditions created from the embedded
+	// EXIF preview instead of the original image.
+	FromPreview int64 `json:"fromPreview"`
+}
+
+func (fs *FileStore) RenditionStats() RenditionStats {
+	return RenditionStats{
+		Generated:   atomic.LoadInt64(&fs.generated),
+		FromPreview: atomic.LoadInt64(&fs.fromPreview),
+	}
+}
+
+// preview return EXIF embedded preview of given image, transformed according
+// to image orientation. Nil is returned if image has no preview.
+func (fs *FileStore) preview(img *Image) image.Image {
+	if !HasEXIF(img.MediaType) {
+		return nil
+	}
+	fd, err := fs.Read(img)
 	if err != nil {
-		return nil, fmt.Errorf("cannot store thumbnail: %s", err)
+		return nil
 	}
-	err = imaging.Encode(fd, image, imaging.JPEG)
-	fd.Close()
+	defer fd.Close()
+	meta, _ := exif.Decode(fd)
+	if meta == nil {
+		return nil
+	}
+	raw := exifPreview(meta)
+	if raw == nil {
+		return nil
+	}
+	preview, err := jpeg.Decode(bytes.NewReader(raw))
 	if err != nil {
-		return nil, fmt.Errorf("cannot write thumbnail: %s", err)
+		return nil
 	}
+	return orientation.Apply(preview, img.Orientation)
+}
 
-	return os.Open(path)
+// previewFits return true if rendition created from given preview would be
+// of the same quality as the one created from the original image.
+func previewFits(preview image.Image, img *Image, p Preset) bool {
+	width, height := orientation.Size(img.Width, img.Height, img.Orientation)
+	b := preview.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 || width == 0 || height == 0 {
+		return false
+	}
+	// some cameras add black bars to the preview to keep its size fixed
+	aspect := float64(width) / float64(height)
+	if math.Abs(float64(b.Dx())/float64(b.Dy())-aspect)/aspect > 0.02 {
+		return false
+	}
+	return float64(b.Dx())/float64(width) >= p.scale(width, height)
+}
+
+// RemoveRenditions delete all renditions of given image, so that they are
+// created again on next read.
+func (fs *FileStore) RemoveRenditions(img *Image) error {
+	return fs.renditions.Remove(img)
+}
+
+// Decode return original image content, transformed according to its
+// orientation. Decoding full size images takes a lot of memory, so it waits
+// for a free worker.
+func (fs *FileStore) Decode(img *Image) (image.Image, error) {
+	fs.workers <- struct{}{}
+	defer func() { <-fs.workers }()
+	return fs.decode(img)
+}
+
+func (fs *FileStore) decode(img *Image) (image.Image, error) {
+	orig, err := fs.Read(img)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read photo file: %s", err)
+	}
+	src, _, err := image.Decode(orig)
+	orig.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %s", err)
+	}
+	return orientation.Apply(src, img.Orientation), nil
 }
 
 func (fs *FileStore) ReadMeta(year int, imageID string) (*Image, error) {
-	path := filepath.Join(fs.photos, fmt.Sprint(year), imageID+".jpg")
+	path := filepath.Join(fs.photos, fmt.Sprint(year), imageID+".json")
 	fd, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read meta file: %s", err)
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadRenditionConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileStore(filepath.Join(dir, "photos"), NewDirRenditionStore(filepath.Join(dir, "thumbnails")), 2)
+
+	now := time.Now()
+	var images []*Image
+	for i := 0; i < 4; i++ {
+		img, _, err := ingest(fs, bytes.NewReader(testJPEG(t, 300+i, 200, 1)), now)
+		if err != nil {
+			t.Fatalf("cannot ingest: %s", err)
+		}
+		images = append(images, img)
+	}
+	presets := Presets{
+		{Name: "a", Width: 50, Height: 50, Fill: true, Quality: 80},
+		{Name: "b", Width: 100, Height: 100, Quality: 80},
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed int64
+	)
+	for i := 0; i < 64; i++ {
+		img := images[i%len(images)]
+		p := presets[i/len(images)%len(presets)]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			fd, err := fs.ReadRendition(img, p)
+			if err != nil {
+				t.Errorf("cannot read %s rendition: %s", p.Name, err)
+				atomic.AddInt64(&failed, 1)
+				return
+			}
+			defer fd.Close()
+			if _, err := jpeg.Decode(fd); err != nil {
+				t.Errorf("cannot decode %s rendition: %s", p.Name, err)
+				atomic.AddInt64(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		t.Fatalf("%d reads failed", failed)
+	}
+	// every rendition is created exactly once
+	if want := int64(len(images) * len(presets)); fs.generated != want {
+		t.Errorf("want %d renditions generated, got %d", want, fs.generated)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "thumbnails", "*", ".tmp-*")); len(tmp) != 0 {
+		t.Errorf("temporary files not removed: %v", tmp)
+	}
+}
+
+func TestDecodeWaitsForWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileStore(dir, nil, 1)
+	img, _, err := ingest(fs, bytes.NewReader(testJPEG(t, 64, 48, 1)), time.Now())
+	if err != nil {
+		t.Fatalf("cannot ingest: %s", err)
+	}
+
+	// the only worker is busy
+	fs.workers <- struct{}{}
+	decoded := make(chan error, 1)
+	go func() {
+		_, err := fs.Decode(img)
+		decoded <- err
+	}()
+	select {
+	case <-decoded:
+		t.Fatal("want decode to wait for a free worker")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-fs.workers
+	select {
+	case err := <-decoded:
+		if err != nil {
+			t.Fatalf("cannot decode: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decode not done after worker was released")
+	}
+}
+
+func TestReadRenditionFromPreview(t *testing.T) {
+	// original is blue and preview is red, so that the source of the
+	// rendition can be told by its color
+	solid := func(w, h int, c color.Color) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.ZP, draw.Src)
+		var b bytes.Buffer
+		if err := jpeg.Encode(&b, img, nil); err != nil {
+			t.Fatalf("cannot encode: %s", err)
+		}
+		return b.Bytes()
+	}
+	blue := color.RGBA{0, 0, 255, 255}
+	red := color.RGBA{255, 0, 0, 255}
+
+	cases := map[string]struct {
+		orientation int
+		preview     []byte
+		preset      Preset
+		wantPreview bool
+	}{
+		"small fill preset from preview": {
+			orientation: 1,
+			preview:     solid(160, 120, red),
+			preset:      Preset{Name: "small", Width: 100, Height: 100, Fill: true, Quality: 80},
+			wantPreview: true,
+		},
+		"fit preset from preview": {
+			orientation: 1,
+			preview:     solid(160, 120, red),
+			preset:      Preset{Name: "medium", Width: 160, Height: 160, Quality: 80},
+			wantPreview: true,
+		},
+		"rotated image from preview": {
+			orientation: 6,
+			preview:     solid(160, 120, red),
+			preset:      Preset{Name: "small", Width: 100, Height: 100, Fill: true, Quality: 80},
+			wantPreview: true,
+		},
+		"preview too small": {
+			orientation: 1,
+			preview:     solid(160, 120, red),
+			preset:      Preset{Name: "large", Width: 1280, Height: 1280, Quality: 80},
+			wantPreview: false,
+		},
+		"preview with different aspect ratio": {
+			orientation: 1,
+			preview:     solid(160, 160, red),
+			preset:      Preset{Name: "small", Width: 100, Height: 100, Fill: true, Quality: 80},
+			wantPreview: false,
+		},
+		"no preview": {
+			orientation: 1,
+			preset:      Preset{Name: "small", Width: 100, Height: 100, Fill: true, Quality: 80},
+			wantPreview: false,
+		},
+	}
+
+	for tname, tc := range cases {
+		dir, err := ioutil.TempDir("", "fs")
+		if err != nil {
+			t.Fatalf("cannot create directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		fs := NewFileStore(filepath.Join(dir, "photos"), NewDirRenditionStore(filepath.Join(dir, "thumbnails")), 1)
+
+		raw := withEXIF(solid(640, 480, blue), tc.orientation, tc.preview)
+		img, _, err := ingest(fs, bytes.NewReader(raw), time.Now())
+		if err != nil {
+			t.Errorf("%s: cannot ingest: %s", tname, err)
+			continue
+		}
+
+		fd, err := fs.ReadRendition(img, tc.preset)
+		if err != nil {
+			t.Errorf("%s: cannot read rendition: %s", tname, err)
+			continue
+		}
+		rendition, err := jpeg.Decode(fd)
+		fd.Close()
+		if err != nil {
+			t.Errorf("%s: cannot decode rendition: %s", tname, err)
+			continue
+		}
+
+		b := rendition.Bounds()
+		r, _, _, _ := rendition.At(b.Dx()/2, b.Dy()/2).RGBA()
+		if fromPreview := r > 0x8000; fromPreview != tc.wantPreview {
+			t.Errorf("%s: want from preview %v, got %v", tname, tc.wantPreview, fromPreview)
+		}
+		var want int64
+		if tc.wantPreview {
+			want = 1
+		}
+		if fromPreview := fs.RenditionStats().FromPreview; fromPreview != want {
+			t.Errorf("%s: want %d renditions from preview, got %d", tname, want, fromPreview)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BBox is geographic area defined by its south-west and north-east corners.
+// If MinLon is greater than MaxLon, area crosses the antimeridian.
+type BBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// ParseBBox parse bounding box written as "minLon,minLat,maxLon,maxLat",
+// which is the format used by GeoJSON and most map libraries.
+func ParseBBox(s string) (*BBox, error) {
+	chunks := strings.Split(s, ",")
+	if len(chunks) != 4 {
+		return nil, fmt.Errorf("expected 4 coordinates, got %d", len(chunks))
+	}
+	var vals [4]float64
+	for i, c := range chunks {
+		v, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid coordinate %q", c)
+		}
+		vals[i] = v
+	}
+	b := BBox{MinLon: vals[0], MinLat: vals[1], MaxLon: vals[2], MaxLat: vals[3]}
+	if b.MinLon < -180 || b.MinLon > 180 || b.MaxLon < -180 || b.MaxLon > 180 {
+		return nil, fmt.Errorf("longitude out of range")
+	}
+	if b.MinLat < -90 || b.MinLat > 90 || b.MaxLat < -90 || b.MaxLat > 90 {
+		return nil, fmt.Errorf("latitude out of range")
+	}
+	if b.MinLat > b.MaxLat {
+		return nil, fmt.Errorf("minimum latitude greater than maximum")
+	}
+	return &b, nil
+}
+
+func (b *BBox) String() string {
+	return fmt.Sprintf("%g,%g,%g,%g", b.MinLon, b.MinLat, b.MaxLon, b.MaxLat)
+}
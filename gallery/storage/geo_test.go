@@ -0,0 +1,53 @@
+package storage
+
+import "testing"
+
+func TestParseBBox(t *testing.T) {
+	cases := map[string]struct {
+		raw     string
+		want    BBox
+		wantErr bool
+	}{
+		"valid": {
+			raw:  "126.1,33.1,126.9,33.6",
+			want: BBox{MinLon: 126.1, MinLat: 33.1, MaxLon: 126.9, MaxLat: 33.6},
+		},
+		"antimeridian": {
+			raw:  "170, -20, -170, -10",
+			want: BBox{MinLon: 170, MinLat: -20, MaxLon: -170, MaxLat: -10},
+		},
+		"too_few": {
+			raw:     "1,2,3",
+			wantErr: true,
+		},
+		"not_a_number": {
+			raw:     "1,2,x,4",
+			wantErr: true,
+		},
+		"latitude_out_of_range": {
+			raw:     "1,-91,2,3",
+			wantErr: true,
+		},
+		"latitude_swapped": {
+			raw:     "1,20,2,10",
+			wantErr: true,
+		},
+	}
+
+	for tname, tc := range cases {
+		got, err := ParseBBox(tc.raw)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %+v", tname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tname, err)
+			continue
+		}
+		if *got != tc.want {
+			t.Errorf("%s: want %+v, got %+v", tname, tc.want, got)
+		}
+	}
+}
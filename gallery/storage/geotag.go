@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/husio/gallery/gallery/gpx"
+	"github.com/husio/gallery/sq"
+)
+
+type Geotagger struct {
+	db     selectExecer
+	fs     *FileStore
+	places PlaceFinder
+}
+
+type selectExecer interface {
+	sq.Selector
+	sq.Execer
+}
+
+// NewGeotagger return geotagger that updates images in given storages. If
+// places is not nil, geotagged images are automatically tagged with place
+// names.
+func NewGeotagger(db selectExecer, fs *FileStore, places PlaceFinder) *Geotagger {
+	return &Geotagger{
+		db:     db,
+		fs:     fs,
+		places: places,
+	}
+}
+
+type GeotagOpts struct {
+	// Tags, if not nil, restricts geotagging to images matching the query.
+	Tags TagQuery
+	// From and To, if not zero, restricts geotagging to images created
+	// within given time window, as recorded by the camera clock.
+	From time.Time
+	To   time.Time
+	// ClockOffset is the difference between camera clock and UTC. For
+	// example, camera set to Korean time has +9h offset.
+	ClockOffset time.Duration
+	// Overwrite if true, replace location of already geotagged images.
+	Overwrite bool
+}
+
+// ParseCameraTime parse time as shown by camera clock, for example
+// 2016-07-21T18:30, which is also the format of datetime-local form input.
+// Empty value is zero time.
+func ParseCameraTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format %q", s)
+}
+
+type GeotagResult struct {
+	// Matched is the number of images selected for geotagging.
+	Matched int
+	// Geotagged contains IDs of images that location was set for.
+	Geotagged []string
+	// Skipped is the number of images that already had location.
+	Skipped int
+	// OutOfTrack is the number of images taken outside of the track
+	// recording time.
+	OutOfTrack int
+}
+
+// Geotag set location of selected images by matching their creation time with
+// the track. Location is written both into database and metadata file.
+func (g *Geotagger) Geotag(track *gpx.Track, opts GeotagOpts) (*GeotagResult, error) {
+	if opts.Tags == nil && opts.From.IsZero() && opts.To.IsZero() {
+		return nil, fmt.Errorf("either tag query or time window is required")
+	}
+
+	images, err := Images(g.db, ImagesOpts{
+		Tags:          opts.Tags,
+		CreatedAfter:  opts.From,
+		CreatedBefore: opts.To,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list images: %s", err)
+	}
+
+	res := GeotagResult{Matched: len(images)}
+	for _, img := range images {
+		if img.Latitude != nil && !opts.Overwrite {
+			res.Skipped++
+			continue
+		}
+
+		// camera time is stored without time zone information
+		taken := time.Date(
+			img.Created.Year(), img.Created.Month(), img.Created.Day(),
+			img.Created.Hour(), img.Created.Minute(), img.Created.Second(),
+			img.Created.Nanosecond(), time.UTC).Add(-opts.ClockOffset)
+		pos, ok := track.Position(taken)
+		if !ok {
+			res.OutOfTrack++
+			continue
+		}
+
+		err := SetImageLocation(g.db, img.ImageID, pos.Latitude, pos.Longitude, pos.Elevation)
+		if err != nil {
+			return &res, fmt.Errorf("cannot set %s location: %s", img.ImageID, err)
+		}
+		img.Latitude, img.Longitude, img.Altitude = &pos.Latitude, &pos.Longitude, pos.Elevation
+		if g.places != nil {
+			if _, err := TagPlaces(g.db, g.places, img); err != nil {
+				return &res, fmt.Errorf("cannot tag %s places: %s", img.ImageID, err)
+			}
+		}
+		if err := g.updateMeta(img); err != nil {
+			return &res, fmt.Errorf("cannot update %s metadata file: %s", img.ImageID, err)
+		}
+		res.Geotagged = append(res.Geotagged, img.ImageID)
+	}
+	return &res, nil
+}
+
+// updateMeta write location of given image into its metadata file, keeping
+// all other information unchanged.
+func (g *Geotagger) updateMeta(img *Image) error {
+	meta, err := g.fs.ReadMeta(img.Created.Year(), img.ImageID)
+	if err != nil {
+		meta = img
+	}
+	meta.Latitude, meta.Longitude, meta.Altitude = img.Latitude, img.Longitude, img.Altitude
+	return g.fs.PutMeta(meta)
+}
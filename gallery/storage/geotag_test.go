@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCameraTime(t *testing.T) {
+	cases := map[string]struct {
+		raw     string
+		want    time.Time
+		wantErr bool
+	}{
+		"empty":        {raw: " ", want: time.Time{}},
+		"form input":   {raw: "2016-07-21T18:30", want: time.Date(2016, 7, 21, 18, 30, 0, 0, time.UTC)},
+		"with seconds": {raw: "2016-07-21T18:30:05", want: time.Date(2016, 7, 21, 18, 30, 5, 0, time.UTC)},
+		"date only":    {raw: " 2016-07-21 ", want: time.Date(2016, 7, 21, 0, 0, 0, 0, time.UTC)},
+		"with zone":    {raw: "2016-07-21T18:30:05+09:00", wantErr: true},
+		"invalid":      {raw: "yesterday", wantErr: true},
+	}
+	for tname, tc := range cases {
+		got, err := ParseCameraTime(tc.raw)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %s", tname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: cannot parse: %s", tname, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: want %s, got %s", tname, tc.want, got)
+		}
+	}
+}
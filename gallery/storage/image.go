@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/husio/gallery/gallery/palette"
 	"github.com/husio/gallery/qb"
 	"github.com/husio/gallery/sq"
 )
@@ -12,14 +14,43 @@ type Image struct {
 	Width       int       `db:"width"       json:"width"`
 	Height      int       `db:"height"      json:"height"`
 	Orientation int       `db:"orientation" json:"orientation"`
+	MediaType   string    `db:"media_type"  json:"mediaType"`
+	Latitude    *float64  `db:"latitude"    json:"latitude,omitempty"`
+	Longitude   *float64  `db:"longitude"   json:"longitude,omitempty"`
+	Altitude    *float64  `db:"altitude"    json:"altitude,omitempty"`
 	Created     time.Time `db:"created"     json:"created"`
 	Tags        []*Tag    `db:"-"           json:"tags"`
+	EXIF        *EXIF     `db:"-"           json:"exif,omitempty"`
+
+	// FocusX and FocusY is the focal point set by the user, given as
+	// fractions of the displayed image width and height. Fill renditions
+	// are cropped around it.
+	FocusX *float64 `db:"focus_x" json:"focusX,omitempty"`
+	FocusY *float64 `db:"focus_y" json:"focusY,omitempty"`
+
+	// Title, Caption and AltText are human readable texts describing the
+	// image. AltText is meant for readers that cannot see the image.
+	Title   string `db:"title"    json:"title,omitempty"`
+	Caption string `db:"caption"  json:"caption,omitempty"`
+	AltText string `db:"alt_text" json:"altText,omitempty"`
+
+	// Snippet is HTML of the text fragment that matched full text search,
+	// with matching words marked. It is set only for search results.
+	Snippet string `db:"snippet" json:"snippet,omitempty"`
+
+	// Palette lists dominant colors of the image, from the most common.
+	Palette []*PaletteColor `db:"-" json:"palette,omitempty"`
+	// Quality is nil if the image quality was not measured yet.
+	Quality *Quality `db:"-" json:"quality,omitempty"`
 }
 
 type Tag struct {
 	Name    string    `db:"name"   json:"name"`
 	ImageID string    `db:"image_id" json:"imageId"`
 	Created time.Time `db:"created"  json:"created"`
+	// Auto is true for tags generated by the application, for example from
+	// image location.
+	Auto bool `db:"auto"     json:"auto,omitempty"`
 }
 
 func CreateTag(e sq.Execer, tag Tag) (*Tag, error) {
@@ -27,45 +58,201 @@ func CreateTag(e sq.Execer, tag Tag) (*Tag, error) {
 		tag.Created = time.Now()
 	}
 	_, err := e.Exec(`
-		INSERT INTO tags (image_id, name, created)
-		VALUES (?, ?, ?)
-	`, tag.ImageID, tag.Name, tag.Created)
+		INSERT INTO tags (image_id, name, created, auto)
+		VALUES (?, ?, ?, ?)
+	`, tag.ImageID, tag.Name, tag.Created, tag.Auto)
 	return &tag, sq.CastErr(err)
 }
 
+// DeleteAutoTags remove all automatically generated tags of given image.
+// Tags created by users are not affected.
+func DeleteAutoTags(e sq.Execer, imageID string) error {
+	_, err := e.Exec(`
+		DELETE FROM tags
+		WHERE image_id = ? AND auto
+	`, imageID)
+	return sq.CastErr(err)
+}
+
+// DeleteAllAutoTags remove automatically generated tags of all images. Tags
+// created by users are not affected.
+func DeleteAllAutoTags(e sq.Execer) error {
+	_, err := e.Exec(`DELETE FROM tags WHERE auto`)
+	return sq.CastErr(err)
+}
+
 func Images(s sq.Selector, opts ImagesOpts) ([]*Image, error) {
+	order, ok := imageSorts[opts.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", opts.Sort)
+	}
+
 	var q qb.Query
-	if len(opts.Tags) == 0 {
-		q = qb.Q("SELECT i.* FROM images i")
+	if match := searchQuery(opts.Query); match != "" {
+		q = qb.Q(searchSelect).Where("image_search MATCH ?", match)
+		if opts.Sort == "" {
+			order = "image_search.rank, i.created DESC"
+		}
 	} else {
-		q = qb.Q("SELECT i.* FROM images i INNER JOIN tags t ON i.image_id = t.image_id")
-		for _, name := range opts.Tags {
-			q.Where("t.name = ?", name)
+		q = qb.Q(`
+			SELECT i.* FROM images i
+			LEFT JOIN image_quality q ON q.image_id = i.image_id
+		`)
+	}
+	if opts.Tags != nil {
+		tags, err := resolveTagQuery(s, opts.Tags)
+		if err != nil {
+			return nil, err
+		}
+		cond, args := tags.sql()
+		q.Where(cond, args...)
+	}
+	if opts.Camera != "" {
+		q.Where(`EXISTS (
+			SELECT 1 FROM image_exif e
+			WHERE e.image_id = i.image_id AND (e.make || ' ' || e.model) LIKE ?
+		)`, "%"+opts.Camera+"%")
+	}
+	if opts.Lens != "" {
+		q.Where(`EXISTS (
+			SELECT 1 FROM image_exif e
+			WHERE e.image_id = i.image_id AND e.lens LIKE ?
+		)`, "%"+opts.Lens+"%")
+	}
+	if !opts.CreatedAfter.IsZero() {
+		q.Where("i.created >= ?", opts.CreatedAfter)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		q.Where("i.created < ?", opts.CreatedBefore)
+	}
+	if opts.Geotagged {
+		q.Where("i.latitude IS NOT NULL AND i.longitude IS NOT NULL")
+	}
+	if c := opts.Color; c != nil {
+		distance := opts.ColorDistance
+		if distance <= 0 {
+			distance = DefaultColorDistance
+		}
+		l, a, b := c.Lab()
+		q.Where(`EXISTS (
+			SELECT 1 FROM image_colors c
+			WHERE c.image_id = i.image_id AND c.weight >= ?
+				AND (c.lab_l - ?) * (c.lab_l - ?) + (c.lab_a - ?) * (c.lab_a - ?) + (c.lab_b - ?) * (c.lab_b - ?) <= ?
+		)`, colorMinWeight, l, l, a, a, b, b, distance*distance)
+	}
+	for _, f := range opts.Scores {
+		cond, args := f.sql()
+		q.Where(cond, args...)
+	}
+	if b := opts.BBox; b != nil {
+		q.Where("i.latitude BETWEEN ? AND ?", b.MinLat, b.MaxLat)
+		if b.MinLon <= b.MaxLon {
+			q.Where("i.longitude BETWEEN ? AND ?", b.MinLon, b.MaxLon)
+		} else {
+			// bounding box crosses the antimeridian
+			q.Where("i.longitude >= ? OR i.longitude <= ?", b.MinLon, b.MaxLon)
 		}
 	}
 
-	q.OrderBy("i.created DESC").Limit(opts.Limit, opts.Offset)
+	q.OrderBy(order).Limit(opts.Limit, opts.Offset)
 	query, args := q.Build()
 
 	var imgs []*Image
-	err := s.Select(&imgs, query, args...)
-	return imgs, sq.CastErr(err)
+	if err := s.Select(&imgs, query, args...); err != nil {
+		return nil, sq.CastErr(err)
+	}
+	for _, img := range imgs {
+		img.Snippet = highlight(img.Snippet)
+	}
+	if err := loadDetails(s, imgs); err != nil {
+		return nil, err
+	}
+	return imgs, nil
+}
+
+// loadDetails set information of given images that is kept outside of the
+// images table.
+func loadDetails(s sq.Selector, imgs []*Image) error {
+	if err := loadEXIF(s, imgs); err != nil {
+		return err
+	}
+	if err := loadPalettes(s, imgs); err != nil {
+		return err
+	}
+	return loadQuality(s, imgs)
 }
 
+// DefaultColorDistance is the CIE76 distance within which palette colors
+// are matched, if not set otherwise. Colors this close are recognized as
+// different shades of the same color.
+const DefaultColorDistance = 20
+
 type ImagesOpts struct {
 	Limit  int64
 	Offset int64
-	Tags   []string
+	// Tags, if not nil, restricts result to images matching the query.
+	// Tag aliases are resolved.
+	Tags TagQuery
+	// Camera, if not empty, restricts result to images taken with camera
+	// which make or model contains given text.
+	Camera string
+	// Lens, if not empty, restricts result to images taken with lens which
+	// model contains given text.
+	Lens string
+	// CreatedAfter and CreatedBefore, if not zero, restricts result to
+	// images created within given time window.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Geotagged, if true, restricts result to images with known location.
+	Geotagged bool
+	// BBox, if not nil, restricts result to images located within given
+	// area.
+	BBox *BBox
+	// Color, if not nil, restricts result to images with a dominant color
+	// that is at most ColorDistance from given one. If ColorDistance is not
+	// set, DefaultColorDistance is used.
+	Color         *palette.Color
+	ColorDistance float64
+	// Scores restricts result to images which quality satisfies all
+	// filters.
+	Scores []*ScoreFilter
+	// Query, if not empty, restricts result to images which texts, tags,
+	// places or camera contain all words of the query. Unless sorted
+	// otherwise, the most relevant images are returned first.
+	Query string
+	// Sort is either "created", which is the default, or the name of a
+	// quality score, in which case the worst images are returned first.
+	Sort string
 }
 
 func CreateImage(e sq.Execer, img Image) (*Image, error) {
 	_, err := e.Exec(`
-		INSERT INTO images (image_id, width, height, created, orientation)
-		VALUES (?, ?, ?, ?, ?)
-	`, img.ImageID, img.Width, img.Height, img.Created, img.Orientation)
+		INSERT INTO images (
+			image_id, width, height, created, orientation, media_type,
+			latitude, longitude, altitude
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, img.ImageID, img.Width, img.Height, img.Created, img.Orientation, img.MediaType,
+		img.Latitude, img.Longitude, img.Altitude)
 	return &img, sq.CastErr(err)
 }
 
+// SetImageLocation update geographic position of an image. Altitude is
+// optional.
+func SetImageLocation(e sq.Execer, imageID string, lat, lon float64, alt *float64) error {
+	res, err := e.Exec(`
+		UPDATE images SET latitude = ?, longitude = ?, altitude = ?
+		WHERE image_id = ?
+	`, lat, lon, alt, imageID)
+	if err != nil {
+		return sq.CastErr(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sq.ErrNotFound
+	}
+	return nil
+}
+
 func ImageByID(g sq.Getter, imageID string) (*Image, error) {
 	var img Image
 	err := g.Get(&img, `
@@ -76,6 +263,14 @@ func ImageByID(g sq.Getter, imageID string) (*Image, error) {
 	if err != nil {
 		return nil, sq.CastErr(err)
 	}
+	switch ex, err := ImageEXIF(g, imageID); err {
+	case nil:
+		img.EXIF = ex
+	case sq.ErrNotFound:
+		// camera settings are not known
+	default:
+		return nil, err
+	}
 	return &img, nil
 }
 
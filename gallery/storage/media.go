@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	// register all supported image formats
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+type mediaType struct {
+	format    string
+	mediaType string
+	ext       string
+	exif      bool
+}
+
+// mediaTypes list all image formats that can be uploaded. Format name is the
+// one returned by image.DecodeConfig.
+var mediaTypes = []mediaType{
+	{format: "jpeg", mediaType: "image/jpeg", ext: ".jpg", exif: true},
+	{format: "png", mediaType: "image/png", ext: ".png"},
+	{format: "gif", mediaType: "image/gif", ext: ".gif"},
+	{format: "tiff", mediaType: "image/tiff", ext: ".tiff", exif: true},
+	{format: "bmp", mediaType: "image/bmp", ext: ".bmp"},
+}
+
+// DefaultMediaType is used for images that were stored before media type
+// information was tracked.
+const DefaultMediaType = "image/jpeg"
+
+// detectMediaType read image configuration from given reader and return
+// description of its format.
+func detectMediaType(r io.Reader) (image.Config, *mediaType, error) {
+	conf, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return conf, nil, fmt.Errorf("cannot decode image: %s", err)
+	}
+	for i := range mediaTypes {
+		if mediaTypes[i].format == format {
+			return conf, &mediaTypes[i], nil
+		}
+	}
+	return conf, nil, fmt.Errorf("unsupported image format: %s", format)
+}
+
+// mediaTypeExt return file extension that should be used for image of given
+// media type.
+func mediaTypeExt(mt string) string {
+	if mt == "" {
+		mt = DefaultMediaType
+	}
+	for _, m := range mediaTypes {
+		if m.mediaType == mt {
+			return m.ext
+		}
+	}
+	return ".jpg"
+}
+
+// HasEXIF return true if images of given media type can contain EXIF
+// metadata.
+func HasEXIF(mt string) bool {
+	if mt == "" {
+		mt = DefaultMediaType
+	}
+	for _, m := range mediaTypes {
+		if m.mediaType == mt {
+			return m.exif
+		}
+	}
+	return false
+}
+
+// UploadAccept return comma separated list of file extensions and media types
+// accepted by the uploader, suitable for HTML input's accept attribute.
+func UploadAccept() string {
+	var s string
+	for _, m := range mediaTypes {
+		s += m.ext + "," + m.mediaType + ","
+	}
+	return s[:len(s)-1]
+}
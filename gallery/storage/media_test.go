@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func TestDetectMediaType(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 12, 7))
+
+	cases := map[string]struct {
+		encode        func(io.Writer, image.Image) error
+		wantMediaType string
+		wantExt       string
+	}{
+		"jpeg": {
+			encode:        func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) },
+			wantMediaType: "image/jpeg",
+			wantExt:       ".jpg",
+		},
+		"png": {
+			encode:        png.Encode,
+			wantMediaType: "image/png",
+			wantExt:       ".png",
+		},
+		"gif": {
+			encode:        func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) },
+			wantMediaType: "image/gif",
+			wantExt:       ".gif",
+		},
+		"tiff": {
+			encode:        func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) },
+			wantMediaType: "image/tiff",
+			wantExt:       ".tiff",
+		},
+		"bmp": {
+			encode:        bmp.Encode,
+			wantMediaType: "image/bmp",
+			wantExt:       ".bmp",
+		},
+	}
+
+	for tname, tc := range cases {
+		var b bytes.Buffer
+		if err := tc.encode(&b, img); err != nil {
+			t.Errorf("%s: cannot encode: %s", tname, err)
+			continue
+		}
+		conf, mt, err := detectMediaType(&b)
+		if err != nil {
+			t.Errorf("%s: cannot detect: %s", tname, err)
+			continue
+		}
+		if conf.Width != 12 || conf.Height != 7 {
+			t.Errorf("%s: want 12x7 image, got %dx%d", tname, conf.Width, conf.Height)
+		}
+		if mt.mediaType != tc.wantMediaType {
+			t.Errorf("%s: want %q media type, got %q", tname, tc.wantMediaType, mt.mediaType)
+		}
+		if ext := mediaTypeExt(mt.mediaType); ext != tc.wantExt {
+			t.Errorf("%s: want %q extension, got %q", tname, tc.wantExt, ext)
+		}
+	}
+
+	if _, _, err := detectMediaType(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Error("want error for invalid content")
+	}
+}
@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Migrate upgrade database created with an older version of schema.sql, by
+// adding missing columns, tables, indexes and triggers. Database that is up to
+// date is not modified, so it is safe to call it on every start. Database
+// without any schema is left untouched, schema.sql must be loaded first.
+func Migrate(db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if ok, err := schemaObjectExists(tx, "images"); err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+	hasSearch, err := schemaObjectExists(tx, "image_search")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range migrateColumns {
+		columns, err := tableColumns(tx, c.table)
+		if err != nil {
+			return err
+		}
+		if columns[c.name] {
+			continue
+		}
+		if _, err := tx.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.name + ` ` + c.definition); err != nil {
+			return fmt.Errorf("cannot add %s.%s column: %s", c.table, c.name, err)
+		}
+	}
+	for _, stmt := range migrateObjects {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("cannot create schema: %s", err)
+		}
+	}
+	if !hasSearch {
+		// title is the most relevant, camera the least
+		if _, err := tx.Exec(`INSERT INTO image_search(image_search, rank) VALUES('rank', 'bm25(10.0, 5.0, 5.0, 3.0, 1.0)')`); err != nil {
+			return fmt.Errorf("cannot configure search index: %s", err)
+		}
+		if err := RebuildSearchIndex(tx); err != nil {
+			return fmt.Errorf("cannot rebuild search index: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit transaction: %s", err)
+	}
+	return nil
+}
+
+func schemaObjectExists(tx *sqlx.Tx, name string) (bool, error) {
+	var n int
+	if err := tx.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE name = ?`, name); err != nil {
+		return false, fmt.Errorf("cannot inspect schema: %s", err)
+	}
+	return n != 0, nil
+}
+
+// tableColumns return set of column names of given table.
+func tableColumns(tx *sqlx.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, fmt.Errorf("cannot inspect %s table: %s", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("cannot inspect %s table: %s", table, err)
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// migrateColumns list columns added to tables that exist since the first
+// version of the schema.
+var migrateColumns = []struct {
+	table      string
+	name       string
+	definition string
+}{
+	{"images", "media_type", `TEXT NOT NULL DEFAULT 'image/jpeg'`},
+	{"images", "latitude", `REAL`},
+	{"images", "longitude", `REAL`},
+	{"images", "altitude", `REAL`},
+	{"images", "focus_x", `REAL`},
+	{"images", "focus_y", `REAL`},
+	{"images", "title", `TEXT NOT NULL DEFAULT ''`},
+	{"images", "caption", `TEXT NOT NULL DEFAULT ''`},
+	{"images", "alt_text", `TEXT NOT NULL DEFAULT ''`},
+	{"tags", "auto", `BOOLEAN NOT NULL DEFAULT 0`},
+}
+
+// migrateObjects create everything that was added to schema.sql after its
+// first version. Must be kept in sync with schema.sql.
+var migrateObjects = []string{
+	`CREATE INDEX IF NOT EXISTS images_location_idx ON images(latitude, longitude)`,
+
+	`CREATE TABLE IF NOT EXISTS tag_aliases (
+		alias        TEXT NOT NULL PRIMARY KEY,
+		name         TEXT NOT NULL,
+		created      TIMESTAMP NOT NULL
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS image_exif (
+		image_id      TEXT NOT NULL PRIMARY KEY REFERENCES images(image_id),
+		make          TEXT NOT NULL DEFAULT '',
+		model         TEXT NOT NULL DEFAULT '',
+		lens          TEXT NOT NULL DEFAULT '',
+		focal_length  REAL NOT NULL DEFAULT 0,
+		aperture      REAL NOT NULL DEFAULT 0,
+		exposure_time REAL NOT NULL DEFAULT 0,
+		iso           INTEGER NOT NULL DEFAULT 0,
+		flash         BOOLEAN NOT NULL DEFAULT 0,
+		software      TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS image_exif_model_idx ON image_exif(make, model)`,
+
+	`CREATE TABLE IF NOT EXISTS image_hashes (
+		image_id      TEXT NOT NULL PRIMARY KEY REFERENCES images(image_id),
+		dhash         INTEGER NOT NULL
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS image_colors (
+		image_id      TEXT NOT NULL REFERENCES images(image_id),
+		position      INTEGER NOT NULL,
+		color         TEXT NOT NULL,
+		weight        REAL NOT NULL,
+		lab_l         REAL NOT NULL,
+		lab_a         REAL NOT NULL,
+		lab_b         REAL NOT NULL,
+
+		PRIMARY KEY(image_id, position)
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS image_quality (
+		image_id      TEXT NOT NULL PRIMARY KEY REFERENCES images(image_id),
+		quality       REAL NOT NULL,
+		sharpness     REAL NOT NULL,
+		exposure      REAL NOT NULL,
+		brightness    REAL NOT NULL,
+		shadows       REAL NOT NULL,
+		highlights    REAL NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS image_quality_quality_idx ON image_quality(quality)`,
+
+	`CREATE VIEW IF NOT EXISTS image_search_source AS
+		SELECT
+			i.image_id,
+			trim(i.title || ' ' || i.alt_text) AS title,
+			i.caption,
+			coalesce((SELECT group_concat(t.name, ' ') FROM tags t WHERE t.image_id = i.image_id AND NOT t.auto), '') AS tags,
+			coalesce((SELECT group_concat(t.name, ' ') FROM tags t WHERE t.image_id = i.image_id AND t.auto), '') AS places,
+			coalesce((SELECT trim(e.make || ' ' || e.model || ' ' || e.lens) FROM image_exif e WHERE e.image_id = i.image_id), '') AS camera
+		FROM images i`,
+
+	`CREATE TABLE IF NOT EXISTS image_search_docs (
+		docid         INTEGER PRIMARY KEY,
+		image_id      TEXT NOT NULL UNIQUE,
+		title         TEXT NOT NULL,
+		caption       TEXT NOT NULL,
+		tags          TEXT NOT NULL,
+		places        TEXT NOT NULL,
+		camera        TEXT NOT NULL
+	)`,
+
+	`CREATE VIRTUAL TABLE IF NOT EXISTS image_search USING fts5(
+		title, caption, tags, places, camera,
+		content = 'image_search_docs',
+		content_rowid = 'docid',
+		tokenize = 'unicode61 remove_diacritics 2'
+	)`,
+
+	`CREATE TRIGGER IF NOT EXISTS image_search_docs_ai AFTER INSERT ON image_search_docs BEGIN
+		INSERT INTO image_search (rowid, title, caption, tags, places, camera)
+		VALUES (new.docid, new.title, new.caption, new.tags, new.places, new.camera);
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS image_search_docs_ad AFTER DELETE ON image_search_docs BEGIN
+		INSERT INTO image_search (image_search, rowid, title, caption, tags, places, camera)
+		VALUES ('delete', old.docid, old.title, old.caption, old.tags, old.places, old.camera);
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS images_search_ai AFTER INSERT ON images BEGIN
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id = new.image_id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS images_search_au AFTER UPDATE OF title, caption, alt_text ON images BEGIN
+		DELETE FROM image_search_docs WHERE image_id = new.image_id;
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id = new.image_id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS images_search_ad AFTER DELETE ON images BEGIN
+		DELETE FROM image_search_docs WHERE image_id = old.image_id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS tags_search_ai AFTER INSERT ON tags BEGIN
+		DELETE FROM image_search_docs WHERE image_id = new.image_id;
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id = new.image_id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS tags_search_au AFTER UPDATE ON tags BEGIN
+		DELETE FROM image_search_docs WHERE image_id IN (old.image_id, new.image_id);
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id IN (old.image_id, new.image_id);
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS tags_search_ad AFTER DELETE ON tags BEGIN
+		DELETE FROM image_search_docs WHERE image_id = old.image_id;
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id = old.image_id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS image_exif_search_ai AFTER INSERT ON image_exif BEGIN
+		DELETE FROM image_search_docs WHERE image_id = new.image_id;
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id = new.image_id;
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS image_exif_search_au AFTER UPDATE ON image_exif BEGIN
+		DELETE FROM image_search_docs WHERE image_id IN (old.image_id, new.image_id);
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id IN (old.image_id, new.image_id);
+	END`,
+
+	`CREATE TRIGGER IF NOT EXISTS image_exif_search_ad AFTER DELETE ON image_exif BEGIN
+		DELETE FROM image_search_docs WHERE image_id = old.image_id;
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source WHERE image_id = old.image_id;
+	END`,
+}
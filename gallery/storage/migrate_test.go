@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// firstSchema is the first version of schema.sql.
+const firstSchema = `
+CREATE TABLE images (
+    image_id      TEXT NOT NULL PRIMARY KEY,
+    width         INTEGER NOT NULL,
+    height        INTEGER NOT NULL,
+    orientation   INTEGER NOT NULL,
+    created       TIMESTAMP NOT NULL
+);
+
+CREATE TABLE tags (
+    name         TEXT NOT NULL,
+    image_id     TEXT NOT NULL REFERENCES images(image_id),
+    created      TIMESTAMP NOT NULL,
+
+    PRIMARY KEY(name, image_id)
+);
+`
+
+func TestMigrate(t *testing.T) {
+	db, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("cannot open database: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(firstSchema); err != nil {
+		t.Fatalf("cannot create schema: %s", err)
+	}
+	now := time.Now()
+	if _, err := db.Exec(`INSERT INTO images VALUES ('old', 10, 20, 1, ?)`, now); err != nil {
+		t.Fatalf("cannot create image: %s", err)
+	}
+	if _, err := db.Exec(`INSERT INTO tags VALUES ('lighthouse', 'old', ?)`, now); err != nil {
+		t.Fatalf("cannot create tag: %s", err)
+	}
+
+	// second migration must not change anything
+	for i := 0; i < 2; i++ {
+		if err := Migrate(db); err != nil {
+			t.Fatalf("cannot migrate: %s", err)
+		}
+	}
+
+	current := newTestDB(t)
+	defer current.Close()
+	if got, want := schemaObjects(t, db), schemaObjects(t, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v schema objects, got %v", want, got)
+	}
+	for _, table := range []string{"images", "tags"} {
+		if got, want := schemaColumns(t, db, table), schemaColumns(t, current, table); !reflect.DeepEqual(got, want) {
+			t.Errorf("want %s columns %v, got %v", table, want, got)
+		}
+	}
+
+	img, err := ImageByID(db, "old")
+	if err != nil {
+		t.Fatalf("cannot get image: %s", err)
+	}
+	if img.MediaType != "image/jpeg" || img.Title != "" {
+		t.Errorf("want jpeg image without title, got %+v", img)
+	}
+	if tags, err := ImageTags(db, "old"); err != nil || len(tags) != 1 || tags[0].Auto {
+		t.Errorf("want user created tag, got %v: %v", tags, err)
+	}
+	if _, err := CreateImage(db, Image{ImageID: "new", Width: 1, Height: 1, Created: now}); err != nil {
+		t.Fatalf("cannot create image: %s", err)
+	}
+	if _, err := CreateTag(db, Tag{ImageID: "new", Name: "Gdańsk", Auto: true}); err != nil {
+		t.Fatalf("cannot create tag: %s", err)
+	}
+	for query, want := range map[string]string{"lighthouse": "old", "gdansk": "new"} {
+		imgs, err := Images(db, ImagesOpts{Limit: 10, Query: query})
+		if err != nil {
+			t.Fatalf("%s: cannot search: %s", query, err)
+		}
+		if len(imgs) != 1 || imgs[0].ImageID != want {
+			t.Errorf("%s: want %s image found, got %v", query, want, imgs)
+		}
+	}
+}
+
+func schemaObjects(t *testing.T, db *sqlx.DB) []string {
+	t.Helper()
+	var names []string
+	if err := db.Select(&names, `SELECT type || ' ' || name FROM sqlite_master ORDER BY type, name`); err != nil {
+		t.Fatalf("cannot list schema: %s", err)
+	}
+	return names
+}
+
+func schemaColumns(t *testing.T, db *sqlx.DB, table string) []string {
+	t.Helper()
+	var columns []string
+	if err := db.Select(&columns, `SELECT name || ' ' || type || ' ' || "notnull" || ' ' || coalesce(dflt_value, '') FROM pragma_table_info(?) ORDER BY name`, table); err != nil {
+		t.Fatalf("cannot list %s columns: %s", table, err)
+	}
+	return columns
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/husio/gallery/sq"
+)
+
+// PlaceFinder return names of places at given location, for example country
+// and city name.
+type PlaceFinder interface {
+	Places(lat, lon float64) []string
+}
+
+// TagPlaces replace automatically generated tags of an image with names of
+// places found at its location. Image without location loses all
+// automatically generated tags. If a user already tagged the image with the
+// same name, that tag is left untouched.
+func TagPlaces(e sq.Execer, places PlaceFinder, img *Image) ([]string, error) {
+	if err := DeleteAutoTags(e, img.ImageID); err != nil {
+		return nil, fmt.Errorf("cannot delete automatic tags: %s", err)
+	}
+	if img.Latitude == nil || img.Longitude == nil {
+		return nil, nil
+	}
+
+	var created []string
+	now := time.Now()
+	for _, name := range places.Places(*img.Latitude, *img.Longitude) {
+		_, err := CreateTag(e, Tag{
+			ImageID: img.ImageID,
+			Name:    name,
+			Created: now,
+			Auto:    true,
+		})
+		switch err {
+		case nil:
+			created = append(created, name)
+		case sq.ErrConflict:
+			// already tagged by user
+		default:
+			return created, fmt.Errorf("cannot create %q tag: %s", name, err)
+		}
+	}
+	return created, nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/husio/gallery/gallery/quality"
+	"github.com/husio/gallery/sq"
+)
+
+// Quality describe technical quality of an image. All scores are within 0..1
+// range, the higher the better.
+type Quality struct {
+	ImageID string `db:"image_id" json:"-"`
+	// Score is the overall quality, the lowest of sharpness and exposure
+	// scores.
+	Score      float64 `db:"quality"    json:"score"`
+	Sharpness  float64 `db:"sharpness"  json:"sharpness"`
+	Exposure   float64 `db:"exposure"   json:"exposure"`
+	Brightness float64 `db:"brightness" json:"brightness"`
+	Shadows    float64 `db:"shadows"    json:"shadows"`
+	Highlights float64 `db:"highlights" json:"highlights"`
+}
+
+func newQuality(imageID string, s quality.Scores) *Quality {
+	return &Quality{
+		ImageID:    imageID,
+		Score:      s.Quality(),
+		Sharpness:  s.Sharpness,
+		Exposure:   s.Exposure,
+		Brightness: s.Brightness,
+		Shadows:    s.Shadows,
+		Highlights: s.Highlights,
+	}
+}
+
+// ImageQuality return quality scores of given image content.
+func ImageQuality(fs *FileStore, img *Image) (quality.Scores, error) {
+	src, err := analysisImage(fs, img, quality.AnalysisSize)
+	if err != nil {
+		return quality.Scores{}, err
+	}
+	return quality.Measure(src), nil
+}
+
+// PutImageQuality store quality scores of an image, replacing previous
+// values if any exist.
+func PutImageQuality(e sq.Execer, imageID string, s quality.Scores) error {
+	q := newQuality(imageID, s)
+	_, err := e.Exec(`
+		INSERT OR REPLACE INTO image_quality (
+			image_id, quality, sharpness, exposure, brightness, shadows, highlights
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, q.ImageID, q.Score, q.Sharpness, q.Exposure, q.Brightness, q.Shadows, q.Highlights)
+	return sq.CastErr(err)
+}
+
+// ImagesWithoutQuality return images that quality was not measured for.
+func ImagesWithoutQuality(s sq.Selector, limit int64) ([]*Image, error) {
+	var imgs []*Image
+	err := s.Select(&imgs, `
+		SELECT i.* FROM images i
+		WHERE NOT EXISTS (
+			SELECT 1 FROM image_quality q
+			WHERE q.image_id = i.image_id
+		)
+		ORDER BY i.created DESC
+		LIMIT ?
+	`, limit)
+	return imgs, sq.CastErr(err)
+}
+
+// loadQuality set quality of all given images that it was measured for.
+func loadQuality(s sq.Selector, imgs []*Image) error {
+	byID := make(map[string]*Image, len(imgs))
+	ids := make([]string, len(imgs))
+	for i, img := range imgs {
+		byID[img.ImageID] = img
+		ids[i] = img.ImageID
+	}
+	return inBatches(ids, func(placeholders string, args []interface{}) error {
+		var scores []*Quality
+		query := fmt.Sprintf(`
+			SELECT * FROM image_quality
+			WHERE image_id IN (%s)
+		`, placeholders)
+		if err := s.Select(&scores, query, args...); err != nil {
+			return sq.CastErr(err)
+		}
+		for _, q := range scores {
+			byID[q.ImageID].Quality = q
+		}
+		return nil
+	})
+}
+
+// scoreColumns maps score names to image_quality columns.
+var scoreColumns = map[string]string{
+	"quality":   "q.quality",
+	"sharpness": "q.sharpness",
+	"exposure":  "q.exposure",
+}
+
+// ScoreFilter restricts images to those with given quality score lower or
+// greater than a value.
+type ScoreFilter struct {
+	// Score is one of quality, sharpness or exposure.
+	Score string
+	// Op is one of <, <=, > or >=.
+	Op    string
+	Value float64
+}
+
+var scoreFilterRx = regexp.MustCompile(`^\s*(\w+)\s*(<=|>=|<|>)\s*([0-9.]+)\s*$`)
+
+// ParseScoreFilter return filter described by a comparison, for example
+// "quality<0.2" or "sharpness >= 0.5".
+func ParseScoreFilter(raw string) (*ScoreFilter, error) {
+	m := scoreFilterRx.FindStringSubmatch(raw)
+	if m == nil {
+		return nil, fmt.Errorf("invalid score filter %q", raw)
+	}
+	if _, ok := scoreColumns[m[1]]; !ok {
+		return nil, fmt.Errorf("unknown score %q", m[1])
+	}
+	value, err := strconv.ParseFloat(m[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid score value %q", m[3])
+	}
+	return &ScoreFilter{Score: m[1], Op: m[2], Value: value}, nil
+}
+
+func (f *ScoreFilter) String() string {
+	return f.Score + f.Op + strconv.FormatFloat(f.Value, 'f', -1, 64)
+}
+
+// sql return condition matching images that satisfy the filter. Images which
+// quality was not measured never match.
+func (f *ScoreFilter) sql() (string, []interface{}) {
+	return fmt.Sprintf("%s %s ?", scoreColumns[f.Score], f.Op), []interface{}{f.Value}
+}
+
+// imageSorts maps sort names accepted by ImagesOpts to ORDER BY clauses.
+// Sorting by a score returns the worst images first, images which quality
+// was not measured are returned last.
+var imageSorts = map[string]string{
+	"":          "i.created DESC",
+	"created":   "i.created DESC",
+	"quality":   "q.quality IS NULL, q.quality, i.created DESC",
+	"sharpness": "q.sharpness IS NULL, q.sharpness, i.created DESC",
+	"exposure":  "q.exposure IS NULL, q.exposure, i.created DESC",
+}
+
+// ValidSort return true if images can be sorted by given name.
+func ValidSort(name string) bool {
+	_, ok := imageSorts[name]
+	return ok
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/gallery/quality"
+)
+
+func TestParseScoreFilter(t *testing.T) {
+	cases := map[string]struct {
+		raw     string
+		want    *ScoreFilter
+		wantErr bool
+	}{
+		"less":          {raw: "quality<0.2", want: &ScoreFilter{Score: "quality", Op: "<", Value: 0.2}},
+		"spaces":        {raw: " sharpness >= 0.5 ", want: &ScoreFilter{Score: "sharpness", Op: ">=", Value: 0.5}},
+		"integer":       {raw: "exposure>1", want: &ScoreFilter{Score: "exposure", Op: ">", Value: 1}},
+		"unknown score": {raw: "beauty<0.2", wantErr: true},
+		"unknown op":    {raw: "quality=0.2", wantErr: true},
+		"no value":      {raw: "quality<", wantErr: true},
+		"invalid value": {raw: "quality<0.2.1", wantErr: true},
+		"injection":     {raw: "quality<0.2 OR 1", wantErr: true},
+	}
+
+	for tname, tc := range cases {
+		got, err := ParseScoreFilter(tc.raw)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %v", tname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tname, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %+v, got %+v", tname, tc.want, got)
+		}
+	}
+}
+
+func TestImagesQuality(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	scores := map[string]*quality.Scores{
+		"sharp":   {Sharpness: 0.9, Exposure: 0.8},
+		"blurred": {Sharpness: 0.1, Exposure: 0.9},
+		"dark":    {Sharpness: 0.7, Exposure: 0.3},
+		"unknown": nil,
+	}
+	now := time.Now()
+	for id, s := range scores {
+		if _, err := CreateImage(db, Image{ImageID: id, Width: 1, Height: 1, Created: now}); err != nil {
+			t.Fatalf("cannot create %s image: %s", id, err)
+		}
+		if s != nil {
+			if err := PutImageQuality(db, id, *s); err != nil {
+				t.Fatalf("cannot store %s quality: %s", id, err)
+			}
+		}
+	}
+
+	cases := map[string]struct {
+		opts ImagesOpts
+		want []string
+	}{
+		"worst first": {
+			opts: ImagesOpts{Sort: "quality"},
+			want: []string{"blurred", "dark", "sharp", "unknown"},
+		},
+		"least exposed first": {
+			opts: ImagesOpts{Sort: "exposure"},
+			want: []string{"dark", "sharp", "blurred", "unknown"},
+		},
+		"rejects": {
+			opts: ImagesOpts{Sort: "quality", Scores: []*ScoreFilter{{Score: "quality", Op: "<", Value: 0.2}}},
+			want: []string{"blurred"},
+		},
+		"all filters must match": {
+			opts: ImagesOpts{Sort: "sharpness", Scores: []*ScoreFilter{
+				{Score: "sharpness", Op: ">=", Value: 0.5},
+				{Score: "exposure", Op: ">", Value: 0.5},
+			}},
+			want: []string{"sharp"},
+		},
+	}
+	for tname, tc := range cases {
+		tc.opts.Limit = 10
+		imgs, err := Images(db, tc.opts)
+		if err != nil {
+			t.Errorf("%s: cannot list images: %s", tname, err)
+			continue
+		}
+		var got []string
+		for _, img := range imgs {
+			got = append(got, img.ImageID)
+			if (img.Quality == nil) != (scores[img.ImageID] == nil) {
+				t.Errorf("%s: unexpected %s quality %v", tname, img.ImageID, img.Quality)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+		}
+	}
+
+	if _, err := Images(db, ImagesOpts{Sort: "beauty"}); err == nil {
+		t.Errorf("want unknown sort error")
+	}
+
+	imgs, err := ImagesWithoutQuality(db, -1)
+	if err != nil {
+		t.Fatalf("cannot list images without quality: %s", err)
+	}
+	if len(imgs) != 1 || imgs[0].ImageID != "unknown" {
+		t.Errorf("want only unknown image without quality, got %v", imgs)
+	}
+}
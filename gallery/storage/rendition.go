@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/husio/gallery/gallery/crop"
+)
+
+// ThumbnailPreset is the name of the rendition preset used for thumbnails.
+// It must always be defined.
+const ThumbnailPreset = "thumb"
+
+// DefaultPresets is the default rendition configuration.
+const DefaultPresets = "small:100x100:fill:85,thumb:200x200:fill:85,medium:1280x1280:fit:85,large:2560x2560:fit:90"
+
+// Preset describe how a rendition of an image is created.
+type Preset struct {
+	Name   string
+	Width  int
+	Height int
+	// Fill is true if rendition is cropped to exactly given size. Otherwise
+	// image is scaled down to fit into given size, keeping its aspect ratio.
+	Fill bool
+	// Quality of JPEG encoding, 1 to 100.
+	Quality int
+}
+
+func (p Preset) String() string {
+	mode := "fit"
+	if p.Fill {
+		mode = "fill"
+	}
+	return fmt.Sprintf("%s:%dx%d:%s:%d", p.Name, p.Width, p.Height, mode, p.Quality)
+}
+
+// render return rendition of given, already correctly oriented content of
+// the image. Fill renditions are cropped around the image focal point if set,
+// otherwise around the most detailed region.
+func (p Preset) render(src image.Image, img *Image) image.Image {
+	if p.Fill {
+		// focal point set by the user is more reliable than the guess
+		var region image.Rectangle
+		if img.FocusX != nil && img.FocusY != nil {
+			region = crop.Around(src.Bounds(), p.Width, p.Height, *img.FocusX, *img.FocusY)
+		} else {
+			region = crop.Detailed(src, p.Width, p.Height)
+		}
+		return imaging.Resize(imaging.Crop(src, region), p.Width, p.Height, imaging.Linear)
+	}
+	b := src.Bounds()
+	if b.Dx() <= p.Width && b.Dy() <= p.Height {
+		return src
+	}
+	return imaging.Fit(src, p.Width, p.Height, imaging.Linear)
+}
+
+// scale return the factor by which image of given size is scaled when
+// creating the rendition. Images are never scaled up, except of fill presets
+// bigger than the image.
+func (p Preset) scale(width, height int) float64 {
+	sw := float64(p.Width) / float64(width)
+	sh := float64(p.Height) / float64(height)
+	scale := math.Min(sw, sh)
+	if p.Fill {
+		scale = math.Max(sw, sh)
+	}
+	return math.Min(scale, 1)
+}
+
+func (p Preset) jpegOptions() *jpeg.Options {
+	return &jpeg.Options{Quality: p.Quality}
+}
+
+// Presets is a list of rendition presets.
+type Presets []Preset
+
+// ParsePresets parse comma separated list of presets, each in format
+//
+//	name:<width>x<height>:<fill|fit>:<quality>
+//
+// for example "thumb:200x200:fill:85,medium:1280x1280:fit:85". Preset named
+// "thumb" is required.
+func ParsePresets(s string) (Presets, error) {
+	var presets Presets
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		chunks := strings.Split(raw, ":")
+		if len(chunks) != 4 {
+			return nil, fmt.Errorf("invalid preset %q", raw)
+		}
+		p := Preset{Name: chunks[0]}
+		// name is part of the rendition file name, separated from
+		// the image ID with a dash
+		if p.Name == "" || strings.ContainsAny(p.Name, "/.- ") {
+			return nil, fmt.Errorf("invalid preset name %q", p.Name)
+		}
+		if _, ok := presets.Get(p.Name); ok {
+			return nil, fmt.Errorf("duplicated preset %q", p.Name)
+		}
+		if _, err := fmt.Sscanf(chunks[1], "%dx%d", &p.Width, &p.Height); err != nil || p.Width <= 0 || p.Height <= 0 {
+			return nil, fmt.Errorf("invalid preset %q size: %s", p.Name, chunks[1])
+		}
+		switch chunks[2] {
+		case "fill":
+			p.Fill = true
+		case "fit":
+			// default
+		default:
+			return nil, fmt.Errorf("invalid preset %q mode: %s", p.Name, chunks[2])
+		}
+		q, err := strconv.Atoi(chunks[3])
+		if err != nil || q < 1 || q > 100 {
+			return nil, fmt.Errorf("invalid preset %q quality: %s", p.Name, chunks[3])
+		}
+		p.Quality = q
+		presets = append(presets, p)
+	}
+	if _, ok := presets.Get(ThumbnailPreset); !ok {
+		return nil, fmt.Errorf("%q preset is required", ThumbnailPreset)
+	}
+	return presets, nil
+}
+
+// Get return preset with given name.
+func (ps Presets) Get(name string) (Preset, bool) {
+	for _, p := range ps {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// Alternatives return all fill presets with the same aspect ratio as the
+// preset with given name, ordered by width. Returned presets can be used
+// interchangeably on screens of different pixel density.
+func (ps Presets) Alternatives(name string) Presets {
+	base, ok := ps.Get(name)
+	if !ok || !base.Fill {
+		return nil
+	}
+	var alt Presets
+	for _, p := range ps {
+		if p.Fill && p.Width*base.Height == p.Height*base.Width {
+			alt = append(alt, p)
+		}
+	}
+	sort.Slice(alt, func(i, j int) bool { return alt[i].Width < alt[j].Width })
+	return alt
+}
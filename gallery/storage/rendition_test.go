@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"reflect"
+	"testing"
+)
+
+func TestParsePresets(t *testing.T) {
+	presets, err := ParsePresets(DefaultPresets)
+	if err != nil {
+		t.Fatalf("cannot parse default presets: %s", err)
+	}
+	want := Presets{
+		{Name: "small", Width: 100, Height: 100, Fill: true, Quality: 85},
+		{Name: "thumb", Width: 200, Height: 200, Fill: true, Quality: 85},
+		{Name: "medium", Width: 1280, Height: 1280, Quality: 85},
+		{Name: "large", Width: 2560, Height: 2560, Quality: 90},
+	}
+	if !reflect.DeepEqual(presets, want) {
+		t.Errorf("want %v, got %v", want, presets)
+	}
+	if alt := presets.Alternatives("thumb"); !reflect.DeepEqual(alt, want[:2]) {
+		t.Errorf("want thumbnail alternatives %v, got %v", want[:2], alt)
+	}
+
+	invalid := map[string]string{
+		"no_thumb":        "medium:1280x1280:fit:85",
+		"missing_quality": "thumb:200x200:fill",
+		"invalid_size":    "thumb:200:fill:85",
+		"invalid_mode":    "thumb:200x200:crop:85",
+		"invalid_quality": "thumb:200x200:fill:101",
+		"invalid_name":    "../thumb:200x200:fill:85",
+		"dash_in_name":    "thumb-2x:400x400:fill:85",
+		"duplicated":      "thumb:200x200:fill:85,thumb:100x100:fill:85",
+	}
+	for tname, s := range invalid {
+		if p, err := ParsePresets(s); err == nil {
+			t.Errorf("%s: want error, got %v", tname, p)
+		}
+	}
+}
+
+func TestPresetRender(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 300))
+
+	cases := map[string]struct {
+		preset     Preset
+		wantWidth  int
+		wantHeight int
+	}{
+		"fill": {
+			preset:     Preset{Width: 200, Height: 200, Fill: true},
+			wantWidth:  200,
+			wantHeight: 200,
+		},
+		"fit": {
+			preset:     Preset{Width: 200, Height: 200},
+			wantWidth:  200,
+			wantHeight: 150,
+		},
+		"fit_no_upscale": {
+			preset:     Preset{Width: 1280, Height: 1280},
+			wantWidth:  400,
+			wantHeight: 300,
+		},
+	}
+
+	for tname, tc := range cases {
+		b := tc.preset.render(src, &Image{}).Bounds()
+		if b.Dx() != tc.wantWidth || b.Dy() != tc.wantHeight {
+			t.Errorf("%s: want %dx%d, got %dx%d", tname, tc.wantWidth, tc.wantHeight, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestPresetRenderFocus(t *testing.T) {
+	// left half is red and right half is blue
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	draw.Draw(src, image.Rect(0, 0, 200, 100), &image.Uniform{color.RGBA{255, 0, 0, 255}}, image.ZP, draw.Src)
+	draw.Draw(src, image.Rect(200, 0, 400, 100), &image.Uniform{color.RGBA{0, 0, 255, 255}}, image.ZP, draw.Src)
+
+	left, right, middle := 0.1, 0.9, 0.5
+	p := Preset{Width: 50, Height: 50, Fill: true}
+
+	cases := map[string]struct {
+		focusX  float64
+		wantRed bool
+	}{
+		"left":  {focusX: left, wantRed: true},
+		"right": {focusX: right, wantRed: false},
+	}
+	for tname, tc := range cases {
+		x := tc.focusX
+		img := p.render(src, &Image{FocusX: &x, FocusY: &middle})
+		r, _, b, _ := img.At(25, 25).RGBA()
+		if isRed := r > b; isRed != tc.wantRed {
+			t.Errorf("%s: want red %v, got %v", tname, tc.wantRed, isRed)
+		}
+	}
+}
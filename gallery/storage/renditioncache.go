@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RenditionCache limit the total size of renditions kept in the underlying
+// store. Once the limit is exceeded, least recently used renditions are
+// deleted by the sweeper. Deleted renditions are created again on the next
+// read.
+//
+// Access is tracked in memory only. When the cache is created, renditions
+// already present in the store are ordered by their modification time.
+type RenditionCache struct {
+	store   RenditionStore
+	maxSize int64
+	// sweep is signaled when the cache grows above the limit
+	sweep chan struct{}
+
+	mu sync.Mutex
+	// lru is ordered from the most to the least recently used entry
+	lru     *list.List
+	entries map[string]map[string]*list.Element
+	// busy contains renditions that are being written or deleted, so that
+	// writing and deleting the same rendition never overlap
+	busy      map[renditionKey]chan struct{}
+	size      int64
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cacheEntry struct {
+	img    *Image
+	preset string
+	size   int64
+	// fresh is true until the entry is read for the first time after it
+	// was created, so that reading just created rendition is not a hit
+	fresh bool
+}
+
+type renditionKey struct {
+	imageID string
+	preset  string
+}
+
+// NewRenditionCache return cache limiting given store to maxSize bytes.
+// Renditions already present in the store are accounted for.
+func NewRenditionCache(store RenditionStore, maxSize int64) (*RenditionCache, error) {
+	var found []RenditionInfo
+	err := store.Walk(func(r RenditionInfo) error {
+		found = append(found, r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list renditions: %s", err)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Modified.Before(found[j].Modified)
+	})
+
+	c := &RenditionCache{
+		store:   store,
+		maxSize: maxSize,
+		sweep:   make(chan struct{}, 1),
+		lru:     list.New(),
+		entries: make(map[string]map[string]*list.Element),
+		busy:    make(map[renditionKey]chan struct{}),
+	}
+	for _, r := range found {
+		c.add(r.Image, r.Preset, r.Size, false)
+	}
+	return c, nil
+}
+
+func (c *RenditionCache) Open(img *Image, preset string) (io.ReadCloser, error) {
+	fd, err := c.store.Open(img, preset)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.misses++
+		}
+		return nil, err
+	}
+	el, ok := c.entries[img.ImageID][preset]
+	if !ok {
+		c.hits++
+		// rendition stored without the cache knowing about it, for
+		// example because its deletion failed, unless it is being
+		// written or deleted right now
+		if c.busy[renditionKey{imageID: img.ImageID, preset: preset}] == nil {
+			c.add(&Image{ImageID: img.ImageID, Created: img.Created}, preset, renditionSize(fd), false)
+			c.requestSweep()
+		}
+		return fd, nil
+	}
+	if e := el.Value.(*cacheEntry); e.fresh {
+		e.fresh = false
+	} else {
+		c.hits++
+	}
+	c.lru.MoveToFront(el)
+	return fd, nil
+}
+
+func (c *RenditionCache) Exists(img *Image, preset string) bool {
+	return c.store.Exists(img, preset)
+}
+
+func (c *RenditionCache) Put(img *Image, preset string, content []byte) error {
+	key := renditionKey{imageID: img.ImageID, preset: preset}
+	c.mu.Lock()
+	c.lockKey(key)
+	c.mu.Unlock()
+
+	err := c.store.Put(img, preset, content)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unlockKey(key)
+	if err != nil {
+		return err
+	}
+	c.add(&Image{ImageID: img.ImageID, Created: img.Created}, preset, int64(len(content)), true)
+	c.requestSweep()
+	return nil
+}
+
+func (c *RenditionCache) Delete(img *Image, preset string) error {
+	if err := c.store.Delete(img, preset); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[img.ImageID][preset]; ok {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *RenditionCache) Remove(img *Image) error {
+	if err := c.store.Remove(img); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	for _, el := range c.entries[img.ImageID] {
+		c.remove(el)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *RenditionCache) Walk(fn func(RenditionInfo) error) error {
+	return c.store.Walk(fn)
+}
+
+// add insert or update entry as the most recently used one. Must be called
+// with the lock acquired.
+func (c *RenditionCache) add(img *Image, preset string, size int64, fresh bool) {
+	if el, ok := c.entries[img.ImageID][preset]; ok {
+		e := el.Value.(*cacheEntry)
+		c.size += size - e.size
+		e.size = size
+		e.fresh = fresh
+		c.lru.MoveToFront(el)
+		return
+	}
+	presets, ok := c.entries[img.ImageID]
+	if !ok {
+		presets = make(map[string]*list.Element)
+		c.entries[img.ImageID] = presets
+	}
+	presets[preset] = c.lru.PushFront(&cacheEntry{img: img, preset: preset, size: size, fresh: fresh})
+	c.size += size
+}
+
+// requestSweep signal the sweeper if the cache is above the limit. Must be
+// called with the lock acquired.
+func (c *RenditionCache) requestSweep() {
+	if c.size <= c.maxSize {
+		return
+	}
+	select {
+	case c.sweep <- struct{}{}:
+	default:
+	}
+}
+
+// lockKey wait until given rendition is not written or deleted and mark it
+// as busy. Must be called with the lock acquired, which is released while
+// waiting.
+func (c *RenditionCache) lockKey(key renditionKey) {
+	for {
+		done, ok := c.busy[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+	}
+	c.busy[key] = make(chan struct{})
+}
+
+// unlockKey mark given rendition as no longer busy. Must be called with the
+// lock acquired.
+func (c *RenditionCache) unlockKey(key renditionKey) {
+	close(c.busy[key])
+	delete(c.busy, key)
+}
+
+// remove delete entry. Must be called with the lock acquired.
+func (c *RenditionCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	c.size -= e.size
+	delete(c.entries[e.img.ImageID], e.preset)
+	if len(c.entries[e.img.ImageID]) == 0 {
+		delete(c.entries, e.img.ImageID)
+	}
+}
+
+// Sweep delete least recently used renditions until the total size is
+// within the limit. Number of deleted renditions is returned.
+func (c *RenditionCache) Sweep() (int, error) {
+	var evicted int
+	for {
+		c.mu.Lock()
+		if c.size <= c.maxSize {
+			c.mu.Unlock()
+			return evicted, nil
+		}
+		// rendition that is being written was just used
+		el := c.lru.Back()
+		for el != nil && c.busy[entryKey(el)] != nil {
+			el = el.Prev()
+		}
+		if el == nil {
+			c.mu.Unlock()
+			return evicted, nil
+		}
+		e := el.Value.(*cacheEntry)
+		key := entryKey(el)
+		c.lockKey(key)
+		c.remove(el)
+		c.evictions++
+		c.mu.Unlock()
+
+		// rendition accessed during deletion is simply created again,
+		// but not before it is deleted
+		err := c.store.Delete(e.img, e.preset)
+
+		c.mu.Lock()
+		c.unlockKey(key)
+		c.mu.Unlock()
+		if err != nil {
+			return evicted, fmt.Errorf("cannot delete %s rendition of %q: %s", e.preset, e.img.ImageID, err)
+		}
+		evicted++
+	}
+}
+
+func entryKey(el *list.Element) renditionKey {
+	e := el.Value.(*cacheEntry)
+	return renditionKey{imageID: e.img.ImageID, preset: e.preset}
+}
+
+// renditionSize return size of opened rendition content or zero if it is
+// not known.
+func renditionSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := r.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return 0
+}
+
+// RunSweeper call Sweep with given interval and whenever the cache grows
+// above the limit, forever.
+func (c *RenditionCache) RunSweeper(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-c.sweep:
+		}
+		n, err := c.Sweep()
+		if err != nil {
+			log.Printf("cannot evict renditions: %s", err)
+		}
+		if n != 0 {
+			log.Printf("%d renditions evicted from cache", n)
+		}
+	}
+}
+
+// CacheStats describe rendition cache state since it was created.
+type CacheStats struct {
+	Size      int64 `json:"size"`
+	MaxSize   int64 `json:"maxSize"`
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// HitRatio is the fraction of reads served from the cache.
+	HitRatio float64 `json:"hitRatio"`
+}
+
+func (c *RenditionCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CacheStats{
+		Size:      c.size,
+		MaxSize:   c.maxSize,
+		Entries:   c.lru.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if reads := c.hits + c.misses; reads != 0 {
+		stats.HitRatio = float64(c.hits) / float64(reads)
+	}
+	return stats
+}
+
+// ParseSize return number of bytes described by given string, for example
+// 512MB or 20GB. Units are powers of 1000. Size without unit is in bytes.
+func ParseSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	multiplier := int64(1)
+	for _, u := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TB", 1e12},
+		{"GB", 1e9},
+		{"MB", 1e6},
+		{"KB", 1e3},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			multiplier = u.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return int64(n * float64(multiplier)), nil
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenditionCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDirRenditionStore(filepath.Join(dir, "thumbnails"))
+	created := time.Date(2016, 7, 20, 8, 0, 0, 0, time.UTC)
+	a := &Image{ImageID: "a", Created: created}
+	b := &Image{ImageID: "b", Created: created}
+	c := &Image{ImageID: "c", Created: created}
+
+	// rendition existing before the cache was created is accounted for
+	if err := store.Put(a, "thumb", make([]byte, 100)); err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+
+	cache, err := NewRenditionCache(store, 250)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	if err := cache.Put(b, "thumb", make([]byte, 100)); err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+	// reading just created rendition is not a hit
+	fd, err := cache.Open(b, "thumb")
+	if err != nil {
+		t.Fatalf("cannot open: %s", err)
+	}
+	fd.Close()
+	if n, _ := cache.Sweep(); n != 0 {
+		t.Errorf("want nothing evicted below the limit, got %d", n)
+	}
+
+	// a is used more recently than b, so b is evicted first
+	fd, err = cache.Open(a, "thumb")
+	if err != nil {
+		t.Fatalf("cannot open: %s", err)
+	}
+	fd.Close()
+	if err := cache.Put(c, "thumb", make([]byte, 100)); err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+	if n, err := cache.Sweep(); err != nil || n != 1 {
+		t.Fatalf("want one rendition evicted, got %d: %v", n, err)
+	}
+
+	if store.Exists(b, "thumb") {
+		t.Error("least recently used rendition not evicted")
+	}
+	if !store.Exists(a, "thumb") || !store.Exists(c, "thumb") {
+		t.Error("recently used rendition evicted")
+	}
+	if _, err := cache.Open(b, "thumb"); !os.IsNotExist(err) {
+		t.Errorf("want not exist error, got %v", err)
+	}
+
+	stats := cache.Stats()
+	want := CacheStats{
+		Size:      200,
+		MaxSize:   250,
+		Entries:   2,
+		Hits:      1,
+		Misses:    1,
+		Evictions: 1,
+		HitRatio:  0.5,
+	}
+	if stats != want {
+		t.Errorf("want %+v stats, got %+v", want, stats)
+	}
+
+	if err := cache.Remove(a); err != nil {
+		t.Fatalf("cannot remove: %s", err)
+	}
+	if stats := cache.Stats(); stats.Size != 100 || stats.Entries != 1 {
+		t.Errorf("removed rendition still accounted for: %+v", stats)
+	}
+}
+
+func TestRenditionCacheUntracked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewDirRenditionStore(filepath.Join(dir, "thumbnails"))
+	img := &Image{ImageID: "a", Created: time.Date(2016, 7, 20, 8, 0, 0, 0, time.UTC)}
+	cache, err := NewRenditionCache(store, 150)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+
+	// rendition written directly to the store is accounted for when read
+	if err := store.Put(img, "large", make([]byte, 200)); err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+	fd, err := cache.Open(img, "large")
+	if err != nil {
+		t.Fatalf("cannot open: %s", err)
+	}
+	fd.Close()
+	if stats := cache.Stats(); stats.Size != 200 || stats.Entries != 1 {
+		t.Errorf("want untracked rendition accounted for, got %+v", stats)
+	}
+	if n, err := cache.Sweep(); err != nil || n != 1 {
+		t.Fatalf("want untracked rendition evicted, got %d: %v", n, err)
+	}
+	if store.Exists(img, "large") {
+		t.Error("untracked rendition not evicted")
+	}
+}
+
+func TestRenditionCacheSweepDuringPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &slowDeleteStore{
+		RenditionStore: NewDirRenditionStore(filepath.Join(dir, "thumbnails")),
+		deleting:       make(chan struct{}),
+		release:        make(chan struct{}),
+	}
+	img := &Image{ImageID: "a", Created: time.Date(2016, 7, 20, 8, 0, 0, 0, time.UTC)}
+	cache, err := NewRenditionCache(store, 50)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	if err := cache.Put(img, "thumb", make([]byte, 100)); err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+
+	swept := make(chan error, 1)
+	go func() {
+		_, err := cache.Sweep()
+		swept <- err
+	}()
+	<-store.deleting
+
+	// rendition created again while the old one is being deleted must not
+	// be deleted with it
+	put := make(chan error, 1)
+	go func() {
+		put <- cache.Put(img, "thumb", make([]byte, 40))
+	}()
+	select {
+	case err := <-put:
+		t.Fatalf("want put to wait for the deletion, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+	if err := <-swept; err != nil {
+		t.Fatalf("cannot sweep: %s", err)
+	}
+	if err := <-put; err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+
+	if !store.Exists(img, "thumb") {
+		t.Error("rendition created during deletion was deleted")
+	}
+	if stats := cache.Stats(); stats.Size != 40 || stats.Entries != 1 {
+		t.Errorf("want new rendition accounted for, got %+v", stats)
+	}
+}
+
+// slowDeleteStore signal when deletion starts and wait for the release
+// before deleting.
+type slowDeleteStore struct {
+	RenditionStore
+	deleting chan struct{}
+	release  chan struct{}
+}
+
+func (s *slowDeleteStore) Delete(img *Image, preset string) error {
+	s.deleting <- struct{}{}
+	<-s.release
+	return s.RenditionStore.Delete(img, preset)
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]struct {
+		raw     string
+		want    int64
+		wantErr bool
+	}{
+		"bytes":           {raw: "1024", want: 1024},
+		"bytes unit":      {raw: "1024B", want: 1024},
+		"gigabytes":       {raw: "20GB", want: 20e9},
+		"lower case":      {raw: "512mb", want: 512e6},
+		"fraction":        {raw: "1.5 GB", want: 1.5e9},
+		"unknown unit":    {raw: "20GiB", wantErr: true},
+		"negative":        {raw: "-1GB", wantErr: true},
+		"no number":       {raw: "GB", wantErr: true},
+		"with whitespace": {raw: " 10KB ", want: 10e3},
+	}
+
+	for tname, tc := range cases {
+		got, err := ParseSize(tc.raw)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: want error, got %d", tname, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tname, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: want %d, got %d", tname, tc.want, got)
+		}
+	}
+}
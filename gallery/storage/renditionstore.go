@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/husio/gallery/sq"
+	"github.com/jmoiron/sqlx"
+)
+
+// RenditionStore keep JPEG encoded renditions of images, identified by the
+// image and the preset name.
+type RenditionStore interface {
+	// Open return rendition content. If rendition does not exist,
+	// returned error satisfies os.IsNotExist.
+	Open(img *Image, preset string) (io.ReadCloser, error)
+	Exists(img *Image, preset string) bool
+	// Put store rendition, replacing existing one if any. Rendition must
+	// never be visible partially written.
+	Put(img *Image, preset string, content []byte) error
+	// Delete remove single rendition of given image.
+	Delete(img *Image, preset string) error
+	// Remove delete all renditions of given image.
+	Remove(img *Image) error
+	// Walk call fn for every stored rendition.
+	Walk(fn func(RenditionInfo) error) error
+}
+
+// RenditionInfo describe stored rendition.
+type RenditionInfo struct {
+	// Image has only the ID and, if known, the creation year set.
+	Image    *Image
+	Preset   string
+	Size     int64
+	Modified time.Time
+}
+
+// DirRenditionStore keep every rendition in a separate file, in directory
+// named after the year the image was created. Thumbnail created before
+// rendition presets were introduced is used as the thumb rendition, until it
+// is replaced.
+type DirRenditionStore struct {
+	root string
+}
+
+func NewDirRenditionStore(root string) *DirRenditionStore {
+	return &DirRenditionStore{root: root}
+}
+
+func (s *DirRenditionStore) Open(img *Image, preset string) (io.ReadCloser, error) {
+	fd, err := os.Open(s.path(img, preset))
+	if os.IsNotExist(err) && preset == ThumbnailPreset {
+		if legacy, lerr := os.Open(s.legacyPath(img)); lerr == nil {
+			return legacy, nil
+		}
+	}
+	return fd, err
+}
+
+func (s *DirRenditionStore) Exists(img *Image, preset string) bool {
+	if _, err := os.Stat(s.path(img, preset)); err == nil {
+		return true
+	}
+	if preset != ThumbnailPreset {
+		return false
+	}
+	_, err := os.Stat(s.legacyPath(img))
+	return err == nil
+}
+
+// Put write rendition into a temporary file, that is renamed once complete,
+// so that readers never see partially written file.
+func (s *DirRenditionStore) Put(img *Image, preset string, content []byte) error {
+	path := s.path(img, preset)
+	os.MkdirAll(filepath.Dir(path), 0777)
+
+	fd, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("cannot store rendition: %s", err)
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(content)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write rendition: %s", err)
+	}
+	if err := os.Rename(fd.Name(), path); err != nil {
+		return fmt.Errorf("cannot store rendition: %s", err)
+	}
+	if preset == ThumbnailPreset {
+		os.Remove(s.legacyPath(img))
+	}
+	return nil
+}
+
+func (s *DirRenditionStore) Delete(img *Image, preset string) error {
+	paths := []string{s.path(img, preset)}
+	if preset == ThumbnailPreset {
+		paths = append(paths, s.legacyPath(img))
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DirRenditionStore) Remove(img *Image) error {
+	paths, err := filepath.Glob(filepath.Join(s.root, fmt.Sprint(img.Created.Year()), img.ImageID+"-*.jpg"))
+	if err != nil {
+		return err
+	}
+	paths = append(paths, s.legacyPath(img))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk call fn for every stored rendition. Files not looking like a
+// rendition are ignored.
+func (s *DirRenditionStore) Walk(fn func(RenditionInfo) error) error {
+	years, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot read directory: %s", err)
+	}
+	for _, y := range years {
+		year, err := strconv.Atoi(y.Name())
+		if err != nil || !y.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.root, y.Name()))
+		if err != nil {
+			return fmt.Errorf("cannot read directory: %s", err)
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			id, preset, ok := parseRenditionName(f.Name())
+			if !ok {
+				continue
+			}
+			err := fn(RenditionInfo{
+				Image: &Image{
+					ImageID: id,
+					Created: time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC),
+				},
+				Preset:   preset,
+				Size:     f.Size(),
+				Modified: f.ModTime(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseRenditionName return image ID and preset name of the rendition file
+// with given name. Image ID can contain a dash, but preset name cannot, so
+// the last dash separates them. Legacy thumbnail is the thumb rendition.
+func parseRenditionName(name string) (string, string, bool) {
+	if id, ok := legacyThumbnailID(name); ok {
+		return id, ThumbnailPreset, true
+	}
+	if !strings.HasSuffix(name, ".jpg") || strings.HasPrefix(name, ".") {
+		return "", "", false
+	}
+	name = strings.TrimSuffix(name, ".jpg")
+	i := strings.LastIndex(name, "-")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// RemoveLegacy delete thumbnail files created before rendition presets were
+// introduced, that are named after the image ID only. These are smaller than
+// the thumb rendition, which is created again when requested. Number of
+// removed files is returned.
+func (s *DirRenditionStore) RemoveLegacy() (int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.root, "*", "*.jpg"))
+	if err != nil {
+		return 0, err
+	}
+	var removed int
+	for _, path := range paths {
+		if _, ok := legacyThumbnailID(filepath.Base(path)); !ok {
+			continue
+		}
+		if _, err := strconv.Atoi(filepath.Base(filepath.Dir(path))); err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// legacyThumbnailID return image ID of a thumbnail file created before
+// rendition presets were introduced. Image IDs are encoded SHA-256
+// checksums, so file named after an image ID only is shorter than any
+// rendition file name, which has the preset name appended.
+func legacyThumbnailID(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".jpg") || strings.HasPrefix(name, ".") {
+		return "", false
+	}
+	id := strings.TrimSuffix(name, ".jpg")
+	if len(id) != imageIDLen {
+		return "", false
+	}
+	return id, true
+}
+
+// imageIDLen is the length of every image ID.
+var imageIDLen = len(encodeSum(make([]byte, sha256.Size)))
+
+func (s *DirRenditionStore) path(img *Image, preset string) string {
+	return filepath.Join(s.root, fmt.Sprint(img.Created.Year()), img.ImageID+"-"+preset+".jpg")
+}
+
+func (s *DirRenditionStore) legacyPath(img *Image) string {
+	return filepath.Join(s.root, fmt.Sprint(img.Created.Year()), img.ImageID+".jpg")
+}
+
+// SQLRenditionStore keep all renditions as blobs in a single SQLite
+// database, instead of creating a file for every rendition.
+type SQLRenditionStore struct {
+	db *sqlx.DB
+}
+
+// OpenSQLRenditionStore return store using SQLite database of given path.
+// Database is created if it does not exist.
+func OpenSQLRenditionStore(path string) (*SQLRenditionStore, error) {
+	// renditions are written by many workers at the same time
+	db, err := sqlx.Open("sqlite3", path+"?_busy_timeout=10000")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %s", err)
+	}
+	if _, err := db.Exec(`PRAGMA journal_mode = WAL`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot enable write-ahead log: %s", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS renditions (
+			image_id  TEXT NOT NULL,
+			preset    TEXT NOT NULL,
+			content   BLOB NOT NULL,
+			created   TIMESTAMP NOT NULL,
+
+			PRIMARY KEY(image_id, preset)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create schema: %s", err)
+	}
+	return &SQLRenditionStore{db: db}, nil
+}
+
+func (s *SQLRenditionStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLRenditionStore) Open(img *Image, preset string) (io.ReadCloser, error) {
+	var content []byte
+	err := s.db.Get(&content, `
+		SELECT content FROM renditions
+		WHERE image_id = ? AND preset = ?
+		LIMIT 1
+	`, img.ImageID, preset)
+	switch err := sq.CastErr(err); err {
+	case nil:
+		return blob{bytes.NewReader(content)}, nil
+	case sq.ErrNotFound:
+		return nil, os.ErrNotExist
+	default:
+		return nil, fmt.Errorf("cannot read rendition: %s", err)
+	}
+}
+
+// blob is rendition content read into memory. Its size is known without
+// reading it.
+type blob struct {
+	*bytes.Reader
+}
+
+func (blob) Close() error {
+	return nil
+}
+
+func (s *SQLRenditionStore) Exists(img *Image, preset string) bool {
+	var n int
+	err := s.db.Get(&n, `
+		SELECT COUNT(*) FROM renditions
+		WHERE image_id = ? AND preset = ?
+	`, img.ImageID, preset)
+	return err == nil && n != 0
+}
+
+func (s *SQLRenditionStore) Put(img *Image, preset string, content []byte) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO renditions (image_id, preset, content, created)
+		VALUES (?, ?, ?, ?)
+	`, img.ImageID, preset, content, time.Now())
+	if err != nil {
+		return fmt.Errorf("cannot store rendition: %s", sq.CastErr(err))
+	}
+	return nil
+}
+
+func (s *SQLRenditionStore) Delete(img *Image, preset string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM renditions
+		WHERE image_id = ? AND preset = ?
+	`, img.ImageID, preset)
+	return sq.CastErr(err)
+}
+
+func (s *SQLRenditionStore) Remove(img *Image) error {
+	_, err := s.db.Exec(`DELETE FROM renditions WHERE image_id = ?`, img.ImageID)
+	return sq.CastErr(err)
+}
+
+// Walk call fn for every stored rendition. Image creation time is not known.
+func (s *SQLRenditionStore) Walk(fn func(RenditionInfo) error) error {
+	var rows []struct {
+		ImageID string    `db:"image_id"`
+		Preset  string    `db:"preset"`
+		Size    int64     `db:"size"`
+		Created time.Time `db:"created"`
+	}
+	err := s.db.Select(&rows, `
+		SELECT image_id, preset, LENGTH(content) AS size, created
+		FROM renditions
+	`)
+	if err != nil {
+		return fmt.Errorf("cannot list renditions: %s", sq.CastErr(err))
+	}
+	for _, r := range rows {
+		err := fn(RenditionInfo{
+			Image:    &Image{ImageID: r.ImageID},
+			Preset:   r.Preset,
+			Size:     r.Size,
+			Modified: r.Created,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenditionStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sqlStore, err := OpenSQLRenditionStore(filepath.Join(dir, "thumbnails.sqlite3"))
+	if err != nil {
+		t.Fatalf("cannot open SQL store: %s", err)
+	}
+	defer sqlStore.Close()
+
+	stores := map[string]RenditionStore{
+		"dir": NewDirRenditionStore(filepath.Join(dir, "thumbnails")),
+		"sql": sqlStore,
+	}
+
+	created := time.Date(2016, 7, 20, 8, 0, 0, 0, time.UTC)
+	img := &Image{ImageID: "Ab-c_d", Created: created}
+	other := &Image{ImageID: "Ab-c_e", Created: created}
+
+	for tname, s := range stores {
+		if _, err := s.Open(img, "thumb"); !os.IsNotExist(err) {
+			t.Errorf("%s: want not exist error, got %v", tname, err)
+		}
+		if s.Exists(img, "thumb") {
+			t.Errorf("%s: rendition exists before put", tname)
+		}
+
+		for _, p := range []string{"thumb", "small"} {
+			if err := s.Put(img, p, []byte(p+"-content")); err != nil {
+				t.Fatalf("%s: cannot put %s: %s", tname, p, err)
+			}
+		}
+		if err := s.Put(img, "thumb", []byte("thumb-replaced")); err != nil {
+			t.Fatalf("%s: cannot replace: %s", tname, err)
+		}
+		if err := s.Put(other, "thumb", []byte("other")); err != nil {
+			t.Fatalf("%s: cannot put other: %s", tname, err)
+		}
+
+		if !s.Exists(img, "thumb") {
+			t.Errorf("%s: rendition does not exist after put", tname)
+		}
+		fd, err := s.Open(img, "thumb")
+		if err != nil {
+			t.Fatalf("%s: cannot open: %s", tname, err)
+		}
+		content, _ := ioutil.ReadAll(fd)
+		fd.Close()
+		if string(content) != "thumb-replaced" {
+			t.Errorf("%s: unexpected content: %q", tname, content)
+		}
+
+		if err := s.Remove(img); err != nil {
+			t.Fatalf("%s: cannot remove: %s", tname, err)
+		}
+		if s.Exists(img, "thumb") || s.Exists(img, "small") {
+			t.Errorf("%s: rendition exists after remove", tname)
+		}
+		if !s.Exists(other, "thumb") {
+			t.Errorf("%s: other image rendition removed", tname)
+		}
+	}
+}
+
+func TestDirRenditionStoreWalk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewDirRenditionStore(dir)
+	s.Put(&Image{ImageID: "a-1", Created: time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)}, "thumb", []byte("a"))
+	s.Put(&Image{ImageID: "b", Created: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)}, "large", []byte("b"))
+	s.Put(&Image{ImageID: "Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk", Created: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)}, "small", []byte("c"))
+	ioutil.WriteFile(filepath.Join(dir, "2016", "notes.txt"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "2016", "trailing-.jpg"), nil, 0644)
+	os.MkdirAll(filepath.Join(dir, "iiif"), 0777)
+	// thumbnails created before rendition presets were introduced
+	ioutil.WriteFile(filepath.Join(dir, "2016", "Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk.jpg"), []byte("legacy"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "2015", "yVwOBOZuoaeRjG4ZZb4WG5gfkDk4kgtKXHX4MVhQs_1.jpg"), []byte("legacy"), 0644)
+
+	found := make(map[string]bool)
+	err = s.Walk(func(r RenditionInfo) error {
+		found[r.Image.ImageID+" "+r.Preset+" "+r.Image.Created.Format("2006")] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot walk: %s", err)
+	}
+	want := map[string]bool{
+		"a-1 thumb 2015": true,
+		"b large 2016":   true,
+		"Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk small 2016": true,
+		"Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk thumb 2016": true,
+		"yVwOBOZuoaeRjG4ZZb4WG5gfkDk4kgtKXHX4MVhQs_1 thumb 2015": true,
+	}
+	if len(found) != len(want) {
+		t.Errorf("want %v, got %v", want, found)
+	}
+	for k := range want {
+		if !found[k] {
+			t.Errorf("%q not found", k)
+		}
+	}
+
+	// legacy thumbnail is the thumb rendition, until it is replaced
+	legacy := &Image{ImageID: "Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk", Created: time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)}
+	fd, err := s.Open(legacy, "thumb")
+	if err != nil {
+		t.Fatalf("cannot open legacy thumbnail: %s", err)
+	}
+	content, _ := ioutil.ReadAll(fd)
+	fd.Close()
+	if string(content) != "legacy" {
+		t.Errorf("want legacy thumbnail content, got %q", content)
+	}
+	if err := s.Put(legacy, "thumb", []byte("thumb")); err != nil {
+		t.Fatalf("cannot put: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2016", legacy.ImageID+".jpg")); !os.IsNotExist(err) {
+		t.Errorf("want legacy thumbnail replaced, got %v", err)
+	}
+	other := &Image{ImageID: "yVwOBOZuoaeRjG4ZZb4WG5gfkDk4kgtKXHX4MVhQs_1", Created: time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)}
+	if err := s.Delete(other, "thumb"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	if s.Exists(other, "thumb") {
+		t.Error("want legacy thumbnail deleted")
+	}
+}
+
+func TestDirRenditionStoreRemoveLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// image IDs can contain a dash
+	ids := []string{
+		"Dk4kgtKXHX4MVhQsyVwOBOZuoaeRj-G4ZZb4-WG5gfk",
+		"yVwOBOZuoaeRjG4ZZb4WG5gfkDk4kgtKXHX4MVhQs_1",
+	}
+	created := time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)
+	s := NewDirRenditionStore(dir)
+	for _, id := range ids {
+		if len(id) != imageIDLen {
+			t.Fatalf("invalid test image ID %q", id)
+		}
+		if err := s.Put(&Image{ImageID: id, Created: created}, "thumb", []byte("thumb")); err != nil {
+			t.Fatalf("cannot put: %s", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "2016", id+".jpg"), []byte("legacy"), 0644); err != nil {
+			t.Fatalf("cannot write legacy thumbnail: %s", err)
+		}
+	}
+	os.MkdirAll(filepath.Join(dir, "iiif"), 0777)
+	notThumbnail := filepath.Join(dir, "iiif", ids[0]+".jpg")
+	ioutil.WriteFile(notThumbnail, nil, 0644)
+
+	if n, err := s.RemoveLegacy(); err != nil || n != len(ids) {
+		t.Fatalf("want %d legacy thumbnails removed, got %d: %v", len(ids), n, err)
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(dir, "2016", id+".jpg")); !os.IsNotExist(err) {
+			t.Errorf("want %s legacy thumbnail removed, got %v", id, err)
+		}
+		if !s.Exists(&Image{ImageID: id, Created: created}, "thumb") {
+			t.Errorf("%s rendition removed", id)
+		}
+	}
+	if _, err := os.Stat(notThumbnail); err != nil {
+		t.Errorf("want file outside of year directory kept, got %v", err)
+	}
+}
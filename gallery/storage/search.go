@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"html"
+	"strings"
+
+	"github.com/husio/gallery/sq"
+)
+
+// Snippet highlight markers, that cannot be found in any text.
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// searchSelect is the query selecting images matching full text search
+// together with a snippet of the best matching text.
+const searchSelect = `
+	SELECT i.*, snippet(image_search, -1, char(2), char(3), '…', 12) AS snippet
+	FROM images i
+	INNER JOIN image_search_docs d ON d.image_id = i.image_id
+	INNER JOIN image_search ON image_search.rowid = d.docid
+	LEFT JOIN image_quality q ON q.image_id = i.image_id
+`
+
+// searchQuery return FTS5 query matching documents that contain all words of
+// given text. Words are matched by prefix, so that "sun" finds "sunset".
+// Query syntax is not supported, so that any text is a valid query.
+func searchQuery(text string) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = `"` + strings.Replace(w, `"`, `""`, -1) + `"*`
+	}
+	return strings.Join(words, " ")
+}
+
+// highlight return HTML of given snippet, with matching words marked.
+func highlight(snippet string) string {
+	s := html.EscapeString(snippet)
+	s = strings.Replace(s, snippetStart, "<mark>", -1)
+	return strings.Replace(s, snippetEnd, "</mark>", -1)
+}
+
+// RebuildSearchIndex create full text search index of all images from
+// scratch. Index is kept in sync by database triggers, so this is only needed
+// for images stored before the index was introduced.
+func RebuildSearchIndex(e sq.Execer) error {
+	if _, err := e.Exec(`DELETE FROM image_search_docs`); err != nil {
+		return sq.CastErr(err)
+	}
+	_, err := e.Exec(`
+		INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+		SELECT * FROM image_search_source
+	`)
+	return sq.CastErr(err)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/sq"
+)
+
+func TestSearchQuery(t *testing.T) {
+	cases := map[string]string{
+		"":                 "",
+		"  ":               "",
+		"sunset":           `"sunset"*`,
+		" red  car ":       `"red"* "car"*`,
+		`say "hi"`:         `"say"* """hi"""*`,
+		"NOT OR AND":       `"NOT"* "OR"* "AND"*`,
+		"title:x (y) -z *": `"title:x"* "(y)"* "-z"* "*"*`,
+	}
+	for text, want := range cases {
+		if got := searchQuery(text); got != want {
+			t.Errorf("%q: want %s, got %s", text, want, got)
+		}
+	}
+}
+
+func TestImagesSearch(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	now := time.Now()
+	// relevance of a word depends on how rare it is, so most images must
+	// not match
+	ids := []string{"sea", "city", "forest"}
+	for i := 0; i < 10; i++ {
+		ids = append(ids, fmt.Sprintf("other-%d", i))
+	}
+	for i, id := range ids {
+		if _, err := CreateImage(db, Image{ImageID: id, Created: now.Add(-time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatalf("cannot create %s image: %s", id, err)
+		}
+	}
+	// texts are not set on creation
+	if _, err := db.Exec(`UPDATE images SET title = 'Sunset', caption = 'Sun goes down <behind> the sea' WHERE image_id = 'sea'`); err != nil {
+		t.Fatalf("cannot update image: %s", err)
+	}
+	if _, err := db.Exec(`UPDATE images SET caption = 'Old town at night' WHERE image_id = 'city'`); err != nil {
+		t.Fatalf("cannot update image: %s", err)
+	}
+	if _, err := db.Exec(`UPDATE images SET title = 'Lake' WHERE image_id = 'other-1'`); err != nil {
+		t.Fatalf("cannot update image: %s", err)
+	}
+	tags := []Tag{
+		{ImageID: "forest", Name: "sunset"},
+		{ImageID: "forest", Name: "hiking"},
+		{ImageID: "city", Name: "Kraków", Auto: true},
+		{ImageID: "other-0", Name: "lake"},
+	}
+	for _, tag := range tags {
+		if _, err := CreateTag(db, tag); err != nil {
+			t.Fatalf("cannot create tag: %s", err)
+		}
+	}
+	if err := PutImageEXIF(db, EXIF{ImageID: "city", Make: "Canon", Model: "EOS 5D"}); err != nil {
+		t.Fatalf("cannot store EXIF: %s", err)
+	}
+
+	search := func(query string) ([]string, []*Image) {
+		imgs, err := Images(db, ImagesOpts{Limit: 10, Query: query})
+		if err != nil {
+			t.Fatalf("%q: cannot search: %s", query, err)
+		}
+		var ids []string
+		for _, img := range imgs {
+			ids = append(ids, img.ImageID)
+		}
+		return ids, imgs
+	}
+
+	cases := map[string]struct {
+		query string
+		want  []string
+	}{
+		"title before tag": {query: "lake", want: []string{"other-1", "other-0"}},
+		"prefix":           {query: "hik", want: []string{"forest"}},
+		"caption":          {query: "town", want: []string{"city"}},
+		"place":            {query: "krakow", want: []string{"city"}},
+		"camera":           {query: "canon 5d", want: []string{"city"}},
+		"all words":        {query: "sunset hiking", want: []string{"forest"}},
+		"no match":         {query: "desert", want: nil},
+		"syntax ignored":   {query: `"night" OR (`, want: nil},
+	}
+	for tname, tc := range cases {
+		if got, _ := search(tc.query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tname, tc.want, got)
+		}
+	}
+
+	_, imgs := search("behind")
+	if len(imgs) != 1 || !strings.Contains(imgs[0].Snippet, "&lt;<mark>behind</mark>&gt;") {
+		t.Errorf("want escaped and highlighted snippet, got %+v", imgs)
+	}
+
+	// index follows changes of all indexed tables
+	if _, err := db.Exec(`DELETE FROM tags WHERE name = 'hiking'`); err != nil {
+		t.Fatalf("cannot delete tag: %s", err)
+	}
+	if got, _ := search("hiking"); got != nil {
+		t.Errorf("want deleted tag not found, got %v", got)
+	}
+	if _, err := NewEditor(sq.NewDatabase(db), NewFileStore(t.TempDir(), nil, 0), nil).SetText("forest", ImageText{Caption: strPtr("Mountain trail")}); err != nil {
+		t.Fatalf("cannot set text: %s", err)
+	}
+	if got, _ := search("trail"); !reflect.DeepEqual(got, []string{"forest"}) {
+		t.Errorf("want changed caption found, got %v", got)
+	}
+
+	if err := RebuildSearchIndex(db); err != nil {
+		t.Fatalf("cannot rebuild index: %s", err)
+	}
+	if got, _ := search("lake"); !reflect.DeepEqual(got, []string{"other-1", "other-0"}) {
+		t.Errorf("want the same result after rebuild, got %v", got)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
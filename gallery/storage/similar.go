@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+
+	"github.com/husio/gallery/gallery/phash"
+	"github.com/husio/gallery/sq"
+)
+
+// PerceptualHash return hash of given image content, that is similar for
+// visually similar images.
+func PerceptualHash(fs *FileStore, img *Image) (uint64, error) {
+	src, err := analysisImage(fs, img, 9)
+	if err != nil {
+		return 0, err
+	}
+	return phash.DHash(src), nil
+}
+
+// analysisImage return content of given image that is good enough for
+// computing image features, like perceptual hash or dominant colors, from a
+// copy of the image scaled down to fit within size x size square. Embedded
+// EXIF preview is used if it is big enough.
+func analysisImage(fs *FileStore, img *Image, size int) (image.Image, error) {
+	if preview := fs.preview(img); preview != nil && previewFits(preview, img, Preset{Width: size, Height: size}) {
+		return preview, nil
+	}
+	return fs.Decode(img)
+}
+
+// PutImageHash store perceptual hash of an image, replacing previous value if
+// any exists.
+func PutImageHash(e sq.Execer, imageID string, hash uint64) error {
+	// SQLite integers are signed
+	_, err := e.Exec(`
+		INSERT OR REPLACE INTO image_hashes (image_id, dhash)
+		VALUES (?, ?)
+	`, imageID, int64(hash))
+	return sq.CastErr(err)
+}
+
+type imageHash struct {
+	ImageID string `db:"image_id"`
+	Hash    int64  `db:"dhash"`
+}
+
+func imageHashes(s sq.Selector) ([]imageHash, error) {
+	var hashes []imageHash
+	err := s.Select(&hashes, `SELECT image_id, dhash FROM image_hashes`)
+	return hashes, sq.CastErr(err)
+}
+
+// ImagesWithoutHash return images that perceptual hash was not computed for.
+func ImagesWithoutHash(s sq.Selector, limit int64) ([]*Image, error) {
+	var imgs []*Image
+	err := s.Select(&imgs, `
+		SELECT i.* FROM images i
+		WHERE NOT EXISTS (
+			SELECT 1 FROM image_hashes h
+			WHERE h.image_id = i.image_id
+		)
+		ORDER BY i.created DESC
+		LIMIT ?
+	`, limit)
+	return imgs, sq.CastErr(err)
+}
+
+// SimilarImage is an image together with its distance to the image it is
+// similar to.
+type SimilarImage struct {
+	*Image
+	// Distance is the number of perceptual hash bits that differ. Zero
+	// means that images look the same.
+	Distance int `json:"distance"`
+}
+
+// SimilarImages return images which perceptual hash is at most maxDistance
+// from the hash of given image, ordered from the most similar. Returned list
+// does not contain the image itself.
+func SimilarImages(s sq.Selector, imageID string, maxDistance int) ([]*SimilarImage, error) {
+	hashes, err := imageHashes(s)
+	if err != nil {
+		return nil, err
+	}
+	var hash *int64
+	for _, h := range hashes {
+		if h.ImageID == imageID {
+			hash = &h.Hash
+			break
+		}
+	}
+	if hash == nil {
+		return nil, sq.ErrNotFound
+	}
+
+	distances := make(map[string]int)
+	var ids []string
+	for _, h := range hashes {
+		if h.ImageID == imageID {
+			continue
+		}
+		if d := phash.Distance(uint64(*hash), uint64(h.Hash)); d <= maxDistance {
+			distances[h.ImageID] = d
+			ids = append(ids, h.ImageID)
+		}
+	}
+	imgs, err := imagesByID(s, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	similar := make([]*SimilarImage, 0, len(imgs))
+	for _, img := range imgs {
+		similar = append(similar, &SimilarImage{Image: img, Distance: distances[img.ImageID]})
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+	return similar, nil
+}
+
+// DuplicateCandidates return groups of images that look nearly the same,
+// for example the same photo saved with different quality. Images within a
+// group are ordered from the biggest.
+func DuplicateCandidates(s sq.Selector, maxDistance int) ([][]*Image, error) {
+	hashes, err := imageHashes(s)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]uint64, len(hashes))
+	for i, h := range hashes {
+		values[i] = uint64(h.Hash)
+	}
+
+	var groups [][]*Image
+	for _, group := range phash.Group(values, maxDistance) {
+		ids := make([]string, len(group))
+		for i, idx := range group {
+			ids[i] = hashes[idx].ImageID
+		}
+		imgs, err := imagesByID(s, ids)
+		if err != nil {
+			return nil, err
+		}
+		if len(imgs) < 2 {
+			continue
+		}
+		sort.SliceStable(imgs, func(i, j int) bool {
+			return imgs[i].Width*imgs[i].Height > imgs[j].Width*imgs[j].Height
+		})
+		groups = append(groups, imgs)
+	}
+	// groups of the most recent photos first
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i][0].Created.After(groups[j][0].Created)
+	})
+	return groups, nil
+}
+
+// imagesByID return images of given IDs. Images that do not exist are
+// ignored.
+func imagesByID(s sq.Selector, ids []string) ([]*Image, error) {
+	var imgs []*Image
+	err := inBatches(ids, func(placeholders string, args []interface{}) error {
+		var found []*Image
+		query := fmt.Sprintf(`
+			SELECT * FROM images
+			WHERE image_id IN (%s)
+		`, placeholders)
+		if err := s.Select(&found, query, args...); err != nil {
+			return sq.CastErr(err)
+		}
+		imgs = append(imgs, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := loadDetails(s, imgs); err != nil {
+		return nil, err
+	}
+	return imgs, nil
+}
+
+// inBatches call fn for consecutive batches of given IDs, with placeholders
+// for an IN clause and the query arguments of the batch. SQLite limits the
+// number of query parameters, so big lists must be split.
+func inBatches(ids []string, fn func(placeholders string, args []interface{}) error) error {
+	const batchSize = 500
+	for len(ids) != 0 {
+		batch := ids
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		ids = ids[len(batch):]
+
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		if err := fn(placeholders, args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
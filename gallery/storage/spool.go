@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// ErrTooLarge is returned when spooled content exceeds allowed size.
+var ErrTooLarge = errors.New("file too large")
+
+// SpooledFile is a temporary file with the SHA-256 checksum of its content
+// computed while it was written.
+type SpooledFile struct {
+	*os.File
+	sum []byte
+}
+
+// Spool copy content of given reader into a temporary file created in dir,
+// computing its checksum at the same time. ErrTooLarge is returned if the
+// content is bigger than maxSize bytes. Returned file is positioned at the
+// beginning and must be removed using Remove.
+func Spool(dir string, r io.Reader, maxSize int64) (*SpooledFile, error) {
+	fd, err := ioutil.TempFile(dir, "spool-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary file: %s", err)
+	}
+	sf := &SpooledFile{File: fd}
+
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fd, sum), io.LimitReader(r, maxSize+1))
+	if err != nil {
+		sf.Remove()
+		return nil, err
+	}
+	if n > maxSize {
+		sf.Remove()
+		return nil, ErrTooLarge
+	}
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		sf.Remove()
+		return nil, fmt.Errorf("cannot seek: %s", err)
+	}
+	sf.sum = sum.Sum(nil)
+	return sf, nil
+}
+
+// SHA256 return checksum of the file content.
+func (sf *SpooledFile) SHA256() []byte {
+	return sf.sum
+}
+
+// Remove close and delete the file.
+func (sf *SpooledFile) Remove() error {
+	sf.File.Close()
+	return os.Remove(sf.File.Name())
+}
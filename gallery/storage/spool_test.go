@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]struct {
+		content []byte
+		maxSize int64
+		wantErr error
+	}{
+		"empty": {
+			content: nil,
+			maxSize: 10,
+		},
+		"exact_size": {
+			content: []byte("0123456789"),
+			maxSize: 10,
+		},
+		"too_large": {
+			content: []byte("0123456789a"),
+			maxSize: 10,
+			wantErr: ErrTooLarge,
+		},
+	}
+
+	for tname, tc := range cases {
+		sf, err := Spool(dir, bytes.NewReader(tc.content), tc.maxSize)
+		if err != tc.wantErr {
+			t.Errorf("%s: want %v error, got %v", tname, tc.wantErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		content, err := ioutil.ReadAll(sf)
+		if err != nil {
+			t.Errorf("%s: cannot read: %s", tname, err)
+		}
+		if !bytes.Equal(content, tc.content) {
+			t.Errorf("%s: want %q content, got %q", tname, tc.content, content)
+		}
+		if want := sha256.Sum256(tc.content); !bytes.Equal(sf.SHA256(), want[:]) {
+			t.Errorf("%s: invalid checksum: %x", tname, sf.SHA256())
+		}
+		if err := sf.Remove(); err != nil {
+			t.Errorf("%s: cannot remove: %s", tname, err)
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("want all files removed, got %d", len(files))
+	}
+}
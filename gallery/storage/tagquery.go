@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// TagQuery is boolean expression over image tags, for example
+//
+//	holiday AND (korea OR japan) AND NOT blurry
+//
+// Query can be build only by ParseTagQuery or by combining already existing
+// queries, which guarantees that it compiles into safe SQL.
+type TagQuery interface {
+	// String return query in format understood by ParseTagQuery.
+	String() string
+
+	// sql return condition that matches images described by the query.
+	// Images table must be available under "i" alias.
+	sql() (string, []interface{})
+}
+
+// TagName match images having tag with given name.
+type TagName string
+
+func (n TagName) String() string {
+	s := string(n)
+	if s == "" || strings.ContainsAny(s, `()"\`) || s != strings.Join(strings.Fields(s), " ") {
+		return strconv.Quote(s)
+	}
+	for _, w := range strings.Fields(s) {
+		if isTagKeyword(w) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func (n TagName) sql() (string, []interface{}) {
+	return `EXISTS (SELECT 1 FROM tags t WHERE t.image_id = i.image_id AND t.name = ?)`, []interface{}{string(n)}
+}
+
+// TagAnd match images matching all of given queries.
+type TagAnd []TagQuery
+
+func (a TagAnd) String() string {
+	return joinTagQueries([]TagQuery(a), " AND ")
+}
+
+func (a TagAnd) sql() (string, []interface{}) {
+	return joinTagQueriesSQL([]TagQuery(a), " AND ")
+}
+
+// TagOr match images matching at least one of given queries.
+type TagOr []TagQuery
+
+func (o TagOr) String() string {
+	return joinTagQueries([]TagQuery(o), " OR ")
+}
+
+func (o TagOr) sql() (string, []interface{}) {
+	return joinTagQueriesSQL([]TagQuery(o), " OR ")
+}
+
+// TagNot match images not matching given query.
+type TagNot struct {
+	Query TagQuery
+}
+
+func (n TagNot) String() string {
+	switch n.Query.(type) {
+	case TagAnd, TagOr:
+		return "NOT (" + n.Query.String() + ")"
+	default:
+		return "NOT " + n.Query.String()
+	}
+}
+
+func (n TagNot) sql() (string, []interface{}) {
+	cond, args := n.Query.sql()
+	return "NOT (" + cond + ")", args
+}
+
+func joinTagQueries(qs []TagQuery, sep string) string {
+	chunks := make([]string, len(qs))
+	for i, q := range qs {
+		switch q.(type) {
+		case TagAnd, TagOr:
+			chunks[i] = "(" + q.String() + ")"
+		default:
+			chunks[i] = q.String()
+		}
+	}
+	return strings.Join(chunks, sep)
+}
+
+func joinTagQueriesSQL(qs []TagQuery, sep string) (string, []interface{}) {
+	var (
+		b    bytes.Buffer
+		args []interface{}
+	)
+	for i, q := range qs {
+		if i != 0 {
+			b.WriteString(sep)
+		}
+		cond, a := q.sql()
+		b.WriteByte('(')
+		b.WriteString(cond)
+		b.WriteByte(')')
+		args = append(args, a...)
+	}
+	return b.String(), args
+}
+
+const (
+	maxTagQueryLength = 1024
+	maxTagQueryDepth  = 16
+	maxTagQueryTerms  = 32
+)
+
+// TagQueryError is returned when tag query cannot be parsed.
+type TagQueryError struct {
+	// Pos is byte offset of the query where the error was found.
+	Pos int
+	Msg string
+}
+
+func (e *TagQueryError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// ParseTagQuery parse given string into tag query.
+//
+// Query is made of tag names combined using AND, OR and NOT operators, for
+// example "holiday AND (korea OR japan) AND NOT blurry". Operators must be
+// written in upper case. Tag names made of several words do not have to be
+// quoted, but tag names containing operators or parentheses must be written
+// in double quotes.
+func ParseTagQuery(s string) (TagQuery, error) {
+	if len(s) > maxTagQueryLength {
+		return nil, &TagQueryError{Pos: maxTagQueryLength, Msg: "query too long"}
+	}
+	tokens, err := tokenizeTagQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := tagQueryParser{tokens: tokens, end: len(s)}
+	q, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, &TagQueryError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %s", tok)}
+	}
+	return q, nil
+}
+
+type tagQueryParser struct {
+	tokens []tagToken
+	pos    int
+	end    int
+	terms  int
+}
+
+func (p *tagQueryParser) peek() tagToken {
+	if p.pos >= len(p.tokens) {
+		return tagToken{kind: tokEOF, pos: p.end}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *tagQueryParser) next() tagToken {
+	tok := p.peek()
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *tagQueryParser) parseOr(depth int) (TagQuery, error) {
+	q, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	or := TagOr{q}
+	for p.peek().kind == tokOr {
+		p.next()
+		q, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *tagQueryParser) parseAnd(depth int) (TagQuery, error) {
+	q, err := p.parseNot(depth)
+	if err != nil {
+		return nil, err
+	}
+	and := TagAnd{q}
+	for p.peek().kind == tokAnd {
+		p.next()
+		q, err := p.parseNot(depth)
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, q)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *tagQueryParser) parseNot(depth int) (TagQuery, error) {
+	if depth > maxTagQueryDepth {
+		return nil, &TagQueryError{Pos: p.peek().pos, Msg: "query nested too deep"}
+	}
+	if p.peek().kind != tokNot {
+		return p.parsePrimary(depth)
+	}
+	p.next()
+	q, err := p.parseNot(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	return TagNot{Query: q}, nil
+}
+
+func (p *tagQueryParser) parsePrimary(depth int) (TagQuery, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokName:
+		p.terms++
+		if p.terms > maxTagQueryTerms {
+			return nil, &TagQueryError{Pos: tok.pos, Msg: "too many tags"}
+		}
+		return TagName(tok.value), nil
+	case tokOpen:
+		q, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokClose {
+			return nil, &TagQueryError{Pos: closing.pos, Msg: fmt.Sprintf("expected ), got %s", closing)}
+		}
+		return q, nil
+	default:
+		return nil, &TagQueryError{Pos: tok.pos, Msg: fmt.Sprintf("expected tag name, got %s", tok)}
+	}
+}
+
+type tagTokenKind int
+
+const (
+	tokEOF tagTokenKind = iota
+	tokName
+	tokAnd
+	tokOr
+	tokNot
+	tokOpen
+	tokClose
+)
+
+type tagToken struct {
+	kind  tagTokenKind
+	value string
+	pos   int
+}
+
+func (t tagToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokName:
+		return strconv.Quote(t.value)
+	default:
+		return t.value
+	}
+}
+
+func isTagKeyword(s string) bool {
+	return s == "AND" || s == "OR" || s == "NOT"
+}
+
+// tokenizeTagQuery split query into tokens. Consecutive words that are not
+// operators are joined into a single tag name.
+func tokenizeTagQuery(s string) ([]tagToken, error) {
+	var tokens []tagToken
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, tagToken{kind: tokOpen, value: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, tagToken{kind: tokClose, value: ")", pos: i})
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return nil, &TagQueryError{Pos: i, Msg: "unterminated quoted tag name"}
+			}
+			name, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, &TagQueryError{Pos: i, Msg: "invalid quoted tag name"}
+			}
+			tokens = append(tokens, tagToken{kind: tokName, value: name, pos: i})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t\r\n()\"", rune(s[end])) {
+				end++
+			}
+			word := s[i:end]
+			switch word {
+			case "AND":
+				tokens = append(tokens, tagToken{kind: tokAnd, value: word, pos: i})
+			case "OR":
+				tokens = append(tokens, tagToken{kind: tokOr, value: word, pos: i})
+			case "NOT":
+				tokens = append(tokens, tagToken{kind: tokNot, value: word, pos: i})
+			default:
+				if n := len(tokens); n > 0 && tokens[n-1].kind == tokName && !tokens[n-1].quoted(s) {
+					tokens[n-1].value += " " + word
+				} else {
+					tokens = append(tokens, tagToken{kind: tokName, value: word, pos: i})
+				}
+			}
+			i = end
+		}
+	}
+
+	for _, tok := range tokens {
+		if tok.kind == tokName && strings.IndexFunc(tok.value, unicode.IsControl) != -1 {
+			return nil, &TagQueryError{Pos: tok.pos, Msg: "tag name contains control characters"}
+		}
+	}
+	return tokens, nil
+}
+
+// quoted return true if token was written in double quotes in given query.
+func (t tagToken) quoted(query string) bool {
+	return query[t.pos] == '"'
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTagQuery(t *testing.T) {
+	cases := map[string]struct {
+		query      string
+		wantString string
+		wantSQL    string
+		wantArgs   []interface{}
+	}{
+		"single_tag": {
+			query:      "holiday",
+			wantString: "holiday",
+			wantSQL:    "EXISTS (SELECT 1 FROM tags t WHERE t.image_id = i.image_id AND t.name = ?)",
+			wantArgs:   []interface{}{"holiday"},
+		},
+		"multi_word_tag": {
+			query:      "  Holiday   in Korea ",
+			wantString: "Holiday in Korea",
+			wantArgs:   []interface{}{"Holiday in Korea"},
+		},
+		"quoted_tag": {
+			query:      `"rock AND roll"`,
+			wantString: `"rock AND roll"`,
+			wantArgs:   []interface{}{"rock AND roll"},
+		},
+		"and": {
+			query:      "a AND b",
+			wantString: "a AND b",
+			wantSQL: "(EXISTS (SELECT 1 FROM tags t WHERE t.image_id = i.image_id AND t.name = ?))" +
+				" AND (EXISTS (SELECT 1 FROM tags t WHERE t.image_id = i.image_id AND t.name = ?))",
+			wantArgs: []interface{}{"a", "b"},
+		},
+		"not": {
+			query:      "NOT blurry",
+			wantString: "NOT blurry",
+			wantSQL:    "NOT (EXISTS (SELECT 1 FROM tags t WHERE t.image_id = i.image_id AND t.name = ?))",
+			wantArgs:   []interface{}{"blurry"},
+		},
+		"precedence": {
+			query:      "a OR b AND NOT c",
+			wantString: "a OR (b AND NOT c)",
+			wantArgs:   []interface{}{"a", "b", "c"},
+		},
+		"full": {
+			query:      "holiday AND (korea OR japan) AND NOT blurry",
+			wantString: "holiday AND (korea OR japan) AND NOT blurry",
+			wantArgs:   []interface{}{"holiday", "korea", "japan", "blurry"},
+		},
+		"not_group": {
+			query:      "NOT (a OR b)",
+			wantString: "NOT (a OR b)",
+			wantArgs:   []interface{}{"a", "b"},
+		},
+	}
+
+	for tname, tc := range cases {
+		q, err := ParseTagQuery(tc.query)
+		if err != nil {
+			t.Errorf("%s: cannot parse: %s", tname, err)
+			continue
+		}
+		if got := q.String(); got != tc.wantString {
+			t.Errorf("%s: want %q, got %q", tname, tc.wantString, got)
+		}
+		sql, args := q.sql()
+		if tc.wantSQL != "" && sql != tc.wantSQL {
+			t.Errorf("%s: \nwant: %s\n got: %s", tname, tc.wantSQL, sql)
+		}
+		if !reflect.DeepEqual(args, tc.wantArgs) {
+			t.Errorf("%s: want %v args, got %v", tname, tc.wantArgs, args)
+		}
+
+		// string representation must parse into the same query
+		again, err := ParseTagQuery(q.String())
+		if err != nil {
+			t.Errorf("%s: cannot parse string representation: %s", tname, err)
+		} else if !reflect.DeepEqual(q, again) {
+			t.Errorf("%s: string representation parsed into different query: %#v", tname, again)
+		}
+	}
+}
+
+func TestParseTagQueryErrors(t *testing.T) {
+	cases := map[string]string{
+		"empty":            "",
+		"missing_operand":  "a AND",
+		"missing_close":    "(a OR b",
+		"unexpected_close": "a)",
+		"two_quoted":       `"a" "b"`,
+		"unterminated":     `"a`,
+		"only_not":         "NOT",
+		"too_deep":         strings.Repeat("(", 40) + "a" + strings.Repeat(")", 40),
+		"too_many_terms":   strings.Repeat("a OR ", 40) + "a",
+		"too_long":         strings.Repeat("a", 2000),
+	}
+
+	for tname, query := range cases {
+		if q, err := ParseTagQuery(query); err == nil {
+			t.Errorf("%s: want error, got %#v", tname, q)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/husio/gallery/sq"
+)
+
+// ErrInvalidTag is returned when tag name is empty or when tag would become
+// an alias of itself.
+var ErrInvalidTag = errors.New("invalid tag name")
+
+// TagAlias is an alternative name of a tag. Aliases are replaced with the
+// tag name when tagging images and when searching by tags.
+type TagAlias struct {
+	Alias   string    `db:"alias"   json:"alias"`
+	Name    string    `db:"name"    json:"name"`
+	Created time.Time `db:"created" json:"created"`
+}
+
+// TagAliases return all defined aliases, ordered by alias.
+func TagAliases(s sq.Selector) ([]*TagAlias, error) {
+	var aliases []*TagAlias
+	err := s.Select(&aliases, `
+		SELECT * FROM tag_aliases
+		ORDER BY alias
+	`)
+	return aliases, sq.CastErr(err)
+}
+
+// tagAliases return mapping of aliases to tag names.
+func tagAliases(s sq.Selector) (map[string]string, error) {
+	aliases, err := TagAliases(s)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(aliases))
+	for _, a := range aliases {
+		names[a.Alias] = a.Name
+	}
+	return names, nil
+}
+
+// ResolveTags return given tag names with aliases replaced by tag names.
+// Duplicates are removed, order is preserved.
+func ResolveTags(s sq.Selector, names []string) ([]string, error) {
+	aliases, err := tagAliases(s)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(names))
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		if n, ok := aliases[name]; ok {
+			name = n
+		}
+		if !seen[name] {
+			seen[name] = true
+			resolved = append(resolved, name)
+		}
+	}
+	return resolved, nil
+}
+
+// resolveTagQuery return query with aliases replaced by tag names.
+func resolveTagQuery(s sq.Selector, q TagQuery) (TagQuery, error) {
+	aliases, err := tagAliases(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(aliases) == 0 {
+		return q, nil
+	}
+	return mapTagNames(q, func(name string) string {
+		if n, ok := aliases[name]; ok {
+			return n
+		}
+		return name
+	}), nil
+}
+
+// mapTagNames return copy of the query with every tag name replaced by the
+// result of fn.
+func mapTagNames(q TagQuery, fn func(string) string) TagQuery {
+	switch q := q.(type) {
+	case TagName:
+		return TagName(fn(string(q)))
+	case TagAnd:
+		mapped := make(TagAnd, len(q))
+		for i, sub := range q {
+			mapped[i] = mapTagNames(sub, fn)
+		}
+		return mapped
+	case TagOr:
+		mapped := make(TagOr, len(q))
+		for i, sub := range q {
+			mapped[i] = mapTagNames(sub, fn)
+		}
+		return mapped
+	case TagNot:
+		return TagNot{Query: mapTagNames(q.Query, fn)}
+	default:
+		panic(fmt.Sprintf("unknown tag query %T", q))
+	}
+}
+
+// TagManager change tags of all images at once, for example to fix a typo in
+// a tag name.
+type TagManager struct {
+	db sq.Database
+}
+
+func NewTagManager(db sq.Database) *TagManager {
+	return &TagManager{db: db}
+}
+
+// Rename change name of a tag. Renaming to the name of an existing tag merges
+// both tags. If keepAlias is true, the old name becomes an alias of the new
+// one. Number of changed image tags is returned.
+func (m *TagManager) Rename(from, to string, keepAlias bool) (int64, error) {
+	return m.Merge([]string{from}, to, keepAlias)
+}
+
+// Merge replace all given tags with a single one. Images that already have
+// that tag keep only one of them. If the tag is an alias, tag that it stands
+// for is used. If keepAliases is true, merged tag names become aliases of
+// the tag. Nothing is changed if any step fails. Number of changed image
+// tags is returned.
+func (m *TagManager) Merge(names []string, into string, keepAliases bool) (int64, error) {
+	var changed int64
+	err := m.inTx(func(tx sq.Connection) error {
+		var err error
+		if changed, err = mergeTags(tx, names, into); err != nil || !keepAliases {
+			return err
+		}
+		resolved, err := resolveTag(tx, into)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if strings.TrimSpace(name) == resolved {
+				continue
+			}
+			if err := setAlias(tx, name, resolved); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// Delete remove given tag from all images, together with its aliases. Number
+// of removed image tags is returned.
+func (m *TagManager) Delete(name string) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, ErrInvalidTag
+	}
+	var deleted int64
+	err := m.inTx(func(tx sq.Connection) error {
+		res, err := tx.Exec(`DELETE FROM tags WHERE name = ?`, name)
+		if err != nil {
+			return sq.CastErr(err)
+		}
+		if deleted, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM tag_aliases WHERE name = ?`, name)
+		return sq.CastErr(err)
+	})
+	return deleted, err
+}
+
+// SetAlias define alias of a tag. Images already tagged with the alias are
+// tagged with the tag instead.
+func (m *TagManager) SetAlias(alias, name string) error {
+	return m.inTx(func(tx sq.Connection) error {
+		return setAlias(tx, alias, name)
+	})
+}
+
+// DeleteAlias remove alias definition. Tags are not changed.
+func (m *TagManager) DeleteAlias(alias string) error {
+	res, err := m.db.Exec(`DELETE FROM tag_aliases WHERE alias = ?`, alias)
+	if err != nil {
+		return sq.CastErr(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sq.ErrNotFound
+	}
+	return nil
+}
+
+// inTx call fn within a transaction, that is committed only if fn succeeds.
+func (m *TagManager) inTx(fn func(sq.Connection) error) error {
+	tx, err := m.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("database error: cannot start transaction: %s", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("database error: cannot commit: %s", err)
+	}
+	return nil
+}
+
+// resolveTag return trimmed tag name, or the name of the tag it is alias of.
+func resolveTag(g sq.Getter, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ErrInvalidTag
+	}
+	var resolved string
+	switch err := sq.CastErr(g.Get(&resolved, `SELECT name FROM tag_aliases WHERE alias = ?`, name)); err {
+	case nil:
+		return resolved, nil
+	case sq.ErrNotFound:
+		return name, nil
+	default:
+		return "", err
+	}
+}
+
+// setAlias define alias of a tag, merging tags named as the alias into it.
+func setAlias(tx sq.Connection, alias, name string) error {
+	alias = strings.TrimSpace(alias)
+	if alias == "" {
+		return ErrInvalidTag
+	}
+	name, err := resolveTag(tx, name)
+	if err != nil {
+		return err
+	}
+	if name == alias {
+		return ErrInvalidTag
+	}
+	if _, err := mergeTags(tx, []string{alias}, name); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO tag_aliases (alias, name, created)
+		VALUES (?, ?, ?)
+	`, alias, name, time.Now())
+	return sq.CastErr(err)
+}
+
+// mergeTags replace all given tags with a single one. Tag primary key does
+// not allow the same tag twice on an image, so tags are copied only to images
+// that do not have it yet. Aliases of merged tags are kept, pointing to the
+// new tag.
+func mergeTags(tx sq.Connection, names []string, into string) (int64, error) {
+	into, err := resolveTag(tx, into)
+	if err != nil {
+		return 0, err
+	}
+	var changed int64
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return 0, ErrInvalidTag
+		}
+		if name == into {
+			continue
+		}
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO tags (name, image_id, created, auto)
+			SELECT ?, image_id, created, auto FROM tags
+			WHERE name = ?
+		`, into, name); err != nil {
+			return 0, sq.CastErr(err)
+		}
+		res, err := tx.Exec(`DELETE FROM tags WHERE name = ?`, name)
+		if err != nil {
+			return 0, sq.CastErr(err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		changed += n
+		if _, err := tx.Exec(`
+			UPDATE tag_aliases SET name = ?
+			WHERE name = ?
+		`, into, name); err != nil {
+			return 0, sq.CastErr(err)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/sq"
+)
+
+func TestTagManager(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := CreateImage(db, Image{ImageID: id, Width: 1, Height: 1, Created: time.Now()}); err != nil {
+			t.Fatalf("cannot create %s image: %s", id, err)
+		}
+	}
+	for _, tag := range []Tag{
+		{ImageID: "a", Name: "Jeju"},
+		{ImageID: "a", Name: "jeju"},
+		{ImageID: "b", Name: "Jeju"},
+		{ImageID: "b", Name: "JEJU"},
+		{ImageID: "c", Name: "korea"},
+		{ImageID: "c", Name: "blurry"},
+	} {
+		if _, err := CreateTag(db, tag); err != nil {
+			t.Fatalf("cannot create tag: %s", err)
+		}
+	}
+
+	// imageTags return tags of all images, sorted
+	imageTags := func() map[string][]string {
+		var tags []*Tag
+		if err := db.Select(&tags, `SELECT * FROM tags`); err != nil {
+			t.Fatalf("cannot list tags: %s", err)
+		}
+		res := make(map[string][]string)
+		for _, tag := range tags {
+			res[tag.ImageID] = append(res[tag.ImageID], tag.Name)
+		}
+		for _, names := range res {
+			sort.Strings(names)
+		}
+		return res
+	}
+
+	m := NewTagManager(sq.NewDatabase(db))
+
+	// image "a" has both tags, so one is dropped
+	if n, err := m.Merge([]string{"Jeju", "JEJU"}, "jeju", false); err != nil || n != 3 {
+		t.Fatalf("want 3 tags merged, got %d: %v", n, err)
+	}
+	want := map[string][]string{"a": {"jeju"}, "b": {"jeju"}, "c": {"blurry", "korea"}}
+	if got := imageTags(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	if n, err := m.Rename("korea", "Korea", false); err != nil || n != 1 {
+		t.Fatalf("want 1 tag renamed, got %d: %v", n, err)
+	}
+	if n, err := m.Delete("blurry"); err != nil || n != 1 {
+		t.Fatalf("want 1 tag deleted, got %d: %v", n, err)
+	}
+	want = map[string][]string{"a": {"jeju"}, "b": {"jeju"}, "c": {"Korea"}}
+	if got := imageTags(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// alias of existing tag merges it
+	if _, err := CreateTag(db, Tag{ImageID: "c", Name: "Jeju-do"}); err != nil {
+		t.Fatalf("cannot create tag: %s", err)
+	}
+	if err := m.SetAlias("Jeju-do", "jeju"); err != nil {
+		t.Fatalf("cannot set alias: %s", err)
+	}
+	if err := m.SetAlias("Jeju", "jeju"); err != nil {
+		t.Fatalf("cannot set alias: %s", err)
+	}
+	want = map[string][]string{"a": {"jeju"}, "b": {"jeju"}, "c": {"Korea", "jeju"}}
+	if got := imageTags(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if err := m.SetAlias("jeju", "Jeju"); err != ErrInvalidTag {
+		t.Errorf("want alias of itself rejected, got %v", err)
+	}
+	if _, err := m.Merge([]string{" "}, "jeju", false); err != ErrInvalidTag {
+		t.Errorf("want empty name rejected, got %v", err)
+	}
+
+	// renaming a tag keeps its aliases
+	if _, err := m.Rename("jeju", "Jeju Island", false); err != nil {
+		t.Fatalf("cannot rename: %s", err)
+	}
+	aliases, err := TagAliases(db)
+	if err != nil {
+		t.Fatalf("cannot list aliases: %s", err)
+	}
+	for _, a := range aliases {
+		if a.Name != "Jeju Island" {
+			t.Errorf("want %s alias of renamed tag, got %s", a.Alias, a.Name)
+		}
+	}
+
+	resolved, err := ResolveTags(db, []string{"Jeju", "Korea", "Jeju-do", "other"})
+	if err != nil {
+		t.Fatalf("cannot resolve tags: %s", err)
+	}
+	if want := []string{"Jeju Island", "Korea", "other"}; !reflect.DeepEqual(resolved, want) {
+		t.Errorf("want %v, got %v", want, resolved)
+	}
+
+	q, err := ParseTagQuery("Jeju AND NOT Korea")
+	if err != nil {
+		t.Fatalf("cannot parse tag query: %s", err)
+	}
+	imgs, err := Images(db, ImagesOpts{Limit: 10, Tags: q})
+	if err != nil {
+		t.Fatalf("cannot list images: %s", err)
+	}
+	var ids []string
+	for _, img := range imgs {
+		ids = append(ids, img.ImageID)
+	}
+	sort.Strings(ids)
+	if want := []string{"a", "b"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("want %v found by alias, got %v", want, ids)
+	}
+
+	// failed alias creation reverts merging
+	if _, err := db.Exec(`
+		CREATE TRIGGER no_aliases BEFORE INSERT ON tag_aliases
+		BEGIN SELECT RAISE(ABORT, 'no aliases'); END
+	`); err != nil {
+		t.Fatalf("cannot create trigger: %s", err)
+	}
+	if _, err := m.Merge([]string{"Korea"}, "Jeju Island", true); err == nil {
+		t.Fatal("want merge error")
+	}
+	want = map[string][]string{"a": {"Jeju Island"}, "b": {"Jeju Island"}, "c": {"Jeju Island", "Korea"}}
+	if got := imageTags(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if _, err := db.Exec(`DROP TRIGGER no_aliases`); err != nil {
+		t.Fatalf("cannot drop trigger: %s", err)
+	}
+	if _, err := m.Rename("Korea", "South Korea", true); err != nil {
+		t.Fatalf("cannot rename: %s", err)
+	}
+	if resolved, err := ResolveTags(db, []string{"Korea"}); err != nil || !reflect.DeepEqual(resolved, []string{"South Korea"}) {
+		t.Errorf("want renamed tag kept as alias, got %v: %v", resolved, err)
+	}
+
+	if err := m.DeleteAlias("Jeju"); err != nil {
+		t.Errorf("cannot delete alias: %s", err)
+	}
+	if err := m.DeleteAlias("Jeju"); err != sq.ErrNotFound {
+		t.Errorf("want not found error, got %v", err)
+	}
+	if _, err := m.Delete("Jeju Island"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	if aliases, err := TagAliases(db); err != nil || len(aliases) != 1 || aliases[0].Alias != "Korea" {
+		t.Errorf("want only aliases of deleted tag removed, got %v: %v", aliases, err)
+	}
+}
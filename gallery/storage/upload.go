@@ -1,135 +1,447 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"image/jpeg"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/husio/gallery/gallery/palette"
+	"github.com/husio/gallery/gallery/phash"
+	"github.com/husio/gallery/gallery/quality"
 	"github.com/husio/gallery/sq"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
 type Uploader struct {
-	db sq.Execer
-	fs *FileStore
+	db          sq.Database
+	fs          *FileStore
+	places      PlaceFinder
+	pregenerate Presets
 }
 
-func NewUploader(db sq.Execer, fs *FileStore) *Uploader {
+// NewUploader return uploader that stores images in given storages. If places
+// is not nil, geotagged images are automatically tagged with place names.
+// Renditions for all pregenerate presets are created right after the upload.
+func NewUploader(db sq.Database, fs *FileStore, places PlaceFinder, pregenerate Presets) *Uploader {
 	return &Uploader{
-		db: db,
-		fs: fs,
+		db:          db,
+		fs:          fs,
+		places:      places,
+		pregenerate: pregenerate,
 	}
 }
 
-func (u *Uploader) Upload(fd io.ReadSeeker, tags []string) error {
+// UploadResult describe the outcome of a single file upload.
+type UploadResult struct {
+	Image *Image
+	// Created is false if the same image was already uploaded before.
+	Created bool
+	// Tags lists all tags applied to the image, including automatically
+	// created ones.
+	Tags []string
+}
+
+// Upload store given image content together with its metadata. Tag aliases
+// are replaced with tag names. Content is read only once. All database
+// changes are done in a single transaction and if it fails, newly written
+// image file is removed.
+func (u *Uploader) Upload(r io.Reader, tags []string) (*UploadResult, error) {
 	now := time.Now()
 
-	image, err := imageMeta(fd)
+	tags, err := ResolveTags(u.db, tags)
 	if err != nil {
-		return fmt.Errorf("cannot extract metadata: %s", err)
+		return nil, fmt.Errorf("database error: cannot resolve tag aliases: %s", err)
 	}
-	if image.Created.IsZero() {
-		image.Created = now
+
+	image, created, err := ingest(u.fs, r, now)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := fd.Seek(0, os.SEEK_SET); err != nil {
-		return fmt.Errorf("cannot seek: %s", err)
+	// features are only used for searching, so failure is not critical
+	var feat *features
+	if created {
+		if feat, err = analyze(u.fs, image); err != nil {
+			log.Printf("cannot analyze %q image: %s", image.ImageID, err)
+		}
 	}
 
-	if err := u.fs.Put(image, fd); err != nil {
-		return fmt.Errorf("cannot storage file: %s", err)
+	tx, err := u.db.Beginx()
+	if err != nil {
+		u.discard(image, created)
+		return nil, fmt.Errorf("database error: cannot start transaction: %s", err)
 	}
+	res, err := u.store(tx, image, feat, tags, now)
+	if err != nil {
+		tx.Rollback()
+		u.discard(image, created)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		u.discard(image, created)
+		return nil, fmt.Errorf("database error: cannot commit: %s", err)
+	}
+
+	// renditions can always be created later, so failure is not critical
+	if res.Created && len(u.pregenerate) != 0 {
+		if err := u.fs.PutRenditions(image, u.pregenerate); err != nil {
+			log.Printf("cannot create %q image renditions: %s", image.ImageID, err)
+		}
+	}
+	return res, nil
+}
 
-	// store image in database
-	image, err = CreateImage(u.db, *image)
+// discard remove image file written by failed upload. Files that existed
+// before the upload belong to already stored images and are not removed.
+func (u *Uploader) discard(img *Image, created bool) {
+	if !created {
+		return
+	}
+	if err := u.fs.Remove(img); err != nil {
+		log.Printf("cannot remove %q image file: %s", img.ImageID, err)
+	}
+}
+
+// store write image information and tags into the database. Image features
+// are stored only if given.
+func (u *Uploader) store(e sq.Execer, image *Image, feat *features, tags []string, now time.Time) (*UploadResult, error) {
+	res := UploadResult{Image: image, Created: true}
+
+	image, err := CreateImage(e, *image)
 	switch err {
 	case nil:
 		// all good
 	case sq.ErrConflict:
-		// image already exists, nothing more to do here
+		// image already exists, only tags can be added
+		res.Created = false
 	default:
-		return fmt.Errorf("database error: cannot store photo: %s", err)
+		return nil, fmt.Errorf("database error: cannot store photo: %s", err)
+	}
+
+	if image.EXIF != nil {
+		if err := PutImageEXIF(e, *image.EXIF); err != nil {
+			return nil, fmt.Errorf("database error: cannot store EXIF: %s", err)
+		}
 	}
 
 	for _, name := range tags {
-		_, err := CreateTag(u.db, Tag{
+		_, err := CreateTag(e, Tag{
 			ImageID: image.ImageID,
 			Name:    name,
 			Created: now,
 		})
 		switch err {
-		case nil:
-			// all good
-		case sq.ErrConflict:
-			// image already exists, nothing more to do here
+		case nil, sq.ErrConflict:
+			// tag might be already set by previous upload
+			res.Tags = append(res.Tags, name)
 		default:
-			return fmt.Errorf("database error: cannot tag: %s", err)
+			return nil, fmt.Errorf("database error: cannot tag: %s", err)
+		}
+	}
+
+	if u.places != nil && image.Latitude != nil {
+		created, err := TagPlaces(e, u.places, image)
+		if err != nil {
+			return nil, fmt.Errorf("database error: cannot tag places: %s", err)
+		}
+		res.Tags = append(res.Tags, created...)
+	}
+
+	if feat != nil {
+		if err := PutImageHash(e, image.ImageID, feat.hash); err != nil {
+			return nil, fmt.Errorf("database error: cannot store hash: %s", err)
+		}
+		if err := PutImagePalette(e, image.ImageID, feat.colors); err != nil {
+			return nil, fmt.Errorf("database error: cannot store palette: %s", err)
+		}
+		if err := PutImageQuality(e, image.ImageID, feat.quality); err != nil {
+			return nil, fmt.Errorf("database error: cannot store quality: %s", err)
 		}
 	}
 
-	return nil
+	return &res, nil
 }
 
-func imageMeta(r io.ReadSeeker) (*Image, error) {
-	conf, err := jpeg.DecodeConfig(r)
+// features are properties of the image content, that are used for
+// searching.
+type features struct {
+	hash    uint64
+	colors  []palette.Color
+	quality quality.Scores
+}
+
+// analyze compute features of given image content. Image is decoded only
+// once and its palette and quality are set.
+func analyze(fs *FileStore, img *Image) (*features, error) {
+	// quality measurement needs the biggest copy of the image
+	src, err := analysisImage(fs, img, quality.AnalysisSize)
 	if err != nil {
-		return nil, fmt.Errorf("cannot decode JPEG: %s", err)
+		return nil, err
+	}
+	feat := features{
+		hash:    phash.DHash(src),
+		colors:  palette.Extract(src, PaletteSize),
+		quality: quality.Measure(src),
 	}
+	img.Palette = newPalette(img.ImageID, feat.colors)
+	img.Quality = newQuality(img.ImageID, feat.quality)
+	return &feat, nil
+}
+
+// maxHeaderSize is the number of bytes from the beginning of the file that are
+// kept in memory for image configuration and EXIF metadata decoding. For
+// almost all images this is enough to not read the file again.
+const maxHeaderSize = 256 << 10
+
+// ingest copy content into the file store, computing its checksum and
+// decoding its metadata in the same pass. Content is first written into a
+// temporary file, which is renamed once the image ID and creation time are
+// known. File spooled by the store is read, but not copied, and it is moved
+// instead of the temporary file. Images without creation time in metadata
+// are created at given time. Returned flag is false if the image file already
+// existed.
+func ingest(fs *FileStore, r io.Reader, now time.Time) (*Image, bool, error) {
+	// checksum of spooled file is already known, unless the ID is not
+	// the checksum of the whole content
+	sf, spooled := r.(*SpooledFile)
+	inPlace := spooled && filepath.Dir(sf.Name()) == fs.spoolDir()
 
-	// compute image hash from image content
-	oid := sha256.New()
-	if _, err := io.Copy(oid, r); err != nil {
-		return nil, fmt.Errorf("cannot compute SHA: %s", err)
+	var tmp *os.File
+	if inPlace {
+		// removing spooled file is up to the caller
+		tmp = sf.File
+	} else {
+		var err error
+		if tmp, err = fs.TempFile(); err != nil {
+			return nil, false, fmt.Errorf("cannot create temporary file: %s", err)
+		}
+		defer func() {
+			// no-op if the file was already moved to its final location
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
 	}
-	img := Image{
-		ImageID: encode(oid),
-		Width:   conf.Width,
-		Height:  conf.Height,
+
+	header := headBuffer{buf: make([]byte, 0, maxHeaderSize), max: maxHeaderSize}
+	hasher := idHasher{head: &header, hashAll: !spooled}
+	w := io.MultiWriter(&header, &hasher)
+	if !inPlace {
+		w = io.MultiWriter(tmp, &header, &hasher)
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	size, err := io.CopyBuffer(w, r, *buf)
+	copyBuffers.Put(buf)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot write image: %s", err)
 	}
 
-	if _, err := r.Seek(0, os.SEEK_SET); err != nil {
-		return nil, fmt.Errorf("cannot seek: %s", err)
+	// only the file header is read, unless it was not big enough
+	var full io.ReadSeeker
+	if size > int64(len(header.buf)) {
+		full = tmp
 	}
-	if meta, err := exif.Decode(r); err != nil {
-		log.Printf("cannot extract EXIF metadata: %s", err)
+	img, err := decodeMeta(header.buf, full)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot extract metadata: %s", err)
+	}
+	if sum := hasher.Sum(); sum != nil {
+		img.ImageID = encodeSum(sum)
 	} else {
-		if orientation, err := meta.Get(exif.Orientation); err != nil {
-			log.Printf("cannot extract image orientation: %s", err)
-		} else {
-			if o, err := orientation.Int(0); err != nil {
-				log.Printf("cannot format orientation: %s", err)
-			} else {
-				img.Orientation = o
-			}
-		}
-		if dt, err := meta.Get(exif.DateTimeOriginal); err != nil {
-			log.Printf("cannot extract image datetime original: %s", err)
-		} else {
-			if raw, err := dt.StringVal(); err != nil {
-				log.Printf("cannot format datetime original: %s", err)
-			} else {
-				img.Created, err = time.Parse("2006:01:02 15:04:05", raw)
-				if err != nil {
-					log.Printf("cannot parse datetime original: %s", err)
-				}
-			}
+		img.ImageID = encodeSum(sf.SHA256())
+	}
+	if img.EXIF != nil {
+		img.EXIF.ImageID = img.ImageID
+	}
+	if img.Created.IsZero() {
+		img.Created = now
+	}
+
+	if !inPlace {
+		if err := tmp.Close(); err != nil {
+			return nil, false, fmt.Errorf("cannot write image: %s", err)
+		}
+	}
+	created, err := fs.Commit(img, tmp.Name())
+	if err != nil {
+		if created {
+			fs.Remove(img)
 		}
+		return nil, false, fmt.Errorf("cannot store file: %s", err)
 	}
+	return img, created, nil
+}
 
+// decodeMeta return image with all fields that can be read from the file
+// content set, except of the ID. Header is the beginning of the file. If
+// header does not contain the whole file, full content must be provided as
+// well, so that it can be used if decoding the header is not enough.
+func decodeMeta(header []byte, full io.ReadSeeker) (*Image, error) {
+	conf, mt, err := detectMediaType(bytes.NewReader(header))
+	if err != nil {
+		if full == nil {
+			return nil, err
+		}
+		if _, err := full.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("cannot seek: %s", err)
+		}
+		if conf, mt, err = detectMediaType(full); err != nil {
+			return nil, err
+		}
+	}
+	img := Image{
+		Width:     conf.Width,
+		Height:    conf.Height,
+		MediaType: mt.mediaType,
+	}
+
+	// only some formats can contain EXIF metadata
+	if !mt.exif {
+		return &img, nil
+	}
+
+	meta, err := exif.Decode(bytes.NewReader(header))
+	if meta == nil && full != nil {
+		if _, err := full.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("cannot seek: %s", err)
+		}
+		meta, err = exif.Decode(full)
+	}
+	if err != nil {
+		log.Printf("cannot extract EXIF metadata: %s", err)
+	}
+	// non critical errors still return partially decoded metadata
+	if meta != nil {
+		applyEXIF(&img, meta)
+	}
 	return &img, nil
 }
 
-func encode(h hasher) string {
-	s := base64.URLEncoding.EncodeToString(h.Sum(nil))
-	return strings.TrimRight(s, "=")
+// copyBuffers keep buffers used to copy uploaded content. Big buffer greatly
+// reduces the number of system calls when writing to several destinations.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 1<<20)
+		return &b
+	},
+}
+
+// headBuffer is a writer that keeps only the first max bytes written.
+type headBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if free := b.max - len(b.buf); free > 0 {
+		if len(p) < free {
+			free = len(p)
+		}
+		b.buf = append(b.buf, p[:free]...)
+	}
+	return len(p), nil
 }
 
-type hasher interface {
-	Sum(b []byte) []byte
+// idHasher compute checksum of the content that the image ID is made of,
+// while the content is written. Head must be written before the hasher.
+//
+// JPEG images are identified by the checksum of the content that follows the
+// part read by jpeg.DecodeConfig, as they always were, so that uploading an
+// image again does not create a duplicate. Other images are identified by the
+// checksum of the whole content.
+type idHasher struct {
+	head *headBuffer
+	// hashAll is false if only JPEG images should be hashed
+	hashAll bool
+
+	written int64
+	decided bool
+	// h is nil if the content is not hashed
+	h hash.Hash
+}
+
+func (ih *idHasher) Write(p []byte) (int, error) {
+	if ih.decided {
+		if ih.h != nil {
+			ih.h.Write(p)
+		}
+		return len(p), nil
+	}
+	ih.written += int64(len(p))
+	if ih.written < int64(ih.head.max) {
+		return len(p), nil
+	}
+	ih.decide()
+	if ih.h != nil {
+		// part of p that did not fit into the head
+		rest := ih.written - int64(len(ih.head.buf))
+		ih.h.Write(p[int64(len(p))-rest:])
+	}
+	return len(p), nil
+}
+
+// decide choose hashing method once the head is complete.
+func (ih *idHasher) decide() {
+	ih.decided = true
+	offset, ok := jpegIDOffset(ih.head.buf)
+	// decoder that read the whole head would read more of the full
+	// content, and tiny images read as a whole would all be the same
+	if ok && offset >= len(ih.head.buf) {
+		ok = false
+	}
+	switch {
+	case ok:
+		ih.h = sha256.New()
+		ih.h.Write(ih.head.buf[offset:])
+	case ih.hashAll:
+		ih.h = sha256.New()
+		ih.h.Write(ih.head.buf)
+	}
+}
+
+// Sum return checksum of the written content or nil if it was not hashed.
+func (ih *idHasher) Sum() []byte {
+	if !ih.decided {
+		ih.decide()
+	}
+	if ih.h == nil {
+		return nil
+	}
+	return ih.h.Sum(nil)
+}
+
+// jpegIDOffset return the number of bytes that jpeg.DecodeConfig reads from
+// given JPEG image header. False is returned if header is not a JPEG image.
+func jpegIDOffset(header []byte) (int, bool) {
+	r := countingReader{r: bytes.NewReader(header)}
+	if _, err := jpeg.DecodeConfig(&r); err != nil {
+		return 0, false
+	}
+	return int(r.n), true
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// encodeSum return image ID for given content checksum.
+func encodeSum(sum []byte) string {
+	s := base64.URLEncoding.EncodeToString(sum)
+	return strings.TrimRight(s, "=")
 }
@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/sq"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func TestIngest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileStore(dir, NewDirRenditionStore(dir), 0)
+
+	content := testJPEG(t, 64, 48, 6)
+	now := time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)
+	img, created, err := ingest(fs, bytes.NewReader(content), now)
+	if err != nil {
+		t.Fatalf("cannot ingest: %s", err)
+	}
+	if !created {
+		t.Error("want new file to be created")
+	}
+
+	offset, ok := jpegIDOffset(content)
+	if !ok {
+		t.Fatal("want JPEG image")
+	}
+	sum := sha256.Sum256(content[offset:])
+	if offset >= len(content) {
+		sum = sha256.Sum256(content)
+	}
+	if want := encodeSum(sum[:]); img.ImageID != want {
+		t.Errorf("want %q ID, got %q", want, img.ImageID)
+	}
+	if img.Width != 64 || img.Height != 48 {
+		t.Errorf("want 64x48 image, got %dx%d", img.Width, img.Height)
+	}
+	if img.Orientation != 6 {
+		t.Errorf("want orientation 6, got %d", img.Orientation)
+	}
+	if !img.Created.Equal(now) {
+		t.Errorf("want %s creation time, got %s", now, img.Created)
+	}
+
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "2015", img.ImageID+".jpg"))
+	if err != nil {
+		t.Fatalf("cannot read stored file: %s", err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Error("stored file content differs")
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, ".ingest-*")); len(tmp) != 0 {
+		t.Errorf("temporary files not removed: %v", tmp)
+	}
+
+	if _, created, err := ingest(fs, bytes.NewReader(content), now); err != nil || created {
+		t.Errorf("want existing file to be reused, got %v, %v", created, err)
+	}
+
+	if _, _, err := ingest(fs, bytes.NewReader([]byte("not an image")), now); err == nil {
+		t.Error("want error for invalid content")
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, ".ingest-*")); len(tmp) != 0 {
+		t.Errorf("temporary files not removed after failure: %v", tmp)
+	}
+}
+
+func TestIngestImageID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileStore(dir, NewDirRenditionStore(dir), 0)
+
+	// baselineID is how JPEG images were always identified
+	baselineID := func(content []byte) string {
+		r := bytes.NewReader(content)
+		if _, err := jpeg.DecodeConfig(r); err != nil {
+			t.Fatalf("cannot decode: %s", err)
+		}
+		h := sha256.New()
+		io.Copy(h, r)
+		return encodeSum(h.Sum(nil))
+	}
+	wholeID := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		return encodeSum(sum[:])
+	}
+	var pngContent bytes.Buffer
+	if err := png.Encode(&pngContent, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatalf("cannot encode: %s", err)
+	}
+	small := testJPEG(t, 200, 150, 1)
+	large := testJPEG(t, 900, 900, 1)
+	if len(large) <= maxHeaderSize {
+		t.Fatalf("want image bigger than the header, got %d bytes", len(large))
+	}
+
+	cases := map[string]struct {
+		content []byte
+		want    string
+	}{
+		"small jpeg": {content: small, want: baselineID(small)},
+		"large jpeg": {content: large, want: baselineID(large)},
+		"png":        {content: pngContent.Bytes(), want: wholeID(pngContent.Bytes())},
+	}
+	for tname, tc := range cases {
+		img, _, err := ingest(fs, bytes.NewReader(tc.content), time.Now())
+		if err != nil {
+			t.Fatalf("%s: cannot ingest: %s", tname, err)
+		}
+		if img.ImageID != tc.want {
+			t.Errorf("%s: want %s ID, got %s", tname, tc.want, img.ImageID)
+		}
+
+		sf, err := Spool(dir, bytes.NewReader(tc.content), int64(len(tc.content)))
+		if err != nil {
+			t.Fatalf("%s: cannot spool: %s", tname, err)
+		}
+		img, _, err = ingest(fs, sf, time.Now())
+		sf.Remove()
+		if err != nil {
+			t.Fatalf("%s: cannot ingest spooled file: %s", tname, err)
+		}
+		if img.ImageID != tc.want {
+			t.Errorf("%s: want %s ID of spooled file, got %s", tname, tc.want, img.ImageID)
+		}
+		fs.Remove(img)
+
+		// file spooled by the store is moved instead of copied
+		sf, err = fs.Spool(bytes.NewReader(tc.content), int64(len(tc.content)))
+		if err != nil {
+			t.Fatalf("%s: cannot spool: %s", tname, err)
+		}
+		img, created, err := ingest(fs, sf, time.Now())
+		if err != nil {
+			t.Fatalf("%s: cannot ingest file spooled by the store: %s", tname, err)
+		}
+		if img.ImageID != tc.want || !created {
+			t.Errorf("%s: want %s ID of created image, got %s, %v", tname, tc.want, img.ImageID, created)
+		}
+		if _, err := os.Stat(sf.Name()); !os.IsNotExist(err) {
+			t.Errorf("%s: want spooled file moved, got %v", tname, err)
+		}
+		if rd, err := fs.Read(img); err != nil {
+			t.Errorf("%s: cannot read stored image: %s", tname, err)
+		} else {
+			content, _ := ioutil.ReadAll(rd)
+			rd.Close()
+			if !bytes.Equal(content, tc.content) {
+				t.Errorf("%s: stored image content differs", tname)
+			}
+		}
+		sf.Remove()
+	}
+}
+
+func TestUploadRollback(t *testing.T) {
+	content := testJPEG(t, 64, 48, 1)
+
+	cases := map[string]struct {
+		db           fakeDB
+		existingFile bool
+		wantErr      bool
+		wantCommit   bool
+		wantRollback bool
+		wantFile     bool
+	}{
+		"ok": {
+			wantCommit: true,
+			wantFile:   true,
+		},
+		"begin_failure": {
+			db:      fakeDB{failBegin: true},
+			wantErr: true,
+		},
+		"image_insert_failure": {
+			db:           fakeDB{failExec: 1},
+			wantErr:      true,
+			wantRollback: true,
+		},
+		"tag_insert_failure": {
+			// image, EXIF and then first tag
+			db:           fakeDB{failExec: 3},
+			wantErr:      true,
+			wantRollback: true,
+		},
+		"commit_failure": {
+			db:      fakeDB{failCommit: true},
+			wantErr: true,
+		},
+		"existing_file_not_removed": {
+			db:           fakeDB{failExec: 1},
+			existingFile: true,
+			wantErr:      true,
+			wantRollback: true,
+			wantFile:     true,
+		},
+	}
+
+	for tname, tc := range cases {
+		dir, err := ioutil.TempDir("", "upload")
+		if err != nil {
+			t.Fatalf("cannot create directory: %s", err)
+		}
+		fs := NewFileStore(dir, NewDirRenditionStore(dir), 0)
+		if tc.existingFile {
+			if _, _, err := ingest(fs, bytes.NewReader(content), time.Now()); err != nil {
+				t.Fatalf("%s: cannot ingest: %s", tname, err)
+			}
+		}
+
+		db := tc.db
+		_, err = NewUploader(&db, fs, nil, nil).Upload(bytes.NewReader(content), []string{"a", "b"})
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%s: want error %v, got %v", tname, tc.wantErr, err)
+		}
+		if db.committed != tc.wantCommit {
+			t.Errorf("%s: want commit %v, got %v", tname, tc.wantCommit, db.committed)
+		}
+		if db.rolledBack != tc.wantRollback {
+			t.Errorf("%s: want rollback %v, got %v", tname, tc.wantRollback, db.rolledBack)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*", "*.jpg"))
+		if gotFile := len(files) == 1; gotFile != tc.wantFile {
+			t.Errorf("%s: want file %v, got %v", tname, tc.wantFile, files)
+		}
+		if tmp, _ := filepath.Glob(filepath.Join(dir, ".ingest-*")); len(tmp) != 0 {
+			t.Errorf("%s: temporary files not removed: %v", tname, tmp)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+var errInjected = errors.New("injected failure")
+
+// fakeDB is database connection that fails on demand.
+type fakeDB struct {
+	// failExec is the number of Exec call that fails, starting from 1. Zero
+	// means no failure.
+	failExec   int
+	failBegin  bool
+	failCommit bool
+
+	execs      int
+	committed  bool
+	rolledBack bool
+}
+
+func (db *fakeDB) Beginx() (sq.Connection, error) {
+	if db.failBegin {
+		return nil, errInjected
+	}
+	return db, nil
+}
+
+func (db *fakeDB) Get(dest interface{}, query string, args ...interface{}) error {
+	return sq.ErrNotFound
+}
+
+func (db *fakeDB) Select(dest interface{}, query string, args ...interface{}) error {
+	return nil
+}
+
+func (db *fakeDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	db.execs++
+	if db.execs == db.failExec {
+		return nil, errInjected
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (db *fakeDB) Commit() error {
+	if db.failCommit {
+		return errInjected
+	}
+	db.committed = true
+	return nil
+}
+
+func (db *fakeDB) Rollback() error {
+	db.rolledBack = true
+	return nil
+}
+
+func TestDecodeMetaHeaderFallback(t *testing.T) {
+	content := testJPEG(t, 64, 48, 3)
+
+	// header too short to contain neither EXIF nor image configuration
+	img, err := decodeMeta(content[:20], bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("cannot decode: %s", err)
+	}
+	if img.Width != 64 || img.Height != 48 || img.Orientation != 3 {
+		t.Errorf("invalid metadata: %dx%d, orientation %d", img.Width, img.Height, img.Orientation)
+	}
+
+	if _, err := decodeMeta(content[:20], nil); err == nil {
+		t.Error("want error for truncated content")
+	}
+}
+
+// testJPEG return JPEG encoded image of given size with random content and
+// EXIF orientation tag set.
+func testJPEG(t testing.TB, width, height, orientation int) []byte {
+	rnd := rand.New(rand.NewSource(int64(width * height)))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(rnd.Intn(256)), uint8(x), uint8(y), 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, nil); err != nil {
+		t.Fatalf("cannot encode: %s", err)
+	}
+	return withEXIF(b.Bytes(), orientation, nil)
+}
+
+// withEXIF return JPEG image with EXIF metadata containing orientation tag
+// and, if not nil, embedded JPEG preview.
+func withEXIF(raw []byte, orientation int, preview []byte) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II*\x00")
+	binary.Write(&tiff, binary.LittleEndian, uint32(8))
+	// IFD0 with single orientation tag
+	binary.Write(&tiff, binary.LittleEndian, uint16(1))
+	binary.Write(&tiff, binary.LittleEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.LittleEndian, uint32(1))
+	binary.Write(&tiff, binary.LittleEndian, []uint16{uint16(orientation), 0})
+	if preview == nil {
+		binary.Write(&tiff, binary.LittleEndian, uint32(0))
+	} else {
+		// IFD1 directly after IFD0, followed by the preview content
+		binary.Write(&tiff, binary.LittleEndian, uint32(26))
+		binary.Write(&tiff, binary.LittleEndian, uint16(2))
+		binary.Write(&tiff, binary.LittleEndian, []uint16{0x0201, 4})
+		binary.Write(&tiff, binary.LittleEndian, []uint32{1, 56})
+		binary.Write(&tiff, binary.LittleEndian, []uint16{0x0202, 4})
+		binary.Write(&tiff, binary.LittleEndian, []uint32{1, uint32(len(preview))})
+		binary.Write(&tiff, binary.LittleEndian, uint32(0))
+		tiff.Write(preview)
+	}
+
+	var out bytes.Buffer
+	out.Write(raw[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, binary.BigEndian, uint16(2+6+tiff.Len()))
+	out.WriteString("Exif\x00\x00")
+	out.Write(tiff.Bytes())
+	out.Write(raw[2:])
+	return out.Bytes()
+}
+
+func BenchmarkIngest(b *testing.B) {
+	benchmarkIngest(b, func(fs *FileStore, r io.ReadSeeker, now time.Time) error {
+		_, _, err := ingest(fs, r, now)
+		return err
+	})
+}
+
+func BenchmarkIngestLegacy(b *testing.B) {
+	benchmarkIngest(b, legacyIngest)
+}
+
+func benchmarkIngest(b *testing.B, ingestFn func(*FileStore, io.ReadSeeker, time.Time) error) {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		b.Fatalf("cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fs := NewFileStore(dir, NewDirRenditionStore(dir), 0)
+
+	// read content from a file, as it is done when uploading
+	srcPath := filepath.Join(dir, "source.jpg")
+	content := testJPEG(b, 2000, 1500, 1)
+	if err := ioutil.WriteFile(srcPath, content, 0640); err != nil {
+		b.Fatalf("cannot write source file: %s", err)
+	}
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src, err := os.Open(srcPath)
+		if err != nil {
+			b.Fatalf("cannot open source file: %s", err)
+		}
+		if err := ingestFn(fs, src, now); err != nil {
+			b.Fatalf("cannot ingest: %s", err)
+		}
+		src.Close()
+
+		// every upload is writing a new file
+		b.StopTimer()
+		os.RemoveAll(filepath.Join(dir, "2016"))
+		b.StartTimer()
+	}
+}
+
+// legacyIngest is the implementation of ingest used before the single pass
+// pipeline, that reads the content once for every processing step.
+func legacyIngest(fs *FileStore, r io.ReadSeeker, now time.Time) error {
+	conf, mt, err := detectMediaType(r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	oid := sha256.New()
+	if _, err := io.Copy(oid, r); err != nil {
+		return err
+	}
+	img := Image{
+		ImageID:   encodeSum(oid.Sum(nil)),
+		Width:     conf.Width,
+		Height:    conf.Height,
+		MediaType: mt.mediaType,
+		Created:   now,
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if meta, _ := exif.Decode(r); meta != nil {
+		applyEXIF(&img, meta)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return fs.Put(&img, r)
+}
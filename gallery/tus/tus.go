@@ -0,0 +1,505 @@
+// Package tus implements server side of the tus resumable upload protocol,
+// version 1.0.0, with creation, expiration, checksum and termination
+// extensions.
+//
+// See http://tus.io/protocols/resumable-upload.html
+package tus
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/husio/gallery/web"
+)
+
+const (
+	Version    = "1.0.0"
+	Extensions = "creation,expiration,checksum,termination"
+
+	// StatusChecksumMismatch is returned when uploaded chunk does not match
+	// provided checksum.
+	StatusChecksumMismatch = 460
+)
+
+// Handler is called with content of every completed upload and metadata
+// provided by the client when the upload was created.
+type Handler func(fd io.ReadSeeker, meta map[string]string) error
+
+// Server keeps state of all uploads in a single directory, so that uploads
+// survive application restarts.
+type Server struct {
+	dir      string
+	basePath string
+	maxSize  int64
+	expiry   time.Duration
+	complete Handler
+
+	mu   sync.Mutex
+	busy map[string]struct{}
+}
+
+// NewServer return server storing partial uploads in given directory. Upload
+// URLs are created by appending upload ID to basePath. Uploads that were not
+// modified for longer than expiry time are removed by Sweep.
+func NewServer(dir, basePath string, maxSize int64, expiry time.Duration, complete Handler) *Server {
+	return &Server{
+		dir:      dir,
+		basePath: strings.TrimRight(basePath, "/"),
+		maxSize:  maxSize,
+		expiry:   expiry,
+		complete: complete,
+		busy:     make(map[string]struct{}),
+	}
+}
+
+// info is upload state stored next to uploaded content. Current offset is
+// always the size of the content file.
+type info struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// Collection handles requests to the base path: server capabilities
+// discovery and upload creation.
+func (s *Server) Collection(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		s.options(w)
+	case "POST":
+		if !s.checkVersion(w, r) {
+			return
+		}
+		s.create(w, r)
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		web.StdJSONResp(w, http.StatusMethodNotAllowed)
+	}
+}
+
+// Upload handles requests to single upload resource.
+func (s *Server) Upload(w http.ResponseWriter, r *http.Request, arg web.PathArg) {
+	if r.Method == "OPTIONS" {
+		s.options(w)
+		return
+	}
+	if !s.checkVersion(w, r) {
+		return
+	}
+
+	id := arg(0)
+	if !validID.MatchString(id) {
+		web.StdJSONResp(w, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		s.head(w, id)
+	case "PATCH":
+		s.patch(w, r, id)
+	case "DELETE":
+		s.terminate(w, id)
+	default:
+		w.Header().Set("Allow", "OPTIONS, HEAD, PATCH, DELETE")
+		web.StdJSONResp(w, http.StatusMethodNotAllowed)
+	}
+}
+
+var validID = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+func (s *Server) options(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Tus-Resumable", Version)
+	h.Set("Tus-Version", Version)
+	h.Set("Tus-Extension", Extensions)
+	h.Set("Tus-Checksum-Algorithm", "sha1,md5,sha256")
+	if s.maxSize > 0 {
+		h.Set("Tus-Max-Size", strconv.FormatInt(s.maxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkVersion return false and write error response if client is using
+// unsupported protocol version.
+func (s *Server) checkVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", Version)
+	if r.Header.Get("Tus-Resumable") != Version {
+		w.Header().Set("Tus-Version", Version)
+		web.JSONErr(w, "unsupported protocol version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		web.JSONErr(w, "deferred length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		web.JSONErr(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if s.maxSize > 0 && length > s.maxSize {
+		web.StdJSONResp(w, http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		web.JSONErr(w, fmt.Sprintf("invalid Upload-Metadata: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	up := info{
+		ID:       newID(),
+		Length:   length,
+		Metadata: meta,
+		Expires:  time.Now().Add(s.expiry),
+	}
+	fd, err := os.OpenFile(s.contentPath(up.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("tus: cannot create upload: %s", err)
+		web.StdJSONResp(w, http.StatusInternalServerError)
+		return
+	}
+	fd.Close()
+	if err := s.writeInfo(&up); err != nil {
+		log.Printf("tus: cannot write upload info: %s", err)
+		os.Remove(s.contentPath(up.ID))
+		web.StdJSONResp(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", s.basePath+"/"+up.ID)
+	w.Header().Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Upload-Offset", "0")
+
+	// empty uploads are complete right away
+	if length == 0 {
+		if !s.lock(up.ID) {
+			web.StdJSONResp(w, http.StatusConflict)
+			return
+		}
+		defer s.unlock(up.ID)
+		if err := s.finish(&up); err != nil {
+			web.JSONErr(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) head(w http.ResponseWriter, id string) {
+	up, offset, err := s.readInfo(id)
+	if err != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	h.Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+	if len(up.Metadata) != 0 {
+		h.Set("Upload-Metadata", formatMetadata(up.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		web.StdJSONResp(w, http.StatusUnsupportedMediaType)
+		return
+	}
+	reqOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || reqOffset < 0 {
+		web.JSONErr(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	var checksum hash.Hash
+	var wantSum []byte
+	if raw := r.Header.Get("Upload-Checksum"); raw != "" {
+		if checksum, wantSum, err = parseChecksum(raw); err != nil {
+			web.JSONErr(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !s.lock(id) {
+		web.JSONErr(w, "upload is already in progress", http.StatusConflict)
+		return
+	}
+	defer s.unlock(id)
+
+	up, offset, err := s.readInfo(id)
+	if err != nil {
+		web.StdJSONResp(w, http.StatusNotFound)
+		return
+	}
+	if reqOffset != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		web.JSONErr(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+
+	fd, err := os.OpenFile(s.contentPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("tus: cannot open %s upload: %s", id, err)
+		web.StdJSONResp(w, http.StatusInternalServerError)
+		return
+	}
+	var dest io.Writer = fd
+	if checksum != nil {
+		dest = io.MultiWriter(fd, checksum)
+	}
+	// never accept more than declared upload length
+	n, copyErr := io.Copy(dest, io.LimitReader(r.Body, up.Length-offset))
+	fd.Close()
+
+	if checksum != nil {
+		if copyErr != nil || !bytes.Equal(checksum.Sum(nil), wantSum) {
+			// chunk must be discarded as whole
+			os.Truncate(s.contentPath(id), offset)
+			if copyErr != nil {
+				web.JSONErr(w, "incomplete chunk", http.StatusBadRequest)
+			} else {
+				web.JSONErr(w, "checksum mismatch", StatusChecksumMismatch)
+			}
+			return
+		}
+	}
+	// without checksum, partially received chunk is kept and client can
+	// resume from the last received byte
+
+	offset += n
+	up.Expires = time.Now().Add(s.expiry)
+	if err := s.writeInfo(up); err != nil {
+		log.Printf("tus: cannot update %s upload info: %s", id, err)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+
+	if copyErr != nil {
+		log.Printf("tus: %s upload interrupted: %s", id, copyErr)
+		web.JSONErr(w, "incomplete chunk", http.StatusBadRequest)
+		return
+	}
+
+	if offset == up.Length {
+		if err := s.finish(up); err != nil {
+			web.JSONErr(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finish pass completed upload to the handler and remove it. If handler
+// fails, upload is kept so that processing can be retried by sending an empty
+// PATCH request.
+func (s *Server) finish(up *info) error {
+	fd, err := os.Open(s.contentPath(up.ID))
+	if err != nil {
+		return fmt.Errorf("cannot open upload: %s", err)
+	}
+	err = s.complete(fd, up.Metadata)
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	s.remove(up.ID)
+	return nil
+}
+
+func (s *Server) terminate(w http.ResponseWriter, id string) {
+	if !s.lock(id) {
+		web.JSONErr(w, "upload is in progress", http.StatusConflict)
+		return
+	}
+	defer s.unlock(id)
+
+	if _, _, err := s.readInfo(id); err != nil {
+		web.StdJSONResp(w, http.StatusNotFound)
+		return
+	}
+	s.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sweep remove all expired uploads.
+func (s *Server) Sweep() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, path := range files {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		if !s.lock(id) {
+			continue
+		}
+		if up, _, err := s.readInfo(id); err != nil || up.Expires.Before(now) {
+			s.remove(id)
+		}
+		s.unlock(id)
+	}
+	return nil
+}
+
+// RunSweeper call Sweep with given interval, forever.
+func (s *Server) RunSweeper(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.Sweep(); err != nil {
+			log.Printf("tus: cannot remove expired uploads: %s", err)
+		}
+	}
+}
+
+func (s *Server) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.busy[id]; ok {
+		return false
+	}
+	s.busy[id] = struct{}{}
+	return true
+}
+
+func (s *Server) unlock(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+func (s *Server) contentPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *Server) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// readInfo return upload information and current offset. Expired uploads are
+// reported as not existing.
+func (s *Server) readInfo(id string) (*info, int64, error) {
+	b, err := ioutil.ReadFile(s.infoPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	var up info
+	if err := json.Unmarshal(b, &up); err != nil {
+		return nil, 0, fmt.Errorf("cannot decode upload info: %s", err)
+	}
+	if up.Expires.Before(time.Now()) {
+		return nil, 0, fmt.Errorf("upload expired")
+	}
+	st, err := os.Stat(s.contentPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &up, st.Size(), nil
+}
+
+func (s *Server) writeInfo(up *info) error {
+	b, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(up.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(up.ID))
+}
+
+func (s *Server) remove(id string) {
+	os.Remove(s.contentPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("cannot read random data: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// parseMetadata decode Upload-Metadata header value, which is comma
+// separated list of key and base64 encoded value pairs.
+func parseMetadata(raw string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(raw) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		chunks := strings.Fields(pair)
+		switch len(chunks) {
+		case 1:
+			meta[chunks[0]] = ""
+		case 2:
+			val, err := base64.StdEncoding.DecodeString(chunks[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %q value: %s", chunks[0], err)
+			}
+			meta[chunks[0]] = string(val)
+		default:
+			return nil, fmt.Errorf("invalid pair %q", pair)
+		}
+	}
+	return meta, nil
+}
+
+// formatMetadata encode metadata as Upload-Metadata header value.
+func formatMetadata(meta map[string]string) string {
+	pairs := make([]string, 0, len(meta))
+	for k, v := range meta {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseChecksum decode Upload-Checksum header value.
+func parseChecksum(raw string) (hash.Hash, []byte, error) {
+	chunks := strings.Fields(raw)
+	if len(chunks) != 2 {
+		return nil, nil, fmt.Errorf("invalid Upload-Checksum")
+	}
+	sum, err := base64.StdEncoding.DecodeString(chunks[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Upload-Checksum value: %s", err)
+	}
+	switch chunks[0] {
+	case "sha1":
+		return sha1.New(), sum, nil
+	case "md5":
+		return md5.New(), sum, nil
+	case "sha256":
+		return sha256.New(), sum, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", chunks[0])
+	}
+}
@@ -0,0 +1,155 @@
+package tus
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husio/gallery/web"
+)
+
+func TestUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tus")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		completed     []byte
+		completedMeta map[string]string
+	)
+	srv := NewServer(dir, "/files", 1000, time.Hour, func(fd io.ReadSeeker, meta map[string]string) error {
+		completed, _ = ioutil.ReadAll(fd)
+		completedMeta = meta
+		return nil
+	})
+	rt := web.NewRouter()
+	rt.Add(`/files`, "OPTIONS,POST", srv.Collection)
+	rt.Add(`/files/(id)`, "OPTIONS,HEAD,PATCH,DELETE", srv.Upload)
+
+	do := func(method, path string, body []byte, headers ...string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("cannot create request: %s", err)
+		}
+		r.Header.Set("Tus-Resumable", Version)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		return w
+	}
+	sha := func(b []byte) string {
+		sum := sha1.Sum(b)
+		return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	if w := do("OPTIONS", "/files", nil); w.Code != http.StatusNoContent || w.Header().Get("Tus-Version") != Version {
+		t.Fatalf("invalid OPTIONS response: %d %v", w.Code, w.Header())
+	}
+	if w := do("POST", "/files", nil, "Upload-Length", "1001"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("want too large upload to be rejected, got %d", w.Code)
+	}
+	if w := do("POST", "/files", nil, "Upload-Length", "10", "Tus-Resumable", "0.2.2"); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("want unsupported version to be rejected, got %d", w.Code)
+	}
+
+	w := do("POST", "/files", nil,
+		"Upload-Length", "11",
+		"Upload-Metadata", "filename cGhvdG8uanBn,tags a29yZWEsamVqdQ==")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("cannot create upload: %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/files/") {
+		t.Fatalf("invalid location: %q", location)
+	}
+
+	const ct = "application/offset+octet-stream"
+
+	if w := do("PATCH", location, []byte("hello"), "Content-Type", ct, "Upload-Offset", "0", "Upload-Checksum", sha([]byte("hello"))); w.Code != http.StatusNoContent {
+		t.Fatalf("cannot upload first chunk: %d %s", w.Code, w.Body)
+	}
+	if w := do("PATCH", location, []byte(" world"), "Content-Type", ct, "Upload-Offset", "0"); w.Code != http.StatusConflict {
+		t.Fatalf("want offset mismatch, got %d", w.Code)
+	}
+	if w := do("PATCH", location, []byte(" world"), "Content-Type", ct, "Upload-Offset", "5", "Upload-Checksum", sha([]byte("invalid"))); w.Code != StatusChecksumMismatch {
+		t.Fatalf("want checksum mismatch, got %d", w.Code)
+	}
+
+	w = do("HEAD", location, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("invalid HEAD response: %d %v", w.Code, w.Header())
+	}
+	if completed != nil {
+		t.Fatal("upload completed too early")
+	}
+
+	if w := do("PATCH", location, []byte(" world"), "Content-Type", ct, "Upload-Offset", "5", "Upload-Checksum", sha([]byte(" world"))); w.Code != http.StatusNoContent {
+		t.Fatalf("cannot upload last chunk: %d %s", w.Code, w.Body)
+	}
+	if string(completed) != "hello world" {
+		t.Fatalf("want hello world, got %q", completed)
+	}
+	if completedMeta["filename"] != "photo.jpg" || completedMeta["tags"] != "korea,jeju" {
+		t.Fatalf("invalid metadata: %v", completedMeta)
+	}
+	if w := do("HEAD", location, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("want completed upload to be removed, got %d", w.Code)
+	}
+}
+
+func TestTerminateAndExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tus")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewServer(dir, "/files", 0, time.Hour, func(io.ReadSeeker, map[string]string) error { return nil })
+	rt := web.NewRouter()
+	rt.Add(`/files`, "OPTIONS,POST", srv.Collection)
+	rt.Add(`/files/(id)`, "OPTIONS,HEAD,PATCH,DELETE", srv.Upload)
+
+	create := func() string {
+		r, _ := http.NewRequest("POST", "/files", nil)
+		r.Header.Set("Tus-Resumable", Version)
+		r.Header.Set("Upload-Length", "100")
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("cannot create upload: %d", w.Code)
+		}
+		return w.Header().Get("Location")
+	}
+
+	location := create()
+	r, _ := http.NewRequest("DELETE", location, nil)
+	r.Header.Set("Tus-Resumable", Version)
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("cannot terminate upload: %d", w.Code)
+	}
+
+	create()
+	srv.expiry = -time.Second
+	create()
+	if err := srv.Sweep(); err != nil {
+		t.Fatalf("cannot sweep: %s", err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Fatalf("want only one upload (2 files) to remain, got %d files", len(files))
+	}
+}
@@ -3,14 +3,177 @@ CREATE TABLE images (
     width         INTEGER NOT NULL,
     height        INTEGER NOT NULL,
     orientation   INTEGER NOT NULL,
+    media_type    TEXT NOT NULL DEFAULT 'image/jpeg',
+    latitude      REAL,
+    longitude     REAL,
+    altitude      REAL,
+    focus_x       REAL,
+    focus_y       REAL,
+    title         TEXT NOT NULL DEFAULT '',
+    caption       TEXT NOT NULL DEFAULT '',
+    alt_text      TEXT NOT NULL DEFAULT '',
     created       TIMESTAMP NOT NULL
 );
 
+CREATE INDEX images_location_idx ON images(latitude, longitude);
+
 
 CREATE TABLE tags (
     name         TEXT NOT NULL,
     image_id     TEXT NOT NULL REFERENCES images(image_id),
     created      TIMESTAMP NOT NULL,
+    auto         BOOLEAN NOT NULL DEFAULT 0,
 
     PRIMARY KEY(name, image_id)
 );
+
+
+CREATE TABLE tag_aliases (
+    alias        TEXT NOT NULL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    created      TIMESTAMP NOT NULL
+);
+
+
+CREATE TABLE image_exif (
+    image_id      TEXT NOT NULL PRIMARY KEY REFERENCES images(image_id),
+    make          TEXT NOT NULL DEFAULT '',
+    model         TEXT NOT NULL DEFAULT '',
+    lens          TEXT NOT NULL DEFAULT '',
+    focal_length  REAL NOT NULL DEFAULT 0,
+    aperture      REAL NOT NULL DEFAULT 0,
+    exposure_time REAL NOT NULL DEFAULT 0,
+    iso           INTEGER NOT NULL DEFAULT 0,
+    flash         BOOLEAN NOT NULL DEFAULT 0,
+    software      TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX image_exif_model_idx ON image_exif(make, model);
+
+
+CREATE TABLE image_hashes (
+    image_id      TEXT NOT NULL PRIMARY KEY REFERENCES images(image_id),
+    dhash         INTEGER NOT NULL
+);
+
+
+CREATE TABLE image_colors (
+    image_id      TEXT NOT NULL REFERENCES images(image_id),
+    position      INTEGER NOT NULL,
+    color         TEXT NOT NULL,
+    weight        REAL NOT NULL,
+    lab_l         REAL NOT NULL,
+    lab_a         REAL NOT NULL,
+    lab_b         REAL NOT NULL,
+
+    PRIMARY KEY(image_id, position)
+);
+
+
+CREATE TABLE image_quality (
+    image_id      TEXT NOT NULL PRIMARY KEY REFERENCES images(image_id),
+    quality       REAL NOT NULL,
+    sharpness     REAL NOT NULL,
+    exposure      REAL NOT NULL,
+    brightness    REAL NOT NULL,
+    shadows       REAL NOT NULL,
+    highlights    REAL NOT NULL
+);
+
+CREATE INDEX image_quality_quality_idx ON image_quality(quality);
+
+
+-- Full text search index. Texts of every image are collected by the
+-- image_search_source view into image_search_docs table, that is kept in
+-- sync by triggers and indexed by image_search. Automatically created tags
+-- are place names.
+CREATE VIEW image_search_source AS
+    SELECT
+        i.image_id,
+        trim(i.title || ' ' || i.alt_text) AS title,
+        i.caption,
+        coalesce((SELECT group_concat(t.name, ' ') FROM tags t WHERE t.image_id = i.image_id AND NOT t.auto), '') AS tags,
+        coalesce((SELECT group_concat(t.name, ' ') FROM tags t WHERE t.image_id = i.image_id AND t.auto), '') AS places,
+        coalesce((SELECT trim(e.make || ' ' || e.model || ' ' || e.lens) FROM image_exif e WHERE e.image_id = i.image_id), '') AS camera
+    FROM images i;
+
+CREATE TABLE image_search_docs (
+    docid         INTEGER PRIMARY KEY,
+    image_id      TEXT NOT NULL UNIQUE,
+    title         TEXT NOT NULL,
+    caption       TEXT NOT NULL,
+    tags          TEXT NOT NULL,
+    places        TEXT NOT NULL,
+    camera        TEXT NOT NULL
+);
+
+CREATE VIRTUAL TABLE image_search USING fts5(
+    title, caption, tags, places, camera,
+    content = 'image_search_docs',
+    content_rowid = 'docid',
+    tokenize = 'unicode61 remove_diacritics 2'
+);
+
+-- title is the most relevant, camera the least
+INSERT INTO image_search(image_search, rank) VALUES('rank', 'bm25(10.0, 5.0, 5.0, 3.0, 1.0)');
+
+CREATE TRIGGER image_search_docs_ai AFTER INSERT ON image_search_docs BEGIN
+    INSERT INTO image_search (rowid, title, caption, tags, places, camera)
+    VALUES (new.docid, new.title, new.caption, new.tags, new.places, new.camera);
+END;
+
+CREATE TRIGGER image_search_docs_ad AFTER DELETE ON image_search_docs BEGIN
+    INSERT INTO image_search (image_search, rowid, title, caption, tags, places, camera)
+    VALUES ('delete', old.docid, old.title, old.caption, old.tags, old.places, old.camera);
+END;
+
+CREATE TRIGGER images_search_ai AFTER INSERT ON images BEGIN
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id = new.image_id;
+END;
+
+CREATE TRIGGER images_search_au AFTER UPDATE OF title, caption, alt_text ON images BEGIN
+    DELETE FROM image_search_docs WHERE image_id = new.image_id;
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id = new.image_id;
+END;
+
+CREATE TRIGGER images_search_ad AFTER DELETE ON images BEGIN
+    DELETE FROM image_search_docs WHERE image_id = old.image_id;
+END;
+
+CREATE TRIGGER tags_search_ai AFTER INSERT ON tags BEGIN
+    DELETE FROM image_search_docs WHERE image_id = new.image_id;
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id = new.image_id;
+END;
+
+CREATE TRIGGER tags_search_au AFTER UPDATE ON tags BEGIN
+    DELETE FROM image_search_docs WHERE image_id IN (old.image_id, new.image_id);
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id IN (old.image_id, new.image_id);
+END;
+
+CREATE TRIGGER tags_search_ad AFTER DELETE ON tags BEGIN
+    DELETE FROM image_search_docs WHERE image_id = old.image_id;
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id = old.image_id;
+END;
+
+CREATE TRIGGER image_exif_search_ai AFTER INSERT ON image_exif BEGIN
+    DELETE FROM image_search_docs WHERE image_id = new.image_id;
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id = new.image_id;
+END;
+
+CREATE TRIGGER image_exif_search_au AFTER UPDATE ON image_exif BEGIN
+    DELETE FROM image_search_docs WHERE image_id IN (old.image_id, new.image_id);
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id IN (old.image_id, new.image_id);
+END;
+
+CREATE TRIGGER image_exif_search_ad AFTER DELETE ON image_exif BEGIN
+    DELETE FROM image_search_docs WHERE image_id = old.image_id;
+    INSERT INTO image_search_docs (image_id, title, caption, tags, places, camera)
+    SELECT * FROM image_search_source WHERE image_id = old.image_id;
+END;
@@ -84,3 +84,8 @@ func (x *sqlxdb) Select(dest interface{}, query string, args ...interface{}) err
 func (x *sqlxdb) Exec(query string, args ...interface{}) (sql.Result, error) {
 	return x.dbx.Exec(query, args...)
 }
+
+// NewDatabase return Database implementation using given sqlx database.
+func NewDatabase(db *sqlx.DB) Database {
+	return &sqlxdb{dbx: db}
+}